@@ -1,31 +1,28 @@
 package agent
 
 import (
-	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
-	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net"
-	"net/http"
 	"os"
-	"os/signal"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
-	"syscall"
+	"sync"
 	"time"
 
-	"github.com/cilium/ebpf"
-	"github.com/cilium/ebpf/link"
-	"github.com/cilium/ebpf/rlimit"
+	"github.com/prometheus/client_golang/prometheus"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/homedir"
 
@@ -33,234 +30,888 @@ import (
 	"github.com/polarsignals/kubezonnet/payload"
 )
 
-func Run(node, subnetCidr, server string, flushInterval time.Duration, debug, sendData bool) error {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+// FlowSource provides the flows captured on the node.
+type FlowSource interface {
+	// Collect returns the flows captured since the previous call and resets
+	// them. The returned slices are only valid until the next call.
+	Collect(ctx context.Context) ([]payload.IPKey, []payload.IPValue, error)
+}
 
-	config, err := rest.InClusterConfig()
-	if err != nil {
-		kubeconfig := filepath.Join(homedir.HomeDir(), ".kube", "config")
-		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+// CIDRFilter is implemented by FlowSources that can filter the flows they
+// capture by CIDR.
+type CIDRFilter interface {
+	SetCIDRs(subnets, excludes []*net.IPNet) error
+}
+
+// PressureNotifier is implemented by FlowSources that can signal that they
+// are running out of capacity before the flush interval has passed.
+type PressureNotifier interface {
+	Pressure() <-chan struct{}
+}
+
+// Sampler is implemented by FlowSources that only capture a sample of the
+// packets. The packet sizes they return are scaled up by the agent.
+type Sampler interface {
+	// SampleRate returns N if 1 in N packets is captured.
+	SampleRate() uint32
+}
+
+// CaptureDescriber is implemented by FlowSources that can describe how they
+// capture traffic.
+type CaptureDescriber interface {
+	CaptureMode() string
+}
+
+// InterfaceRecorder is implemented by FlowSources that may not know the
+// interface flows left the node on. Sources that don't implement it are
+// assumed to record the interface.
+type InterfaceRecorder interface {
+	RecordsInterfaces() bool
+}
+
+// PodLister lists the pods running on the agent's node.
+type PodLister interface {
+	List() []*v1.Pod
+}
+
+// Options configures an Agent.
+type Options struct {
+	// Node is the name of the Kubernetes node the agent is running on.
+	Node string
+	// Version is the version of the agent, which is sent to the servers.
+	Version string
+	// Config holds the settings of the agent. If ConfigFile is set, these are
+	// only the defaults for settings not present in the file.
+	Config Config
+	// ConfigFile is an optional configuration file that is watched for
+	// changes.
+	ConfigFile string
+	// SendData enables sending batches to the servers of the Config. The
+	// debug output and Sinks are written to regardless.
+	SendData bool
+	// Debug prints every flow to stderr.
+	Debug bool
+
+	// KubeConfig is used to talk to the API server. If nil, the in-cluster
+	// config or ~/.kube/config is used. It is only needed if Pods is nil or
+	// CIDR discovery is enabled.
+	KubeConfig *rest.Config
+	// Source captures the flows. If nil, a BPFSource is created with the
+	// BPF options.
+	Source FlowSource
+	BPF    BPFOptions
+	// CaptureProfile is the name of the capture profile of the BPFSource.
+	// If empty or CaptureProfileAuto, it is detected from the CNI
+	// configuration in CNIConfDir, DefaultCNIConfDir if empty.
+	CaptureProfile string
+	CNIConfDir     string
+	// Pods lists the pods on the node, only flows originating from these are
+	// kept. If nil, the pods are read from PodSource, PodSourceAPIServer if
+	// empty, and with PodSourceKubelet from the kubelet configured by Kubelet.
+	Pods      PodLister
+	PodSource string
+	Kubelet   KubeletOptions
+	// Namespaces are used to ignore the pods of namespaces annotated with
+	// IgnoreAnnotation. If nil, they are watched using the API server when
+	// Pods is nil as well.
+	Namespaces NamespaceGetter
+	// Sinks receive every batch in addition to the servers of the Config.
+	Sinks []Sink
+	// Registerer is used to register the agent's metrics, if set.
+	Registerer prometheus.Registerer
+}
+
+// Agent periodically collects flows from a FlowSource, filters and
+// aggregates them and writes them to Sinks.
+type Agent struct {
+	opts Options
+	// config is the configuration in effect, localConfig with serverConfig
+	// applied on top.
+	config       Config
+	localConfig  Config
+	serverConfig serverConfig
+	// configContent is the content of the configuration file that New
+	// parsed, changes from it are applied by Run.
+	configContent []byte
+	metrics       *metrics
+
+	// mtx protects source and pods, which are set up by Run while the debug
+	// endpoint may already be serving.
+	mtx        sync.RWMutex
+	source     FlowSource
+	pods       PodLister
+	namespaces NamespaceGetter
+	// podIPs keeps the IPs of pods on the node that were deleted during the
+	// current window.
+	podIPs *podIPCache
+
+	// bpfOptions are the options the BPFSource was created with, nil if the
+	// source was provided by the options.
+	bpfOptions *BPFOptions
+
+	sinks    []Sink
+	httpSink *HTTPSink
+	grpcSink *GRPCSink
+
+	discoveredCIDRs []string
+	// discover starts discovering CIDRs in a mode until ctx is done.
+	discover func(ctx context.Context, mode string) (<-chan []string, error)
+	// discovered receives the CIDRs of the current discovery mode, which is
+	// stopped by stopDiscovery.
+	discovered    <-chan []string
+	stopDiscovery context.CancelFunc
+
+	// instanceID identifies the agent process to the servers, which
+	// deduplicate its batches by their sequence number.
+	instanceID string
+	sequence   uint64
+	// windowStart is when the current window started.
+	windowStart time.Time
+
+	ephemeralMin uint16
+	ephemeralMax uint16
+}
+
+// New creates an agent. If a configuration file is set, it is loaded on top
+// of the configuration of the options.
+func New(opts Options) (*Agent, error) {
+	if opts.Node == "" {
+		return nil, errors.New("node name must not be empty")
+	}
+	switch opts.PodSource {
+	case "", PodSourceAPIServer, PodSourceKubelet:
+	default:
+		return nil, fmt.Errorf("unknown pod source %q, must be one of %q or %q", opts.PodSource, PodSourceAPIServer, PodSourceKubelet)
+	}
+	if name := opts.CaptureProfile; name != "" && name != CaptureProfileAuto {
+		if _, err := LookupCaptureProfile(name); err != nil {
+			return nil, err
+		}
+	}
+
+	config := opts.Config
+	var configContent []byte
+	if opts.ConfigFile != "" {
+		var err error
+		config, configContent, err = loadConfigFile(opts.ConfigFile, opts.Config)
 		if err != nil {
-			log.Fatalf("Error creating kubernetes config: %v", err)
+			return nil, err
+		}
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	if opts.Source == nil && opts.BPF.SampleRate > 1 {
+		if err := config.requireVersioned("sampling"); err != nil {
+			return nil, fmt.Errorf("invalid config: %w", err)
 		}
 	}
 
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		log.Fatalf("Error creating kubernetes client: %v", err)
+	reg := opts.Registerer
+	if reg == nil {
+		reg = prometheus.NewRegistry()
 	}
 
-	fmt.Println("Watching pods for node: ", node)
-	factory := informers.NewSharedInformerFactoryWithOptions(clientset, 0,
-		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
-			options.FieldSelector = "spec.nodeName=" + node
-		}))
-	informer := factory.Core().V1().Pods().Informer()
-	go informer.Run(ctx.Done())
+	a := &Agent{
+		opts:          opts,
+		config:        config,
+		localConfig:   config,
+		configContent: configContent,
+		metrics:       newMetrics(reg),
+		source:        opts.Source,
+		pods:          opts.Pods,
+		namespaces:    opts.Namespaces,
+		sinks:         slices.Clone(opts.Sinks),
+	}
+	a.podIPs = newPodIPCache(a.ignoredPod)
 
-	ip, ipNet, err := net.ParseCIDR(subnetCidr)
-	if err != nil || ip == nil || ip.To4() == nil {
-		fmt.Println("Error: Invalid subnet CIDR")
-		flag.Usage()
-		os.Exit(1)
+	var instanceID [16]byte
+	if _, err := rand.Read(instanceID[:]); err != nil {
+		return nil, fmt.Errorf("generate instance ID: %w", err)
 	}
+	a.instanceID = hex.EncodeToString(instanceID[:])
 
-	// Convert IP to uint32
-	ipUint := ipToUint32(ip)
+	if opts.Debug {
+		// Stdout is reserved for the flows written as JSON.
+		a.sinks = append(a.sinks, debugSink{w: os.Stderr})
+	}
+	if opts.SendData {
+		httpServers, grpcServers := splitServers(config.Servers)
+		httpSink, err := NewHTTPSink(httpServers, config.TLS, config.PayloadVersion)
+		if err != nil {
+			return nil, err
+		}
+		grpcSink, err := NewGRPCSink(grpcServers, config.TLS)
+		if err != nil {
+			return nil, err
+		}
+		a.httpSink, a.grpcSink = httpSink, grpcSink
+		a.sinks = append(a.sinks, httpSink, grpcSink)
+	}
 
-	// Convert subnet mask to uint32
-	maskUint := maskToUint32(ipNet.Mask)
+	var err error
+	a.ephemeralMin, a.ephemeralMax, err = readEphemeralPortRange(ipLocalPortRangeFile)
+	if err != nil {
+		log.Println("failed to read ephemeral port range, using defaults:", err)
+		a.ephemeralMin, a.ephemeralMax = defaultEphemeralPortMin, defaultEphemeralPortMax
+	}
 
-	// Print the converted values
-	fmt.Printf("Subnet CIDR: %s\n", subnetCidr)
-	fmt.Printf("IP Prefix: %s -> %x\n", ip.String(), ipUint)
-	fmt.Printf("Subnet Mask: %s -> %x\n", net.IP(ipNet.Mask).String(), maskUint)
+	return a, nil
+}
 
-	// Remove resource limits for kernels <5.11.
-	if err := rlimit.RemoveMemlock(); err != nil {
-		return fmt.Errorf("removing memlock: %w", err)
+// Run runs the agent until ctx is cancelled.
+func (a *Agent) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	kubeConfig := a.opts.KubeConfig
+	if kubeConfig == nil && (a.pods == nil || a.config.CIDRDiscovery != "") {
+		var err error
+		kubeConfig, err = loadKubeConfig()
+		if err != nil {
+			return err
+		}
 	}
 
-	// Load the compiled eBPF ELF and load it into the kernel.
-	spec, err := loadKubezonnet()
-	if err != nil {
-		return fmt.Errorf("load eBPF program: %w", err)
+	if a.pods == nil {
+		if a.namespaces == nil {
+			namespaces, err := watchNamespaces(ctx, kubeConfig)
+			if err != nil {
+				return err
+			}
+			a.mtx.Lock()
+			a.namespaces = namespaces
+			a.mtx.Unlock()
+		}
+
+		var pods PodLister
+		var err error
+		if a.opts.PodSource == PodSourceKubelet {
+			pods, err = pollKubeletPods(ctx, kubeConfig, a.opts.Kubelet, a.podIPs)
+		} else {
+			pods, err = watchPodsOnNode(ctx, kubeConfig, a.opts.Node, a.podIPs)
+		}
+		if err != nil {
+			return err
+		}
+		a.mtx.Lock()
+		a.pods = pods
+		a.mtx.Unlock()
 	}
 
-	if err := spec.RewriteConstants(map[string]interface{}{
-		"subnet_prefix": byteorder.Htonl(ipUint),
-		"subnet_mask":   byteorder.Htonl(maskUint),
-	}); err != nil {
-		return fmt.Errorf("configure eBPF program: %w", err)
+	if a.source == nil {
+		bpfOpts := a.opts.BPF
+		bpfOpts.Profile = a.captureProfile(ctx, kubeConfig)
+		source, err := NewBPFSource(bpfOpts)
+		if err != nil {
+			return err
+		}
+		// The source is replaced when the sample rate changes.
+		defer func() {
+			a.mtx.Lock()
+			defer a.mtx.Unlock()
+			a.source.(*BPFSource).Close()
+			a.source = nil
+		}()
+		a.mtx.Lock()
+		a.source = source
+		a.bpfOptions = &bpfOpts
+		a.mtx.Unlock()
 	}
 
-	var objs kubezonnetObjects
-	if err := spec.LoadAndAssign(&objs, nil); err != nil {
-		return fmt.Errorf("load eBPF objects: %w", err)
+	if err := a.applyFilters(); err != nil {
+		return fmt.Errorf("configure filters: %w", err)
 	}
-	defer objs.Close()
 
-	link, err := link.AttachNetfilter(link.NetfilterOptions{
-		ProtocolFamily: 2, // IPv4
-		HookNumber:     4, // netfilter postrouting
-		Program:        objs.NfPostroutingHook,
-	})
+	if a.discover == nil {
+		a.discover = func(ctx context.Context, mode string) (<-chan []string, error) {
+			return discoverCIDRs(ctx, kubeConfig, mode)
+		}
+	}
+	discoveryCtx, stopDiscovery := context.WithCancel(ctx)
+	a.discovered, a.stopDiscovery = nil, stopDiscovery
+	defer func() { a.stopDiscovery() }()
+	discovered, err := a.discover(discoveryCtx, a.config.CIDRDiscovery)
 	if err != nil {
-		return fmt.Errorf("attach netfilter: %w", err)
+		return fmt.Errorf("discover CIDRs: %w", err)
 	}
-	defer link.Close()
+	a.discovered = discovered
 
-	// Channel to listen to interrupt signals
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	var reloads <-chan Config
+	if a.opts.ConfigFile != "" {
+		reloads = watchConfigFile(ctx, a.opts.ConfigFile, configReloadInterval, a.opts.Config, a.configContent)
+	}
+
+	pressure := a.pressure()
 
-	ticker := time.NewTicker(flushInterval)
+	var serverConfigs, registrationConfigs <-chan serverConfig
+	if a.grpcSink != nil {
+		defer a.grpcSink.Close()
+		// Streams are opened before the first flush, so that servers
+		// know the agent and configure it even without traffic.
+		a.grpcSink.start(a.registration())
+		serverConfigs = a.grpcSink.configUpdates()
+	}
+	if a.httpSink != nil {
+		// Registering before the first flush lets servers configure the
+		// agent.
+		a.httpSink.register(ctx, a.registration())
+		registrationConfigs = a.httpSink.configUpdates()
+	}
+
+	ticker := time.NewTicker(a.flushInterval())
 	defer ticker.Stop()
+	a.windowStart = time.Now()
 
-	size := objs.IpMap.MaxEntries()
-	keys := make([]payload.IPKey, size)
-	values := make([]payload.IPValue, size)
 	for {
 		select {
-		case <-stop:
-			fmt.Println("Shutting down...")
-			return nil
 		case <-ctx.Done():
-			fmt.Println("Shutting down...")
+			log.Println("shutting down")
 			return nil
-		case <-ticker.C:
-			log.Println("reading data from eBPF maps")
-			keys = keys[:size]
-			values = values[:size]
-			opts := &ebpf.BatchOptions{}
-			cursor := new(ebpf.MapBatchCursor)
-			n, err := objs.IpMap.BatchLookupAndDelete(cursor, keys, values, opts)
-			if n <= 0 {
-				log.Println("no data, skipping")
+		case newConfig, ok := <-reloads:
+			if !ok {
+				reloads = nil
 				continue
 			}
-			if err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
-				log.Println("failed to read data:", err)
+			log.Println("config file changed, reloading")
+			flushInterval := a.flushInterval()
+			if err := a.reloadConfig(ctx, newConfig); err != nil {
+				log.Println("failed to reload config, keeping previous settings:", err)
+			}
+			if a.flushInterval() != flushInterval {
+				ticker.Reset(a.flushInterval())
+			}
+		case config := <-serverConfigs:
+			a.applyServerConfig(ctx, config, ticker)
+			pressure = a.pressure()
+		case config := <-registrationConfigs:
+			a.applyServerConfig(ctx, config, ticker)
+			pressure = a.pressure()
+		case cidrs, ok := <-a.discovered:
+			if !ok {
+				a.discovered = nil
 				continue
 			}
-			keys = keys[:n]
-			values = values[:n]
-
-			pods := convertToPods(informer.GetStore().List())
-			finalKeys, finalValues := filterSrcIpOnCurrentHost(keys, values, pods)
-
-			if debug {
-				log.Println("debug printing", len(finalKeys), "keys, started with", n, "keys before filtering to host-local pods (", len(pods), ")")
-				for i := 0; i < len(finalKeys); i++ {
-					srcIP := net.IPv4(byte(finalKeys[i].SrcIP), byte(finalKeys[i].SrcIP>>8), byte(finalKeys[i].SrcIP>>16), byte(finalKeys[i].SrcIP>>24)).String()
-					dstIP := net.IPv4(byte(finalKeys[i].DstIP), byte(finalKeys[i].DstIP>>8), byte(finalKeys[i].DstIP>>16), byte(finalKeys[i].DstIP>>24)).String()
-					fmt.Printf("%s:%d -> %s:%d: %d bytes\n", srcIP, finalKeys[i].SrcPort, dstIP, finalKeys[i].DstPort, finalValues[i].PacketSize)
-				}
+			log.Println("discovered", len(cidrs), "CIDRs to monitor")
+			a.discoveredCIDRs = cidrs
+			if err := a.applyFilters(); err != nil {
+				log.Println("failed to update filters:", err)
 			}
-
-			if sendData {
-				if len(finalKeys) > 0 {
-					log.Println("sending data to the server")
-					if err := sendDataToServer(ctx, server, finalKeys, finalValues); err != nil {
-						log.Println(err)
-					}
-				}
-			} else {
-				log.Println("sending data disabled, skipping")
+		case <-ticker.C:
+			if err := a.flush(ctx); err != nil {
+				log.Println(err)
 			}
+		case <-pressure:
+			log.Println("flow source is running out of capacity, flushing early")
+			a.metrics.earlyFlushes.Inc()
+			if err := a.flush(ctx); err != nil {
+				log.Println(err)
+			}
+			ticker.Reset(a.flushInterval())
 		}
 	}
 }
 
-func convertToPods(objs []interface{}) []*v1.Pod {
-	res := make([]*v1.Pod, 0, len(objs))
+// applyServerConfig applies the configuration a server asked for on top of
+// the agent's own. Invalid configurations are ignored.
+func (a *Agent) applyServerConfig(ctx context.Context, config serverConfig, ticker *time.Ticker) {
+	merged := a.localConfig.withServerConfig(config)
+	if err := merged.Validate(); err != nil {
+		log.Printf("ignoring invalid server configuration %s: %v", config.Revision, err)
+		return
+	}
+	log.Printf("applying server configuration %s", config.Revision)
 
-	for _, obj := range objs {
-		res = append(res, obj.(*v1.Pod))
+	if err := a.setFilters(merged); err != nil {
+		log.Printf("ignoring server configuration %s, failed to update filters: %v", config.Revision, err)
+		return
+	}
+	flushInterval := a.flushInterval()
+	previous := a.serverConfig
+	a.serverConfig = config
+	a.config = merged
+	if config.SampleRate != previous.SampleRate {
+		if err := a.resample(ctx); err != nil {
+			log.Println("failed to change the sample rate:", err)
+		}
+	}
+	if a.flushInterval() != flushInterval {
+		ticker.Reset(a.flushInterval())
 	}
+}
 
-	return res
+// sampleRate returns the sample rate asked for by a server, or the one of the
+// BPF options.
+func (a *Agent) sampleRate() uint32 {
+	if a.serverConfig.SampleRate > 0 {
+		return a.serverConfig.SampleRate
+	}
+	return a.opts.BPF.SampleRate
 }
 
-func filterSrcIpOnCurrentHost(keys []payload.IPKey, values []payload.IPValue, podsOnHost []*v1.Pod) ([]payload.IPKey, []payload.IPValue) {
-	ipsOnHost := make(map[uint32]struct{}, len(podsOnHost)) // pods may have multiple IPs so this is just an approximation
+// resample replaces the BPFSource with one using the current sample rate,
+// which is a constant of the eBPF program. The new source is attached before
+// the previous one is detached, so that no packets are missed, and the flows
+// the previous one captured until then are flushed before it is closed. The
+// packets captured by both in between are counted twice. If the new source
+// can't be created, the previous one is kept. Provided sources are left as
+// they are.
+//
+// Only sources using the agent's own sample rate are pinned, as a restarted
+// agent starts with its own rate and would discard objects pinned with the
+// server's. Resampling to the server's rate removes the pinned objects, so
+// that they don't keep counting.
+func (a *Agent) resample(ctx context.Context) error {
+	if a.bpfOptions == nil || a.bpfOptions.SampleRate == a.sampleRate() {
+		return nil
+	}
 
-	for _, pod := range podsOnHost {
-		for _, podIP := range pod.Status.PodIPs {
-			ip := net.ParseIP(podIP.IP)
-			if ip == nil || ip.To4() == nil {
-				log.Println("ip is not IPv4, currently only IPv4 is supported")
-				continue
-			}
+	opts := *a.bpfOptions
+	opts.SampleRate = a.sampleRate()
+	opts.PinPath = ""
+	if opts.SampleRate == a.opts.BPF.SampleRate {
+		opts.PinPath = a.opts.BPF.PinPath
+	}
+	source, err := NewBPFSource(opts)
+	if err != nil {
+		return fmt.Errorf("create BPF source with sample rate %d: %w", opts.SampleRate, err)
+	}
+	if err := a.filterSource(source, a.config); err != nil {
+		source.Close()
+		return fmt.Errorf("configure filters: %w", err)
+	}
 
-			ipsOnHost[ipToUint32(ip)] = struct{}{}
+	previous := a.source.(*BPFSource)
+	if pinPath := a.bpfOptions.PinPath; pinPath != "" && opts.PinPath == "" {
+		// Pinned links stay attached until they are unpinned.
+		if err := Unpin(pinPath); err != nil {
+			log.Println("failed to unpin the previous BPF source:", err)
 		}
 	}
+	if err := previous.closeLinks(); err != nil {
+		log.Println("failed to detach the previous BPF source:", err)
+	}
+	if err := a.flush(ctx); err != nil {
+		log.Println(err)
+	}
 
-	resKeys := make([]payload.IPKey, 0, len(keys))
-	resValues := make([]payload.IPValue, 0, len(values))
-	for i := range keys {
-		if _, found := ipsOnHost[byteorder.Ntohl(keys[i].SrcIP)]; found {
-			resKeys = append(resKeys, keys[i])
-			resValues = append(resValues, values[i])
+	a.mtx.Lock()
+	a.source = source
+	a.bpfOptions = &opts
+	a.mtx.Unlock()
+	if err := previous.Close(); err != nil {
+		log.Println("failed to close the previous BPF source:", err)
+	}
+
+	log.Println("changed the sample rate to", opts.SampleRate)
+	return nil
+}
+
+// pressure returns the channel the source signals pressure on, nil if it
+// can't.
+func (a *Agent) pressure() <-chan struct{} {
+	if notifier, ok := a.source.(PressureNotifier); ok {
+		return notifier.Pressure()
+	}
+	return nil
+}
+
+// registration describes the agent and its capabilities to the servers.
+func (a *Agent) registration() payload.Registration {
+	release, err := kernelRelease()
+	if err != nil {
+		log.Println("failed to read the kernel release:", err)
+	}
+	return payload.Registration{
+		Node:            a.opts.Node,
+		InstanceID:      a.instanceID,
+		AgentVersion:    a.opts.Version,
+		KernelRelease:   release,
+		CaptureMode:     a.captureMode(),
+		PayloadVersions: payload.Versions,
+		Compressions:    []string{payload.CompressionGzip},
+	}
+}
+
+// captureMode describes how the source captures traffic, empty if it can't
+// tell.
+func (a *Agent) captureMode() string {
+	if describer, ok := a.source.(CaptureDescriber); ok {
+		return describer.CaptureMode()
+	}
+	return ""
+}
+
+func (a *Agent) flushInterval() time.Duration {
+	return a.config.FlushInterval.Duration
+}
+
+// components returns the flow source and pod lister, which are nil until Run
+// has set them up.
+func (a *Agent) components() (FlowSource, PodLister) {
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+	return a.source, a.pods
+}
+
+// ignoredPod reports whether the traffic of pod is ignored because of
+// IgnoreAnnotation.
+func (a *Agent) ignoredPod(pod *v1.Pod) bool {
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+	return ignoredPod(pod, a.namespaces)
+}
+
+// reloadConfig applies a changed configuration file. If the CIDR discovery
+// mode changed, the new mode is started first and replaces the previous one
+// only once the configuration was applied. The previously discovered CIDRs
+// are kept until the new mode discovered its own, so that flows aren't
+// dropped in between.
+func (a *Agent) reloadConfig(ctx context.Context, config Config) error {
+	if config.CIDRDiscovery == a.config.CIDRDiscovery {
+		return a.reload(config)
+	}
+
+	discoveryCtx, stopDiscovery := context.WithCancel(ctx)
+	discovered, err := a.discover(discoveryCtx, config.CIDRDiscovery)
+	if err != nil {
+		stopDiscovery()
+		return fmt.Errorf("discover CIDRs: %w", err)
+	}
+	previousCIDRs := a.discoveredCIDRs
+	if config.CIDRDiscovery == "" {
+		a.discoveredCIDRs = nil
+	}
+	if err := a.reload(config); err != nil {
+		stopDiscovery()
+		a.discoveredCIDRs = previousCIDRs
+		if restoreErr := a.applyFilters(); restoreErr != nil {
+			err = errors.Join(err, fmt.Errorf("restore filters: %w", restoreErr))
+		}
+		return err
+	}
+	a.stopDiscovery()
+	a.discovered, a.stopDiscovery = discovered, stopDiscovery
+	return nil
+}
+
+// reload applies a changed configuration, keeping the settings of the
+// server's configuration. The sinks and filters are updated before the
+// configuration is replaced, and on error the previous settings are kept.
+func (a *Agent) reload(config Config) error {
+	if a.opts.BPF.SampleRate > 1 && a.bpfOptions != nil {
+		if err := config.requireVersioned("sampling"); err != nil {
+			return err
+		}
+	}
+	merged := config.withServerConfig(a.serverConfig)
+	if err := a.updateSinks(config, a.localConfig); err != nil {
+		return err
+	}
+	if err := a.setFilters(merged); err != nil {
+		err = fmt.Errorf("update filters: %w", err)
+		if restoreErr := a.updateSinks(a.localConfig, config); restoreErr != nil {
+			err = errors.Join(err, fmt.Errorf("restore sinks: %w", restoreErr))
+		}
+		if restoreErr := a.applyFilters(); restoreErr != nil {
+			err = errors.Join(err, fmt.Errorf("restore filters: %w", restoreErr))
+		}
+		return err
+	}
+	a.localConfig, a.config = config, merged
+	return nil
+}
+
+// updateSinks points the sinks at the servers of config. If a sink fails to
+// update, the sinks are restored to the servers of previous.
+func (a *Agent) updateSinks(config, previous Config) error {
+	httpServers, grpcServers := splitServers(config.Servers)
+	if a.httpSink != nil {
+		if err := a.httpSink.Update(httpServers, config.TLS, config.PayloadVersion); err != nil {
+			return err
+		}
+	}
+	if a.grpcSink != nil {
+		if err := a.grpcSink.Update(grpcServers, config.TLS); err != nil {
+			if a.httpSink != nil {
+				previousServers, _ := splitServers(previous.Servers)
+				if restoreErr := a.httpSink.Update(previousServers, previous.TLS, previous.PayloadVersion); restoreErr != nil {
+					err = errors.Join(err, fmt.Errorf("restore HTTP sink: %w", restoreErr))
+				}
+			}
+			return err
 		}
 	}
+	return nil
+}
+
+// applyFilters configures the source with the configured and discovered
+// CIDRs, if it supports filtering.
+func (a *Agent) applyFilters() error {
+	return a.setFilters(a.config)
+}
 
-	return resKeys, resValues
+// setFilters configures the source with the CIDRs of config and the
+// discovered CIDRs, if it supports filtering.
+func (a *Agent) setFilters(config Config) error {
+	return a.filterSource(a.source, config)
 }
 
-func attachToInterface(interfaceName string, prog *ebpf.Program) (link.Link, error) {
-	iface, err := net.InterfaceByName(interfaceName)
+// subnetMapEntries is the capacity of subnet_map in kubezonnet.c. Discovered
+// CIDRs that don't fit are left out, instead of failing to update the
+// filters.
+var subnetMapEntries = 65536
+
+// filterSource configures source with the CIDRs of config and the discovered
+// CIDRs, if it supports filtering.
+func (a *Agent) filterSource(source FlowSource, config Config) error {
+	filter, ok := source.(CIDRFilter)
+	if !ok {
+		return nil
+	}
+
+	discovered := a.discoveredCIDRs
+	if room := max(subnetMapEntries-len(config.SubnetCIDRs), 0); len(discovered) > room {
+		log.Printf("discovered %d CIDRs, only monitoring %d of them as the subnet map is full", len(discovered), room)
+		discovered = discovered[:room]
+	}
+	subnets, err := ParseCIDRs(slices.Concat(config.SubnetCIDRs, discovered))
+	if err != nil {
+		return err
+	}
+	excludes, err := ParseCIDRs(config.ExcludeCIDRs)
 	if err != nil {
-		return nil, fmt.Errorf("get interface %q: %w", interfaceName, err)
+		return err
 	}
 
-	link, err := link.AttachTCX(link.TCXOptions{
-		Program:   prog,
-		Attach:    ebpf.AttachTCXEgress,
-		Interface: iface.Index,
-	})
+	if err := filter.SetCIDRs(subnets, excludes); err != nil {
+		return err
+	}
+
+	log.Printf("subnet CIDRs: %v, discovered CIDRs: %d, excluded CIDRs: %v", config.SubnetCIDRs, len(a.discoveredCIDRs), config.ExcludeCIDRs)
+	return nil
+}
+
+// flush collects the flows from the source and writes them to all sinks.
+func (a *Agent) flush(ctx context.Context) error {
+	log.Println("reading data from flow source")
+	keys, values, err := a.source.Collect(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("attach TCX: %w", err)
+		return fmt.Errorf("failed to read data: %w", err)
+	}
+	now := time.Now()
+	windowStart := a.windowStart
+	a.windowStart = now
+	a.metrics.flushes.Inc()
+	a.metrics.flowsCollected.Add(float64(len(keys)))
+	if len(keys) == 0 {
+		log.Println("no data, skipping")
+		return nil
+	}
+
+	pods := a.pods.List()
+	a.podIPs.observe(now, pods...)
+	finalKeys, finalValues, ignored := filterSrcIpOnCurrentHost(keys, values, a.podIPs.ips(now, podIPRetention*a.flushInterval()))
+	a.metrics.flowsIgnored.Add(float64(ignored))
+	a.metrics.flowsDroppedNonLocal.Add(float64(len(keys) - len(finalKeys) - ignored))
+	finalKeys, finalValues = aggregate(a.config.Aggregation, finalKeys, finalValues, newPortClassifier(a.ephemeralMin, a.ephemeralMax, pods))
+	var interfaces map[uint32]string
+	if a.config.InterfaceDimension && recordsInterfaces(a.source) {
+		interfaces = interfaceNames(finalKeys)
+	} else {
+		finalKeys, finalValues = dropInterfaces(finalKeys, finalValues)
+	}
+	sampleRate := scaleSampled(a.source, finalValues)
+
+	if a.opts.Debug {
+		log.Println("debug printing", len(finalKeys), "keys, started with", len(keys), "keys before filtering to host-local pods (", len(pods), ")")
 	}
 
-	return link, err
+	if len(finalKeys) == 0 {
+		return nil
+	}
+
+	a.sequence++
+	batch := Batch{
+		Node:         a.opts.Node,
+		Start:        windowStart,
+		Time:         now,
+		InstanceID:   a.instanceID,
+		Sequence:     a.sequence,
+		AgentVersion: a.opts.Version,
+		CaptureMode:  a.captureMode(),
+		Aggregation:  a.config.Aggregation,
+		SampleRate:   sampleRate,
+		Interfaces:   interfaces,
+		Keys:         finalKeys,
+		Values:       finalValues,
+	}
+	a.metrics.flowsSent.Add(float64(len(finalKeys)))
+
+	// Sinks are written concurrently and given up on after a flush
+	// interval, so that a slow or backpressuring server neither holds up the
+	// other sinks nor keeps the source from being drained for long.
+	ctx, cancel := context.WithTimeout(ctx, a.flushInterval())
+	defer cancel()
+	errs := make([]error, len(a.sinks))
+	var wg sync.WaitGroup
+	for i, sink := range a.sinks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := sink.Write(ctx, batch); err != nil {
+				a.metrics.sinkErrors.Inc()
+				errs[i] = err
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
 }
 
-func sendDataToServer(ctx context.Context, server string, keys []payload.IPKey, values []payload.IPValue) error {
-	content := payload.Encode(keys, values)
-	req, err := http.NewRequest("POST", server, bytes.NewReader(content))
+// captureProfile returns the capture profile of the options, detecting it
+// from the node's CNI if needed. If detection fails, the default profile is
+// used.
+func (a *Agent) captureProfile(ctx context.Context, kubeConfig *rest.Config) CaptureProfile {
+	if name := a.opts.CaptureProfile; name != "" && name != CaptureProfileAuto {
+		// Validated by New.
+		profile, _ := LookupCaptureProfile(name)
+		return profile
+	}
+
+	// The API server is only needed for Cilium's routing modes, detection
+	// falls back to assuming the defaults without it.
+	var client kubernetes.Interface
+	if kubeConfig == nil {
+		kubeConfig, _ = loadKubeConfig()
+	}
+	if kubeConfig != nil {
+		client, _ = kubernetes.NewForConfig(kubeConfig)
+	}
+
+	confDir := a.opts.CNIConfDir
+	if confDir == "" {
+		confDir = DefaultCNIConfDir
+	}
+	profile, reason, err := DetectCaptureProfile(ctx, confDir, client)
 	if err != nil {
-		return fmt.Errorf("new request: %w", err)
+		log.Println("failed to detect the capture profile, using the default profile:", err)
+		profile, _ = LookupCaptureProfile("default")
+		return profile
 	}
+	log.Printf("using capture profile %s: %s", profile.Name, reason)
+	return profile
+}
+
+// recordsInterfaces reports whether source records the interface flows left
+// the node on.
+func recordsInterfaces(source FlowSource) bool {
+	recorder, ok := source.(InterfaceRecorder)
+	return !ok || recorder.RecordsInterfaces()
+}
+
+// scaleSampled scales the packet sizes of values up to estimates of the
+// actual traffic, if source only captures a sample of the packets. The sample
+// rate is returned, 0 if all packets are captured.
+func scaleSampled(source FlowSource, values []payload.IPValue) uint32 {
+	sampler, ok := source.(Sampler)
+	if !ok || sampler.SampleRate() <= 1 {
+		return 0
+	}
+
+	rate := sampler.SampleRate()
+	for i := range values {
+		values[i].PacketSize *= uint64(rate)
+	}
+	return rate
+}
+
+// podIPRetention is for how many flush intervals the IPs of deleted pods are
+// kept, covering flows from the window they were deleted in even if flushes
+// are delayed.
+const podIPRetention = 2
 
-	req = req.WithContext(ctx)
+// configReloadInterval is how often the configuration file is checked for changes.
+const configReloadInterval = 5 * time.Second
 
-	client := http.DefaultClient
-	res, err := client.Do(req)
+func loadKubeConfig() (*rest.Config, error) {
+	config, err := rest.InClusterConfig()
 	if err != nil {
-		return fmt.Errorf("do request: %w", err)
+		kubeconfig := filepath.Join(homedir.HomeDir(), ".kube", "config")
+		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+		if err != nil {
+			return nil, fmt.Errorf("creating kubernetes config: %w", err)
+		}
 	}
-	defer res.Body.Close()
+	return config, nil
+}
+
+// informerPodLister lists pods from an informer's store.
+type informerPodLister struct {
+	store cache.Store
+}
+
+func (l informerPodLister) List() []*v1.Pod {
+	return convertToPods(l.store.List())
+}
 
-	respContent, err := io.ReadAll(res.Body)
+// watchPodsOnNode watches the pods on node and records their IPs in podIPs.
+// It returns once the informer has synced, so that the first flush doesn't
+// drop the flows of pods that aren't known yet.
+func watchPodsOnNode(ctx context.Context, kubeConfig *rest.Config, node string, podIPs *podIPCache) (PodLister, error) {
+	clientset, err := kubernetes.NewForConfig(kubeConfig)
 	if err != nil {
-		return fmt.Errorf("read response: %w", err)
+		return nil, fmt.Errorf("creating kubernetes client: %w", err)
 	}
 
-	if res.StatusCode != 200 {
-		return fmt.Errorf("write not successful: %s", string(respContent))
+	log.Println("watching pods for node", node)
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset, 0,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = "spec.nodeName=" + node
+		}))
+	informer := factory.Core().V1().Pods().Informer()
+	if _, err := informer.AddEventHandler(podIPs.handler()); err != nil {
+		return nil, fmt.Errorf("watch pods: %w", err)
 	}
+	go informer.Run(ctx.Done())
 
-	return nil
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return nil, fmt.Errorf("watch pods: %w", ctx.Err())
+	}
+
+	return informerPodLister{store: informer.GetStore()}, nil
+}
+
+func convertToPods(objs []interface{}) []*v1.Pod {
+	res := make([]*v1.Pod, 0, len(objs))
+
+	for _, obj := range objs {
+		res = append(res, obj.(*v1.Pod))
+	}
+
+	return res
 }
 
-type PacketInfo struct {
-	SrcIP      uint32
-	DestIP     uint32
-	PacketSize uint32
-	Ifindex    uint32
+// filterSrcIpOnCurrentHost keeps the flows sent from ipsOnHost, which are in
+// host byte order and map to whether the pod's traffic is ignored. The number
+// of flows dropped as ignored is returned as well.
+func filterSrcIpOnCurrentHost(keys []payload.IPKey, values []payload.IPValue, ipsOnHost map[uint32]bool) ([]payload.IPKey, []payload.IPValue, int) {
+	resKeys := make([]payload.IPKey, 0, len(keys))
+	resValues := make([]payload.IPValue, 0, len(values))
+	ignored := 0
+	for i := range keys {
+		ignore, found := ipsOnHost[byteorder.Ntohl(keys[i].SrcIP)]
+		switch {
+		case !found:
+		case ignore:
+			ignored++
+		default:
+			resKeys = append(resKeys, keys[i])
+			resValues = append(resValues, values[i])
+		}
+	}
+
+	return resKeys, resValues, ignored
 }
 
 // ipToUint32 converts an IPv4 address to a uint32
@@ -276,12 +927,3 @@ func ipToUint32(ip net.IP) uint32 {
 	}
 	return result
 }
-
-// maskToUint32 converts a net.IPMask to a uint32
-func maskToUint32(mask net.IPMask) uint32 {
-	var result uint32
-	for _, byteValue := range mask {
-		result = (result << 8) | uint32(byteValue)
-	}
-	return result
-}
@@ -0,0 +1,409 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/polarsignals/kubezonnet/byteorder"
+	"github.com/polarsignals/kubezonnet/payload"
+)
+
+type fakeSource struct {
+	mtx     sync.Mutex
+	keys    []payload.IPKey
+	values  []payload.IPValue
+	subnets []*net.IPNet
+	// setErr is returned by SetCIDRs, if set.
+	setErr error
+}
+
+func (s *fakeSource) add(key payload.IPKey, value payload.IPValue) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.keys = append(s.keys, key)
+	s.values = append(s.values, value)
+}
+
+func (s *fakeSource) Collect(context.Context) ([]payload.IPKey, []payload.IPValue, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	keys, values := s.keys, s.values
+	s.keys, s.values = nil, nil
+	return keys, values, nil
+}
+
+func (s *fakeSource) Peek() ([]payload.IPKey, []payload.IPValue, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return slices.Clone(s.keys), slices.Clone(s.values), nil
+}
+
+func (s *fakeSource) SetCIDRs(subnets, _ []*net.IPNet) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.setErr != nil {
+		return s.setErr
+	}
+	s.subnets = subnets
+	return nil
+}
+
+type fakePods []*v1.Pod
+
+func (p fakePods) List() []*v1.Pod {
+	return p
+}
+
+type captureSink struct {
+	batches chan Batch
+}
+
+func (s captureSink) Write(_ context.Context, batch Batch) error {
+	batch.Keys = slices.Clone(batch.Keys)
+	batch.Values = slices.Clone(batch.Values)
+	s.batches <- batch
+	return nil
+}
+
+func TestAgentFlush(t *testing.T) {
+	local := byteorder.Htonl(0x0a000001)  // 10.0.0.1
+	remote := byteorder.Htonl(0x0a000102) // 10.0.1.2
+
+	source := &fakeSource{}
+	sink := captureSink{batches: make(chan Batch, 10)}
+	a, err := New(Options{
+		Node: "node-a",
+		Config: Config{
+			SubnetCIDRs:   []string{"10.0.0.0/16"},
+			Aggregation:   payload.AggregationIPPair,
+			FlushInterval: Duration{10 * time.Millisecond},
+			Servers:       []string{"http://server"},
+		},
+		Source: source,
+		Pods: fakePods{{
+			Status: v1.PodStatus{PodIPs: []v1.PodIP{{IP: "10.0.0.1"}}},
+		}},
+		Sinks: []Sink{sink},
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- a.Run(ctx)
+	}()
+
+	source.add(payload.IPKey{SrcIP: local, DstIP: remote, SrcPort: 40000, DstPort: 80}, payload.IPValue{PacketSize: 10})
+	source.add(payload.IPKey{SrcIP: local, DstIP: remote, SrcPort: 40001, DstPort: 80}, payload.IPValue{PacketSize: 20})
+	// Not originating from a pod on this node.
+	source.add(payload.IPKey{SrcIP: remote, DstIP: local, SrcPort: 80, DstPort: 40000}, payload.IPValue{PacketSize: 40})
+
+	select {
+	case batch := <-sink.batches:
+		require.False(t, batch.Time.IsZero())
+		require.False(t, batch.Start.After(batch.Time))
+		require.Len(t, batch.InstanceID, 32)
+		batch.Start, batch.Time, batch.InstanceID = time.Time{}, time.Time{}, ""
+		require.Equal(t, Batch{
+			Node:        "node-a",
+			Sequence:    1,
+			Aggregation: payload.AggregationIPPair,
+			Keys:        []payload.IPKey{{SrcIP: local, DstIP: remote}},
+			Values:      []payload.IPValue{{PacketSize: 30}},
+		}, batch)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for flush")
+	}
+
+	cancel()
+	require.NoError(t, <-done)
+
+	source.mtx.Lock()
+	defer source.mtx.Unlock()
+	require.Len(t, source.subnets, 1)
+	require.Equal(t, "10.0.0.0/16", source.subnets[0].String())
+}
+
+type pressureSource struct {
+	*fakeSource
+	pressure chan struct{}
+}
+
+func (s pressureSource) Pressure() <-chan struct{} {
+	return s.pressure
+}
+
+func TestAgentEarlyFlush(t *testing.T) {
+	source := pressureSource{fakeSource: &fakeSource{}, pressure: make(chan struct{})}
+	sink := captureSink{batches: make(chan Batch, 10)}
+	a, err := New(Options{
+		Node: "node-a",
+		Config: Config{
+			SubnetCIDRs:   []string{"10.0.0.0/16"},
+			FlushInterval: Duration{time.Hour},
+			Servers:       []string{"http://server"},
+		},
+		Source: source,
+		Pods: fakePods{{
+			Status: v1.PodStatus{PodIPs: []v1.PodIP{{IP: "10.0.0.1"}}},
+		}},
+		Sinks: []Sink{sink},
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- a.Run(ctx)
+	}()
+
+	source.add(payload.IPKey{SrcIP: byteorder.Htonl(0x0a000001), DstIP: byteorder.Htonl(0x0a000102)}, payload.IPValue{PacketSize: 10})
+	source.pressure <- struct{}{}
+
+	select {
+	case batch := <-sink.batches:
+		require.Len(t, batch.Keys, 1)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for early flush")
+	}
+
+	cancel()
+	require.NoError(t, <-done)
+}
+
+func TestAgentServerConfig(t *testing.T) {
+	source := &fakeSource{}
+	a, err := New(Options{
+		Node: "node-a",
+		Config: Config{
+			SubnetCIDRs:   []string{"10.0.0.0/16"},
+			Aggregation:   payload.AggregationIPPair,
+			FlushInterval: Duration{time.Hour},
+			Servers:       []string{"http://server"},
+		},
+		Source: source,
+	})
+	require.NoError(t, err)
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	// The server's settings take precedence, empty ones keep the agent's.
+	a.applyServerConfig(context.Background(), serverConfig{
+		Revision:      "a",
+		SubnetCIDRs:   []string{"10.1.0.0/16"},
+		SampleRate:    4,
+		FlushInterval: time.Minute,
+	}, ticker)
+	require.Equal(t, []string{"10.1.0.0/16"}, a.config.SubnetCIDRs)
+	require.Equal(t, payload.AggregationIPPair, a.config.Aggregation)
+	require.Equal(t, time.Minute, a.flushInterval())
+	require.Equal(t, uint32(4), a.sampleRate())
+	source.mtx.Lock()
+	require.Equal(t, "10.1.0.0/16", source.subnets[0].String())
+	source.mtx.Unlock()
+
+	// Invalid configurations are ignored.
+	a.applyServerConfig(context.Background(), serverConfig{Revision: "b", SubnetCIDRs: []string{"fd00::/8"}}, ticker)
+	require.Equal(t, "a", a.serverConfig.Revision)
+	require.Equal(t, []string{"10.1.0.0/16"}, a.config.SubnetCIDRs)
+
+	// Reloading the configuration file keeps the server's settings.
+	require.NoError(t, a.reload(Config{
+		SubnetCIDRs:   []string{"10.0.0.0/16"},
+		Aggregation:   payload.AggregationServerPort,
+		FlushInterval: Duration{time.Hour},
+	}))
+	require.Equal(t, []string{"10.1.0.0/16"}, a.config.SubnetCIDRs)
+	require.Equal(t, payload.AggregationServerPort, a.config.Aggregation)
+	require.Equal(t, time.Minute, a.flushInterval())
+}
+
+func TestAgentReloadFailure(t *testing.T) {
+	source := &fakeSource{}
+	config := Config{
+		SubnetCIDRs:   []string{"10.0.0.0/16"},
+		FlushInterval: Duration{time.Hour},
+		Servers:       []string{"http://server"},
+	}
+	a, err := New(Options{Node: "node-a", Config: config, Source: source, SendData: true})
+	require.NoError(t, err)
+	require.NoError(t, a.applyFilters())
+
+	// A sink that can't be updated keeps the previous settings.
+	changed := config
+	changed.SubnetCIDRs = []string{"10.1.0.0/16"}
+	changed.TLS.CAFile = filepath.Join(t.TempDir(), "missing.pem")
+	require.Error(t, a.reload(changed))
+	require.Equal(t, config, a.config)
+	require.Equal(t, config, a.localConfig)
+	require.Equal(t, "10.0.0.0/16", source.subnets[0].String())
+
+	// So do filters that can't be updated.
+	changed.TLS = TLSConfig{}
+	changed.Servers = []string{"http://other-server"}
+	source.setErr = errors.New("map full")
+	require.Error(t, a.reload(changed))
+	require.Equal(t, config, a.config)
+	require.Equal(t, []string{"http://server"}, a.httpSink.servers)
+
+	source.setErr = nil
+	require.NoError(t, a.reload(changed))
+	require.Equal(t, changed, a.config)
+	require.Equal(t, "10.1.0.0/16", source.subnets[0].String())
+
+	// A new discovery mode replaces the previous one only once the rest of
+	// the configuration is applied.
+	var contexts []context.Context
+	a.discover = func(ctx context.Context, mode string) (<-chan []string, error) {
+		contexts = append(contexts, ctx)
+		return make(chan []string), nil
+	}
+	previous := make(chan []string)
+	previousStopped := false
+	a.discovered, a.stopDiscovery = previous, func() { previousStopped = true }
+	a.discoveredCIDRs = []string{"10.2.0.0/24"}
+	discovering := changed
+	discovering.CIDRDiscovery = CIDRDiscoveryNodes
+	source.setErr = errors.New("map full")
+	require.Error(t, a.reloadConfig(context.Background(), discovering))
+	require.Equal(t, changed, a.config)
+	require.True(t, a.discovered == (<-chan []string)(previous))
+	require.False(t, previousStopped)
+	require.ErrorIs(t, contexts[0].Err(), context.Canceled)
+	require.Equal(t, []string{"10.2.0.0/24"}, a.discoveredCIDRs)
+
+	source.setErr = nil
+	require.NoError(t, a.reloadConfig(context.Background(), discovering))
+	require.Equal(t, discovering, a.config)
+	require.True(t, previousStopped)
+	require.NoError(t, contexts[1].Err())
+	// The previously discovered CIDRs are kept until the new mode delivers.
+	require.Equal(t, []string{"10.2.0.0/24"}, a.discoveredCIDRs)
+	require.Equal(t, "10.2.0.0/24", source.subnets[1].String())
+}
+
+// cgroupSource doesn't know the interfaces, like the cgroup_skb hook.
+type cgroupSource struct {
+	*fakeSource
+}
+
+func (cgroupSource) RecordsInterfaces() bool {
+	return false
+}
+
+func TestAgentFlushInterfaces(t *testing.T) {
+	local := byteorder.Htonl(0x0a000001)  // 10.0.0.1
+	remote := byteorder.Htonl(0x0a000102) // 10.0.1.2
+
+	for name, tc := range map[string]struct {
+		recorded bool
+		flows    int
+	}{
+		"recorded": {recorded: true, flows: 2},
+		// Flows that only differed by interface are merged.
+		"not recorded": {recorded: false, flows: 1},
+	} {
+		t.Run(name, func(t *testing.T) {
+			source := &fakeSource{}
+			var flowSource FlowSource = source
+			if !tc.recorded {
+				flowSource = cgroupSource{source}
+			}
+			sink := captureSink{batches: make(chan Batch, 1)}
+			a, err := New(Options{
+				Node: "node-a",
+				Config: Config{
+					SubnetCIDRs:        []string{"10.0.0.0/16"},
+					InterfaceDimension: true,
+					PayloadVersion:     payload.Version2,
+					FlushInterval:      Duration{time.Hour},
+					Servers:            []string{"http://server"},
+				},
+				Source: flowSource,
+				Pods: fakePods{{
+					Status: v1.PodStatus{PodIPs: []v1.PodIP{{IP: "10.0.0.1"}}},
+				}},
+				Sinks: []Sink{sink},
+			})
+			require.NoError(t, err)
+
+			source.add(payload.IPKey{SrcIP: local, DstIP: remote, DstPort: 80, Ifindex: 1}, payload.IPValue{PacketSize: 10})
+			source.add(payload.IPKey{SrcIP: local, DstIP: remote, DstPort: 80, Ifindex: 2}, payload.IPValue{PacketSize: 20})
+			require.NoError(t, a.flush(context.Background()))
+
+			batch := <-sink.batches
+			require.Equal(t, tc.recorded, batch.Interfaces != nil)
+			require.Len(t, batch.Keys, tc.flows)
+		})
+	}
+}
+
+// stalledSink waits for the flush to give up on it.
+type stalledSink struct{}
+
+func (stalledSink) Write(ctx context.Context, _ Batch) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestAgentFlushStalledSink(t *testing.T) {
+	source := &fakeSource{}
+	sink := captureSink{batches: make(chan Batch, 1)}
+	a, err := New(Options{
+		Node: "node-a",
+		Config: Config{
+			SubnetCIDRs:   []string{"10.0.0.0/16"},
+			FlushInterval: Duration{50 * time.Millisecond},
+			Servers:       []string{"http://server"},
+		},
+		Source: source,
+		Pods: fakePods{{
+			Status: v1.PodStatus{PodIPs: []v1.PodIP{{IP: "10.0.0.1"}}},
+		}},
+		Sinks: []Sink{stalledSink{}, sink},
+	})
+	require.NoError(t, err)
+
+	source.add(payload.IPKey{SrcIP: byteorder.Htonl(0x0a000001), DstIP: byteorder.Htonl(0x0a000102), DstPort: 80}, payload.IPValue{PacketSize: 10})
+	// The other sinks are written regardless, and the flush is bounded by
+	// the flush interval.
+	start := time.Now()
+	require.ErrorIs(t, a.flush(context.Background()), context.DeadlineExceeded)
+	require.Less(t, time.Since(start), time.Second)
+	require.Len(t, sink.batches, 1)
+}
+
+func TestAgentSubnetMapFull(t *testing.T) {
+	subnetMapEntries = 3
+	defer func() { subnetMapEntries = 65536 }()
+
+	source := &fakeSource{}
+	a, err := New(Options{
+		Node: "node-a",
+		Config: Config{
+			SubnetCIDRs:   []string{"10.0.0.0/16"},
+			FlushInterval: Duration{time.Hour},
+			Servers:       []string{"http://server"},
+		},
+		Source: source,
+		Pods:   fakePods{},
+	})
+	require.NoError(t, err)
+
+	// Discovered CIDRs that don't fit are left out, the configured ones
+	// are always monitored.
+	a.discoveredCIDRs = []string{"10.1.0.1/32", "10.1.0.2/32", "10.1.0.3/32"}
+	require.NoError(t, a.applyFilters())
+	require.Len(t, source.subnets, 3)
+	require.Equal(t, "10.0.0.0/16", source.subnets[0].String())
+	require.Equal(t, "10.1.0.2/32", source.subnets[2].String())
+}
@@ -0,0 +1,167 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/polarsignals/kubezonnet/byteorder"
+	"github.com/polarsignals/kubezonnet/payload"
+)
+
+const ipLocalPortRangeFile = "/proc/sys/net/ipv4/ip_local_port_range"
+
+// Linux defaults for net.ipv4.ip_local_port_range, used if it can't be read.
+const (
+	defaultEphemeralPortMin = 32768
+	defaultEphemeralPortMax = 60999
+)
+
+// portClassifier decides which side of a flow is the serving one.
+type portClassifier struct {
+	ephemeralMin uint16
+	ephemeralMax uint16
+	// containerPorts maps pod IPs (in host byte order) of pods on this node
+	// to the ports declared by their containers.
+	containerPorts map[uint32]map[uint16]struct{}
+}
+
+func newPortClassifier(ephemeralMin, ephemeralMax uint16, podsOnHost []*v1.Pod) portClassifier {
+	containerPorts := make(map[uint32]map[uint16]struct{}, len(podsOnHost))
+	for _, pod := range podsOnHost {
+		ports := map[uint16]struct{}{}
+		for _, container := range pod.Spec.Containers {
+			for _, port := range container.Ports {
+				ports[uint16(port.ContainerPort)] = struct{}{}
+			}
+		}
+		if len(ports) == 0 {
+			continue
+		}
+
+		for _, podIP := range pod.Status.PodIPs {
+			ip := net.ParseIP(podIP.IP)
+			if ip == nil || ip.To4() == nil {
+				continue
+			}
+			containerPorts[ipToUint32(ip)] = ports
+		}
+	}
+
+	return portClassifier{
+		ephemeralMin:   ephemeralMin,
+		ephemeralMax:   ephemeralMax,
+		containerPorts: containerPorts,
+	}
+}
+
+func (c portClassifier) isEphemeral(port uint16) bool {
+	return port >= c.ephemeralMin && port <= c.ephemeralMax
+}
+
+// collapseClientPort sets the port of the client side of key to 0. Source
+// pods are always local, so a declared container port identifies the source as
+// the server. Otherwise the side using an ephemeral port is the client.
+func (c portClassifier) collapseClientPort(key payload.IPKey) payload.IPKey {
+	if _, found := c.containerPorts[byteorder.Ntohl(key.SrcIP)][key.SrcPort]; found {
+		key.DstPort = 0
+		return key
+	}
+
+	switch {
+	case c.isEphemeral(key.SrcPort):
+		key.SrcPort = 0
+	case c.isEphemeral(key.DstPort):
+		key.DstPort = 0
+	}
+	return key
+}
+
+// aggregate collapses the ports of keys according to mode and sums up the
+// values of keys that become identical. The order of first occurrence is
+// preserved.
+func aggregate(mode string, keys []payload.IPKey, values []payload.IPValue, ports portClassifier) ([]payload.IPKey, []payload.IPValue) {
+	switch mode {
+	case payload.AggregationServerPort:
+		return mergeKeys(keys, values, ports.collapseClientPort)
+	case payload.AggregationIPPair:
+		return mergeKeys(keys, values, func(key payload.IPKey) payload.IPKey {
+			key.SrcPort = 0
+			key.DstPort = 0
+			return key
+		})
+	default:
+		return keys, values
+	}
+}
+
+// dropInterfaces removes the interface from keys and sums up the values of
+// flows that only differed by interface.
+func dropInterfaces(keys []payload.IPKey, values []payload.IPValue) ([]payload.IPKey, []payload.IPValue) {
+	return mergeKeys(keys, values, func(key payload.IPKey) payload.IPKey {
+		key.Ifindex = 0
+		return key
+	})
+}
+
+// mergeKeys maps every key with f and sums up the values of keys that become
+// identical, preserving the order of first occurrence.
+func mergeKeys(keys []payload.IPKey, values []payload.IPValue, f func(payload.IPKey) payload.IPKey) ([]payload.IPKey, []payload.IPValue) {
+	index := make(map[payload.IPKey]int, len(keys))
+	resKeys := make([]payload.IPKey, 0, len(keys))
+	resValues := make([]payload.IPValue, 0, len(values))
+	for i, key := range keys {
+		key = f(key)
+		if j, found := index[key]; found {
+			resValues[j].PacketSize += values[i].PacketSize
+			resValues[j].SquaredSizes += values[i].SquaredSizes
+			continue
+		}
+		index[key] = len(resKeys)
+		resKeys = append(resKeys, key)
+		resValues = append(resValues, values[i])
+	}
+
+	return resKeys, resValues
+}
+
+// interfaceNames resolves the interfaces of keys to their names. Interfaces
+// that no longer exist are left out.
+func interfaceNames(keys []payload.IPKey) map[uint32]string {
+	names := map[uint32]string{}
+	for _, key := range keys {
+		if key.Ifindex == 0 {
+			continue
+		}
+		if _, found := names[key.Ifindex]; found {
+			continue
+		}
+		iface, err := net.InterfaceByIndex(int(key.Ifindex))
+		if err != nil {
+			continue
+		}
+		names[key.Ifindex] = iface.Name
+	}
+	return names
+}
+
+// readEphemeralPortRange reads the range of ports the kernel picks client
+// ports from.
+func readEphemeralPortRange(path string) (uint16, uint16, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var low, high uint16
+	if _, err := fmt.Sscan(strings.TrimSpace(string(content)), &low, &high); err != nil {
+		return 0, 0, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if low > high {
+		return 0, 0, fmt.Errorf("invalid port range %d-%d in %s", low, high, path)
+	}
+	return low, high, nil
+}
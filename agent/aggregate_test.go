@@ -0,0 +1,74 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/polarsignals/kubezonnet/byteorder"
+	"github.com/polarsignals/kubezonnet/payload"
+)
+
+func TestAggregate(t *testing.T) {
+	client := byteorder.Htonl(0x0a000001) // 10.0.0.1
+	server := byteorder.Htonl(0x0a000002) // 10.0.0.2
+	db := byteorder.Htonl(0x0a000003)     // 10.0.0.3
+
+	pods := []*v1.Pod{{
+		Spec: v1.PodSpec{Containers: []v1.Container{{
+			Ports: []v1.ContainerPort{{ContainerPort: 8080}},
+		}}},
+		Status: v1.PodStatus{PodIPs: []v1.PodIP{{IP: "10.0.0.2"}}},
+	}}
+	ports := newPortClassifier(32768, 60999, pods)
+
+	keys := []payload.IPKey{
+		{SrcIP: client, DstIP: server, SrcPort: 40000, DstPort: 8080},
+		{SrcIP: client, DstIP: server, SrcPort: 40001, DstPort: 8080},
+		// Server replying from its declared container port.
+		{SrcIP: server, DstIP: client, SrcPort: 8080, DstPort: 40000},
+		// Server port below the ephemeral range, client port above it.
+		{SrcIP: server, DstIP: db, SrcPort: 61000, DstPort: 5432},
+	}
+	values := []payload.IPValue{{PacketSize: 1}, {PacketSize: 2}, {PacketSize: 4}, {PacketSize: 8}}
+
+	resKeys, resValues := aggregate(payload.AggregationFull, keys, values, ports)
+	require.Equal(t, keys, resKeys)
+	require.Equal(t, values, resValues)
+
+	resKeys, resValues = aggregate(payload.AggregationServerPort, keys, values, ports)
+	require.Equal(t, []payload.IPKey{
+		{SrcIP: client, DstIP: server, SrcPort: 0, DstPort: 8080},
+		{SrcIP: server, DstIP: client, SrcPort: 8080, DstPort: 0},
+		{SrcIP: server, DstIP: db, SrcPort: 61000, DstPort: 5432},
+	}, resKeys)
+	require.Equal(t, []payload.IPValue{{PacketSize: 3}, {PacketSize: 4}, {PacketSize: 8}}, resValues)
+
+	resKeys, resValues = aggregate(payload.AggregationIPPair, keys, values, ports)
+	require.Equal(t, []payload.IPKey{
+		{SrcIP: client, DstIP: server},
+		{SrcIP: server, DstIP: client},
+		{SrcIP: server, DstIP: db},
+	}, resKeys)
+	require.Equal(t, []payload.IPValue{{PacketSize: 3}, {PacketSize: 4}, {PacketSize: 8}}, resValues)
+}
+
+func TestDropInterfaces(t *testing.T) {
+	a := byteorder.Htonl(0x0a000001) // 10.0.0.1
+	b := byteorder.Htonl(0x0a000002) // 10.0.0.2
+
+	keys := []payload.IPKey{
+		{SrcIP: a, DstIP: b, SrcPort: 40000, DstPort: 8080, Ifindex: 2},
+		{SrcIP: a, DstIP: b, SrcPort: 40000, DstPort: 8080, Ifindex: 3},
+		{SrcIP: b, DstIP: a, SrcPort: 8080, DstPort: 40000, Ifindex: 2},
+	}
+	values := []payload.IPValue{{PacketSize: 1, SquaredSizes: 1}, {PacketSize: 2, SquaredSizes: 4}, {PacketSize: 4, SquaredSizes: 16}}
+
+	resKeys, resValues := dropInterfaces(keys, values)
+	require.Equal(t, []payload.IPKey{
+		{SrcIP: a, DstIP: b, SrcPort: 40000, DstPort: 8080},
+		{SrcIP: b, DstIP: a, SrcPort: 8080, DstPort: 40000},
+	}, resKeys)
+	require.Equal(t, []payload.IPValue{{PacketSize: 3, SquaredSizes: 5}, {PacketSize: 4, SquaredSizes: 16}}, resValues)
+}
@@ -0,0 +1,590 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/ringbuf"
+	"github.com/cilium/ebpf/rlimit"
+
+	"github.com/polarsignals/kubezonnet/byteorder"
+	"github.com/polarsignals/kubezonnet/payload"
+)
+
+// BPFOptions configures a BPFSource.
+type BPFOptions struct {
+	// HighWaterMark is the fraction of the flow map's capacity at which the
+	// agent is signalled to flush early. 0 disables early flushes.
+	HighWaterMark float64
+	// SampleRate only records 1 in SampleRate packets, if greater than 1.
+	SampleRate uint32
+	// PinPath is a directory on a bpffs, such as DefaultPinPath, to pin the
+	// maps and the netfilter link in. A restarted agent adopts the pinned
+	// program and its counters instead of starting over, unless the eBPF
+	// object or its configuration changed. Empty disables pinning.
+	PinPath string
+	// Profile describes where the program is attached and how overlay
+	// encapsulated packets are handled. The zero value attaches to netfilter.
+	// Hooks the kernel doesn't support fall back to HookCgroupSkb.
+	Profile CaptureProfile
+	// CgroupPath is the root of the cgroup v2 hierarchy HookCgroupSkb
+	// attaches to, DefaultCgroupPath if empty.
+	CgroupPath string
+}
+
+// DefaultCgroupPath is where the cgroup v2 hierarchy is usually mounted.
+const DefaultCgroupPath = "/sys/fs/cgroup"
+
+// hookPrograms are the names of the programs attached to each hook.
+var hookPrograms = map[string]string{
+	HookNetfilter: "nf_postrouting_hook",
+	HookTCX:       "tcx_egress_hook",
+	HookCgroupSkb: "cgroup_skb_egress_hook",
+}
+
+// DefaultPinPath is the conventional directory to pin eBPF objects in.
+const DefaultPinPath = "/sys/fs/bpf/kubezonnet"
+
+// pinnedVersionName is the file in the pin directory holding the version of
+// the pinned objects. Links are pinned as "link" for the netfilter hook,
+// "tcx-<interface>" for TCX and "cgroup" for cgroup_skb.
+const pinnedVersionName = "version"
+
+// pinnedMaps are the maps pinned by name. The .rodata map holding the
+// constants isn't pinned, it is part of the version instead.
+var pinnedMaps = []string{"ip_map", "subnet_map", "exclude_map", "pressure_state_map", "pressure_events"}
+
+// BPFSource is a FlowSource that captures flows with an eBPF program attached
+// to the netfilter postrouting hook, or another hook of the capture profile.
+type BPFSource struct {
+	objs     kubezonnetObjects
+	links    []link.Link
+	events   *ringbuf.Reader
+	pressure chan struct{}
+
+	sampleRate  uint32
+	hook        string
+	captureMode string
+
+	keys   []payload.IPKey
+	values []payload.IPValue
+}
+
+// NewBPFSource loads the eBPF program into the kernel and attaches it. Nothing
+// is recorded until CIDRs are configured with SetCIDRs.
+func NewBPFSource(opts BPFOptions) (*BPFSource, error) {
+	spec, highWaterMark, err := loadSpec(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &BPFSource{
+		pressure:   make(chan struct{}, 1),
+		sampleRate: opts.SampleRate,
+	}
+
+	profile := opts.Profile
+	if profile.Hook == "" {
+		profile.Hook = HookNetfilter
+	}
+	support, err := detectKernelSupport()
+	if err != nil {
+		log.Println("failed to detect kernel support, assuming an old kernel:", err)
+	}
+	if hook := support.hook(profile.Hook); hook != profile.Hook {
+		log.Printf("kernel doesn't support the %s hook, falling back to %s", profile.Hook, hook)
+		profile.Hook = hook
+	}
+	s.hook = profile.Hook
+	s.captureMode = profile.Hook
+	if profile.Name != "" {
+		s.captureMode = profile.Name + "/" + profile.Hook
+	}
+
+	collOpts := &ebpf.CollectionOptions{}
+	version := objectVersion(_KubezonnetBytes, highWaterMark, opts.SampleRate, profile)
+	current := false
+	if opts.PinPath != "" {
+		current, err = preparePinPath(opts.PinPath, version)
+		if err != nil {
+			return nil, fmt.Errorf("prepare pin path: %w", err)
+		}
+		for _, name := range pinnedMaps {
+			spec.Maps[name].Pinning = ebpf.PinByName
+		}
+		collOpts.Maps.PinPath = opts.PinPath
+	}
+
+	if err := loadObjects(spec, profile.Hook, &s.objs, collOpts); err != nil {
+		return nil, fmt.Errorf("load eBPF objects: %w", err)
+	}
+
+	cgroupPath := opts.CgroupPath
+	if cgroupPath == "" {
+		cgroupPath = DefaultCgroupPath
+	}
+	if err := s.attach(profile, cgroupPath, opts.PinPath, current); err != nil {
+		s.objs.Close()
+		return nil, err
+	}
+
+	// The version is written last, so that an interrupted start is replaced
+	// by the next one.
+	if opts.PinPath != "" && !current {
+		if err := os.WriteFile(filepath.Join(opts.PinPath, pinnedVersionName), []byte(version+"\n"), 0o644); err != nil {
+			s.closeLinks()
+			s.objs.Close()
+			return nil, fmt.Errorf("write pinned version: %w", err)
+		}
+	}
+
+	s.events, err = ringbuf.NewReader(s.objs.PressureEvents)
+	if err != nil {
+		s.closeLinks()
+		s.objs.Close()
+		return nil, fmt.Errorf("open pressure ring buffer: %w", err)
+	}
+
+	size := s.objs.IpMap.MaxEntries()
+	s.keys = make([]payload.IPKey, size)
+	s.values = make([]payload.IPValue, size)
+
+	go s.readPressureEvents()
+
+	return s, nil
+}
+
+// loadSpec loads the eBPF object and configures its constants from opts. The
+// high-water mark is returned in number of entries.
+func loadSpec(opts BPFOptions) (*ebpf.CollectionSpec, uint32, error) {
+	if opts.HighWaterMark < 0 || opts.HighWaterMark > 1 {
+		return nil, 0, errors.New("high-water mark must be between 0 and 1")
+	}
+
+	// Remove resource limits for kernels <5.11.
+	if err := rlimit.RemoveMemlock(); err != nil {
+		return nil, 0, fmt.Errorf("removing memlock: %w", err)
+	}
+
+	// Load the compiled eBPF ELF and load it into the kernel.
+	spec, err := loadKubezonnet()
+	if err != nil {
+		return nil, 0, fmt.Errorf("load eBPF program: %w", err)
+	}
+
+	highWaterMark := uint32(opts.HighWaterMark * float64(spec.Maps["ip_map"].MaxEntries))
+	if err := spec.RewriteConstants(map[string]interface{}{
+		"high_water_mark": highWaterMark,
+		"sample_rate":     opts.SampleRate,
+		"encap_mode":      encapMode(opts.Profile.Encap),
+	}); err != nil {
+		return nil, 0, fmt.Errorf("configure eBPF program: %w", err)
+	}
+	return spec, highWaterMark, nil
+}
+
+// loadObjects loads the maps and only the program of hook into objs, as the
+// kernel may not support the others.
+func loadObjects(spec *ebpf.CollectionSpec, hook string, objs *kubezonnetObjects, opts *ebpf.CollectionOptions) error {
+	if hook == "" {
+		hook = HookNetfilter
+	}
+	name, found := hookPrograms[hook]
+	if !found {
+		return fmt.Errorf("unknown hook %q", hook)
+	}
+
+	spec = spec.Copy()
+	for program := range spec.Programs {
+		if program != name {
+			delete(spec.Programs, program)
+		}
+	}
+
+	coll, err := ebpf.NewCollectionWithOptions(spec, *opts)
+	if err != nil {
+		return err
+	}
+	// Closes whatever isn't assigned.
+	defer coll.Close()
+
+	if err := coll.Assign(&objs.kubezonnetMaps); err != nil {
+		return err
+	}
+	prog := coll.DetachProgram(name)
+	switch hook {
+	case HookNetfilter:
+		objs.NfPostroutingHook = prog
+	case HookTCX:
+		objs.TcxEgressHook = prog
+	case HookCgroupSkb:
+		objs.CgroupSkbEgressHook = prog
+	}
+	return nil
+}
+
+// attach attaches the eBPF program as described by the capture profile. With
+// a pin path the links are pinned, and pinned links are adopted if adopt is
+// set.
+func (s *BPFSource) attach(profile CaptureProfile, cgroupPath, pinPath string, adopt bool) error {
+	switch profile.Hook {
+	case "", HookNetfilter:
+		l, err := attachPinned(pinPath, "link", adopt, func() (link.Link, error) {
+			return link.AttachNetfilter(link.NetfilterOptions{
+				ProtocolFamily: 2, // IPv4
+				HookNumber:     4, // netfilter postrouting
+				Program:        s.objs.NfPostroutingHook,
+			})
+		})
+		if err != nil {
+			return fmt.Errorf("attach netfilter: %w", err)
+		}
+		s.links = append(s.links, l)
+	case HookTCX:
+		ifaces, err := net.Interfaces()
+		if err != nil {
+			return fmt.Errorf("list interfaces: %w", err)
+		}
+		ifaces = matchInterfaces(ifaces, profile.Interfaces)
+		if len(ifaces) == 0 {
+			return fmt.Errorf("no interface matches %s", strings.Join(profile.Interfaces, ", "))
+		}
+		for _, iface := range ifaces {
+			l, err := attachPinned(pinPath, "tcx-"+iface.Name, adopt, func() (link.Link, error) {
+				return link.AttachTCX(link.TCXOptions{
+					Program:   s.objs.TcxEgressHook,
+					Attach:    ebpf.AttachTCXEgress,
+					Interface: iface.Index,
+				})
+			})
+			if err != nil {
+				s.closeLinks()
+				return fmt.Errorf("attach TCX to %s: %w", iface.Name, err)
+			}
+			s.links = append(s.links, l)
+		}
+	case HookCgroupSkb:
+		l, err := attachPinned(pinPath, "cgroup", adopt, func() (link.Link, error) {
+			return link.AttachCgroup(link.CgroupOptions{
+				Path:    cgroupPath,
+				Attach:  ebpf.AttachCGroupInetEgress,
+				Program: s.objs.CgroupSkbEgressHook,
+			})
+		})
+		if err != nil {
+			return fmt.Errorf("attach to cgroup %s: %w", cgroupPath, err)
+		}
+		s.links = append(s.links, l)
+	default:
+		return fmt.Errorf("unknown hook %q", profile.Hook)
+	}
+	return nil
+}
+
+// attachPinned adopts the link pinned as name in pinPath if adopt is set, and
+// otherwise attaches and pins a new one.
+func attachPinned(pinPath, name string, adopt bool, attach func() (link.Link, error)) (link.Link, error) {
+	if pinPath == "" {
+		return attach()
+	}
+
+	path := filepath.Join(pinPath, name)
+	if adopt {
+		l, err := link.LoadPinnedLink(path, nil)
+		if err == nil {
+			log.Println("adopted pinned eBPF link", path)
+			return l, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Println("failed to load pinned link, attaching again:", err)
+		}
+	}
+
+	l, err := attach()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		l.Close()
+		return nil, fmt.Errorf("remove stale pin: %w", err)
+	}
+	if err := l.Pin(path); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("pin: %w", err)
+	}
+	return l, nil
+}
+
+// matchInterfaces returns the interfaces whose name matches one of the glob
+// patterns.
+func matchInterfaces(ifaces []net.Interface, patterns []string) []net.Interface {
+	var res []net.Interface
+	for _, iface := range ifaces {
+		for _, pattern := range patterns {
+			if ok, _ := filepath.Match(pattern, iface.Name); ok {
+				res = append(res, iface)
+				break
+			}
+		}
+	}
+	return res
+}
+
+func (s *BPFSource) closeLinks() error {
+	var errs []error
+	for _, l := range s.links {
+		errs = append(errs, l.Close())
+	}
+	s.links = nil
+	return errors.Join(errs...)
+}
+
+// objectVersion identifies the eBPF object and the configuration it is loaded
+// and attached with. Pinned objects are only adopted if their version is the
+// same.
+func objectVersion(object []byte, config ...interface{}) string {
+	h := sha256.New()
+	h.Write(object)
+	fmt.Fprintln(h, config...)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// preparePinPath creates the pin directory and reports whether the objects
+// pinned in it are of the given version. If they aren't, they are removed,
+// which detaches a pinned program no process holds on to anymore.
+func preparePinPath(dir, version string) (bool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return false, err
+	}
+
+	pinned, err := os.ReadFile(filepath.Join(dir, pinnedVersionName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+	if err == nil && strings.TrimSpace(string(pinned)) == version {
+		return true, nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range entries {
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// Unpin removes the objects pinned in pinPath and the directory itself, as
+// pinned links keep the program attached after the agent is uninstalled. The
+// program is detached once no agent holds it open anymore, so an agent still
+// using pinPath keeps capturing until it exits. Unpinning a directory that
+// doesn't exist does nothing.
+func Unpin(pinPath string) error {
+	entries, err := os.ReadDir(pinPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.Remove(filepath.Join(pinPath, entry.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Remove(pinPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *BPFSource) readPressureEvents() {
+	for {
+		if _, err := s.events.Read(); err != nil {
+			if !errors.Is(err, ringbuf.ErrClosed) {
+				log.Println("failed to read pressure event:", err)
+			}
+			return
+		}
+
+		// The eBPF program may signal more than once per window.
+		select {
+		case s.pressure <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Pressure returns a channel that receives a value when the flow map crosses
+// the high-water mark.
+func (s *BPFSource) Pressure() <-chan struct{} {
+	return s.pressure
+}
+
+// Collect reads and deletes all flows from the eBPF map. The returned slices
+// are only valid until the next call.
+func (s *BPFSource) Collect(ctx context.Context) ([]payload.IPKey, []payload.IPValue, error) {
+	keys := s.keys[:cap(s.keys)]
+	values := s.values[:cap(s.values)]
+	opts := &ebpf.BatchOptions{}
+	cursor := new(ebpf.MapBatchCursor)
+	n, err := s.objs.IpMap.BatchLookupAndDelete(cursor, keys, values, opts)
+
+	// Start a new window for the high-water mark. Entries added between
+	// reading the map and resetting aren't counted, which only delays
+	// signalling.
+	if resetErr := s.objs.PressureStateMap.Put(uint32(0), kubezonnetPressureState{}); resetErr != nil {
+		log.Println("failed to reset map pressure state:", resetErr)
+	}
+
+	if n <= 0 {
+		return nil, nil, nil
+	}
+	if err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return nil, nil, fmt.Errorf("read eBPF map: %w", err)
+	}
+
+	return keys[:n], values[:n], nil
+}
+
+// SampleRate returns N if only 1 in N packets is recorded.
+func (s *BPFSource) SampleRate() uint32 {
+	return s.sampleRate
+}
+
+// CaptureMode returns the capture profile and the hook the program is
+// attached to, such as "cilium-ebpf/tcx".
+func (s *BPFSource) CaptureMode() string {
+	return s.captureMode
+}
+
+// RecordsInterfaces reports whether the interface flows left the node on is
+// known, which it isn't with the cgroup_skb hook.
+func (s *BPFSource) RecordsInterfaces() bool {
+	return s.hook != HookCgroupSkb
+}
+
+// Peek reads all flows from the eBPF map without deleting them.
+func (s *BPFSource) Peek() ([]payload.IPKey, []payload.IPValue, error) {
+	return lookupFlows(s.objs.IpMap)
+}
+
+// lookupFlows reads all flows from the flow map m without deleting them.
+func lookupFlows(m *ebpf.Map) ([]payload.IPKey, []payload.IPValue, error) {
+	size := m.MaxEntries()
+	keys := make([]payload.IPKey, size)
+	values := make([]payload.IPValue, size)
+	opts := &ebpf.BatchOptions{}
+	cursor := new(ebpf.MapBatchCursor)
+	n, err := m.BatchLookup(cursor, keys, values, opts)
+	if err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return nil, nil, fmt.Errorf("read eBPF map: %w", err)
+	}
+
+	return keys[:n], values[:n], nil
+}
+
+// SetCIDRs syncs the CIDRs to monitor and to exclude into the eBPF filter
+// maps.
+func (s *BPFSource) SetCIDRs(subnets, excludes []*net.IPNet) error {
+	if err := syncCIDRMap(s.objs.SubnetMap, subnets); err != nil {
+		return fmt.Errorf("update subnet map: %w", err)
+	}
+	if err := syncCIDRMap(s.objs.ExcludeMap, excludes); err != nil {
+		return fmt.Errorf("update exclude map: %w", err)
+	}
+	return nil
+}
+
+// Close detaches and unloads the eBPF program. A pinned program stays
+// attached and keeps counting until the next agent adopts it.
+func (s *BPFSource) Close() error {
+	return errors.Join(s.closeLinks(), s.events.Close(), s.objs.Close())
+}
+
+// syncCIDRMap makes the LPM trie m contain exactly the given CIDRs. New
+// entries are inserted before stale ones are removed, so that a CIDR that is
+// present before and after an update is never missing from the map. If both
+// don't fit into the map, stale entries are removed first instead. CIDRs that
+// don't fit at all are rejected before the map is changed.
+func syncCIDRMap(m *ebpf.Map, cidrs []*net.IPNet) error {
+	want := make(map[kubezonnetLpmKey]*net.IPNet, len(cidrs))
+	for _, cidr := range cidrs {
+		ones, _ := cidr.Mask.Size()
+		key := kubezonnetLpmKey{
+			Prefixlen: uint32(ones),
+			Addr:      byteorder.Htonl(ipToUint32(cidr.IP)),
+		}
+		want[key] = cidr
+	}
+	if len(want) > int(m.MaxEntries()) {
+		return fmt.Errorf("%d CIDRs exceed the capacity of %d", len(want), m.MaxEntries())
+	}
+
+	var (
+		key   kubezonnetLpmKey
+		value uint8
+		stale []kubezonnetLpmKey
+	)
+	iter := m.Iterate()
+	for iter.Next(&key, &value) {
+		if _, found := want[key]; !found {
+			stale = append(stale, key)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("iterate: %w", err)
+	}
+
+	put := func() error {
+		for key, cidr := range want {
+			if err := m.Put(key, uint8(1)); err != nil {
+				return fmt.Errorf("put %s: %w", cidr, err)
+			}
+		}
+		return nil
+	}
+	deleteStale := func() error {
+		for _, key := range stale {
+			if err := m.Delete(key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+				return fmt.Errorf("delete: %w", err)
+			}
+		}
+		return nil
+	}
+	if len(want)+len(stale) > int(m.MaxEntries()) {
+		if err := deleteStale(); err != nil {
+			return err
+		}
+		return put()
+	}
+	if err := put(); err != nil {
+		return err
+	}
+	return deleteStale()
+}
+
+// encapMode returns the eBPF program's ENCAP_* constant of an Encap mode.
+func encapMode(encap string) uint32 {
+	switch encap {
+	case EncapSkip:
+		return 1
+	case EncapDecap:
+		return 2
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,62 @@
+package agent
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreparePinPath(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "kubezonnet")
+	version := objectVersion([]byte("object"), 819, 1)
+	require.NotEqual(t, version, objectVersion([]byte("object"), 819, 10))
+	require.NotEqual(t, version, objectVersion([]byte("changed"), 819, 1))
+	require.NotEqual(t, version, objectVersion([]byte("object"), 819, 1, captureProfiles["cilium-ebpf"]))
+
+	// Nothing pinned yet.
+	current, err := preparePinPath(dir, version)
+	require.NoError(t, err)
+	require.False(t, current)
+
+	// Pretend a previous agent pinned its objects.
+	for _, name := range append([]string{"link", "tcx-eth0"}, pinnedMaps...) {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), nil, 0o644))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, pinnedVersionName), []byte(version+"\n"), 0o644))
+
+	current, err = preparePinPath(dir, version)
+	require.NoError(t, err)
+	require.True(t, current)
+	require.FileExists(t, filepath.Join(dir, "link"))
+
+	// A different version replaces the pinned objects.
+	current, err = preparePinPath(dir, objectVersion([]byte("changed"), 819, 1))
+	require.NoError(t, err)
+	require.False(t, current)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestUnpin(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "kubezonnet")
+	require.NoError(t, os.Mkdir(dir, 0o755))
+	for _, name := range append([]string{"link", pinnedVersionName}, pinnedMaps...) {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), nil, 0o644))
+	}
+
+	require.NoError(t, Unpin(dir))
+	require.NoDirExists(t, dir)
+
+	// Nothing left to unpin.
+	require.NoError(t, Unpin(dir))
+}
+
+func TestMatchInterfaces(t *testing.T) {
+	ifaces := []net.Interface{{Name: "lo"}, {Name: "eth0"}, {Name: "eth1"}, {Name: "ens5"}, {Name: "cilium_host"}, {Name: "lxc1234"}}
+	require.Equal(t, []net.Interface{{Name: "eth0"}, {Name: "eth1"}, {Name: "ens5"}}, matchInterfaces(ifaces, physicalInterfaces))
+	require.Empty(t, matchInterfaces(ifaces, []string{"bond*"}))
+}
@@ -0,0 +1,100 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DefaultCNIConfDir is where CNI plugins install their network
+// configuration on nodes.
+const DefaultCNIConfDir = "/etc/cni/net.d"
+
+// Known CNIs, as returned by DetectCNI.
+const (
+	CNICilium  = "cilium"
+	CNICalico  = "calico"
+	CNIFlannel = "flannel"
+	CNIAWSVPC  = "aws-vpc"
+	CNIKindnet = "kindnet"
+)
+
+// cniPluginTypes maps the plugin types of CNI network configurations to the
+// CNI that installs them.
+var cniPluginTypes = map[string]string{
+	"cilium-cni": CNICilium,
+	"calico":     CNICalico,
+	"flannel":    CNIFlannel,
+	"aws-cni":    CNIAWSVPC,
+}
+
+// DetectCNI detects the CNI from the network configuration in confDir. Like
+// the container runtime, the lexicographically first configuration is used.
+// If its plugins aren't known, the type of its first plugin is returned. The
+// file the CNI was detected from is returned as well.
+func DetectCNI(confDir string) (string, string, error) {
+	entries, err := os.ReadDir(confDir)
+	if err != nil {
+		return "", "", err
+	}
+
+	var files []string
+	for _, entry := range entries {
+		switch filepath.Ext(entry.Name()) {
+		case ".conf", ".conflist", ".json":
+			if !entry.IsDir() {
+				files = append(files, entry.Name())
+			}
+		}
+	}
+	sort.Strings(files)
+	if len(files) == 0 {
+		return "", "", fmt.Errorf("no CNI network configuration in %s", confDir)
+	}
+
+	path := filepath.Join(confDir, files[0])
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", "", err
+	}
+
+	// A .conflist has a list of plugins, a .conf is a single plugin.
+	var conf struct {
+		Name    string `json:"name"`
+		Type    string `json:"type"`
+		Plugins []struct {
+			Type string `json:"type"`
+		} `json:"plugins"`
+	}
+	if err := json.Unmarshal(content, &conf); err != nil {
+		return "", "", fmt.Errorf("parse %s: %w", path, err)
+	}
+	// kindnet uses the generic ptp plugin.
+	if conf.Name == "kindnet" {
+		return CNIKindnet, path, nil
+	}
+	types := []string{conf.Type}
+	for _, plugin := range conf.Plugins {
+		types = append(types, plugin.Type)
+	}
+
+	first := ""
+	for _, typ := range types {
+		if typ == "" {
+			continue
+		}
+		if cni, found := cniPluginTypes[typ]; found {
+			return cni, path, nil
+		}
+		if first == "" {
+			first = strings.ToLower(typ)
+		}
+	}
+	if first == "" {
+		return "", "", fmt.Errorf("no CNI plugin type in %s", path)
+	}
+	return first, path, nil
+}
@@ -0,0 +1,39 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectCNI(t *testing.T) {
+	dir := t.TempDir()
+	_, _, err := DetectCNI(dir)
+	require.Error(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "10-calico.conflist"), []byte(`{
+		"name": "k8s-pod-network",
+		"plugins": [{"type": "calico"}, {"type": "portmap"}]
+	}`), 0o644))
+	cni, path, err := DetectCNI(dir)
+	require.NoError(t, err)
+	require.Equal(t, CNICalico, cni)
+	require.Equal(t, filepath.Join(dir, "10-calico.conflist"), path)
+
+	// The lexicographically first configuration wins.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "05-cilium.conflist"), []byte(`{
+		"name": "cilium",
+		"plugins": [{"type": "cilium-cni"}]
+	}`), 0o644))
+	cni, _, err = DetectCNI(dir)
+	require.NoError(t, err)
+	require.Equal(t, CNICilium, cni)
+
+	// Unknown plugins are returned by type.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "00-bridge.conf"), []byte(`{"type": "bridge"}`), 0o644))
+	cni, _, err = DetectCNI(dir)
+	require.NoError(t, err)
+	require.Equal(t, "bridge", cni)
+}
@@ -0,0 +1,328 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	"sigs.k8s.io/yaml"
+
+	"github.com/polarsignals/kubezonnet/payload"
+)
+
+// Config holds the agent settings that can be provided through a
+// configuration file. All of them can be changed while the agent is running.
+type Config struct {
+	// SubnetCIDRs are the IPv4 CIDRs to monitor, both the source and the
+	// destination of a packet must be contained in one of them.
+	SubnetCIDRs []string `json:"subnetCIDRs,omitempty"`
+	// CIDRDiscovery enables discovering the CIDRs to monitor from the
+	// cluster in addition to SubnetCIDRs, one of "nodes", "cilium" or
+	// "pods".
+	CIDRDiscovery string `json:"cidrDiscovery,omitempty"`
+	// ExcludeCIDRs are IPv4 CIDRs that are never recorded, even if they are
+	// contained in one of the SubnetCIDRs.
+	ExcludeCIDRs []string `json:"excludeCIDRs,omitempty"`
+	// Aggregation controls how ports are aggregated before sending data,
+	// one of "full" (default), "server-port" or "ip-pair".
+	Aggregation string `json:"aggregation,omitempty"`
+	// InterfaceDimension sends the interface traffic left the node on, so
+	// that servers can attribute traffic per interface. HTTP servers need
+	// PayloadVersion 2 or later to receive it.
+	InterfaceDimension bool `json:"interfaceDimension,omitempty"`
+	// PayloadVersion is the version of the encoding of the data sent to
+	// the servers, payload.VersionLegacy (default), payload.Version2 or
+	// payload.Version3. Servers older than Version2 can only decode
+	// VersionLegacy, and servers older than Version3 can't decode it.
+	// Servers that support registration choose the version instead.
+	PayloadVersion int `json:"payloadVersion,omitempty"`
+	// FlushInterval is the interval at which data is sent to the servers.
+	FlushInterval Duration `json:"flushInterval,omitempty"`
+	// Servers are the endpoints statistics are sent to. URLs with the grpc
+	// or grpcs scheme, such as grpc://kubezonnet-server:8081, stream the
+	// statistics over gRPC instead of sending a request per flush.
+	Servers []string `json:"servers,omitempty"`
+	// TLS configures the client used to talk to the servers.
+	TLS TLSConfig `json:"tls,omitempty"`
+}
+
+// TLSConfig configures TLS for the connection to the servers.
+type TLSConfig struct {
+	CAFile             string `json:"caFile,omitempty"`
+	CertFile           string `json:"certFile,omitempty"`
+	KeyFile            string `json:"keyFile,omitempty"`
+	ServerName         string `json:"serverName,omitempty"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty"`
+}
+
+// Duration is a time.Duration that is represented as a string such as "10s"
+// in configuration files.
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string: %w", err)
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// LoadConfigFile reads a YAML or JSON configuration file. Settings that are
+// not present in the file keep their value from defaults.
+func LoadConfigFile(path string, defaults Config) (Config, error) {
+	config, _, err := loadConfigFile(path, defaults)
+	return config, err
+}
+
+// loadConfigFile is LoadConfigFile, also returning the content the
+// configuration was parsed from.
+func loadConfigFile(path string, defaults Config) (Config, []byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, nil, fmt.Errorf("read config file: %w", err)
+	}
+
+	config, err := parseConfig(content, defaults)
+	if err != nil {
+		return Config{}, nil, err
+	}
+	return config, content, nil
+}
+
+func parseConfig(content []byte, defaults Config) (Config, error) {
+	// Unmarshalling reuses the backing arrays of slices, which must not
+	// change the defaults.
+	config := defaults
+	config.SubnetCIDRs = slices.Clone(defaults.SubnetCIDRs)
+	config.ExcludeCIDRs = slices.Clone(defaults.ExcludeCIDRs)
+	config.Servers = slices.Clone(defaults.Servers)
+	if err := yaml.UnmarshalStrict(content, &config); err != nil {
+		return Config{}, fmt.Errorf("parse config: %w", err)
+	}
+
+	if err := config.Validate(); err != nil {
+		return Config{}, err
+	}
+
+	return config, nil
+}
+
+// Validate checks that the configuration is complete and well-formed.
+func (c Config) Validate() error {
+	switch c.CIDRDiscovery {
+	case "":
+		if len(c.SubnetCIDRs) == 0 {
+			return errors.New("at least one subnet CIDR must be configured when CIDR discovery is disabled")
+		}
+	case CIDRDiscoveryNodes, CIDRDiscoveryCilium, CIDRDiscoveryPods:
+	default:
+		return fmt.Errorf("unknown CIDR discovery mode %q", c.CIDRDiscovery)
+	}
+	if _, err := ParseCIDRs(c.SubnetCIDRs); err != nil {
+		return fmt.Errorf("subnet CIDRs: %w", err)
+	}
+	if _, err := ParseCIDRs(c.ExcludeCIDRs); err != nil {
+		return fmt.Errorf("exclude CIDRs: %w", err)
+	}
+
+	switch c.Aggregation {
+	case "", payload.AggregationFull, payload.AggregationServerPort, payload.AggregationIPPair:
+	default:
+		return fmt.Errorf("unknown aggregation mode %q", c.Aggregation)
+	}
+
+	switch c.PayloadVersion {
+	case 0, payload.VersionLegacy, payload.Version2, payload.Version3:
+	default:
+		return fmt.Errorf("unsupported payload version %d", c.PayloadVersion)
+	}
+	if c.InterfaceDimension {
+		if err := c.requireVersioned("the interface dimension"); err != nil {
+			return err
+		}
+	}
+
+	if c.FlushInterval.Duration <= 0 {
+		return errors.New("flush interval must be greater than zero")
+	}
+
+	if len(c.Servers) == 0 {
+		return errors.New("at least one server must be configured")
+	}
+	for _, server := range c.Servers {
+		if server == "" {
+			return errors.New("server must not be empty")
+		}
+		if isGRPCServer(server) {
+			if _, _, err := grpcTarget(server); err != nil {
+				return err
+			}
+		}
+	}
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return errors.New("tls: cert file and key file must be configured together")
+	}
+
+	return nil
+}
+
+// requireVersioned checks that feature, which only payload version 2 and later
+// can carry, can be sent to the HTTP servers. Streams to gRPC servers carry
+// all features.
+func (c Config) requireVersioned(feature string) error {
+	httpServers, _ := splitServers(c.Servers)
+	if len(httpServers) > 0 && c.PayloadVersion < payload.Version2 {
+		return fmt.Errorf("%s requires payload version %d or later", feature, payload.Version2)
+	}
+	return nil
+}
+
+// withServerConfig returns c with the settings of the server's central
+// configuration applied on top.
+func (c Config) withServerConfig(config serverConfig) Config {
+	if config.SubnetCIDRs != nil {
+		c.SubnetCIDRs = config.SubnetCIDRs
+	}
+	if config.ExcludeCIDRs != nil {
+		c.ExcludeCIDRs = config.ExcludeCIDRs
+	}
+	if config.Aggregation != "" {
+		c.Aggregation = config.Aggregation
+	}
+	if config.FlushInterval > 0 {
+		c.FlushInterval = Duration{config.FlushInterval}
+	}
+	return c
+}
+
+// ParseCIDRs parses CIDRs, rejecting the ones that aren't IPv4, which the
+// eBPF program can't match.
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	res := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		ip, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		if ip.To4() == nil {
+			return nil, fmt.Errorf("%q is not an IPv4 CIDR, currently only IPv4 is supported", cidr)
+		}
+		res = append(res, ipNet)
+	}
+	return res, nil
+}
+
+// httpClient returns the client to use for talking to the servers.
+func (c TLSConfig) httpClient() (*http.Client, error) {
+	if c == (TLSConfig{}) {
+		return http.DefaultClient, nil
+	}
+
+	config, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return &http.Client{Transport: transport}, nil
+}
+
+// tlsConfig returns the TLS client configuration for the servers.
+func (c TLSConfig) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+
+	if c.CAFile != "" {
+		ca, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// watchConfigFile polls the configuration file and sends every valid change
+// from last, the content the current configuration was parsed from, on the
+// returned channel. Polling is used rather than inotify, as ConfigMap volumes
+// are updated by atomically swapping a symlink.
+func watchConfigFile(ctx context.Context, path string, interval time.Duration, defaults Config, last []byte) <-chan Config {
+	ch := make(chan Config)
+
+	go func() {
+		defer close(ch)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			content, err := os.ReadFile(path)
+			if err != nil {
+				log.Println("failed to read config file:", err)
+				continue
+			}
+			if bytes.Equal(content, last) {
+				continue
+			}
+			last = content
+
+			config, err := parseConfig(content, defaults)
+			if err != nil {
+				log.Println("ignoring invalid config file change:", err)
+				continue
+			}
+
+			select {
+			case ch <- config:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch
+}
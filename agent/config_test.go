@@ -0,0 +1,105 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseConfig(t *testing.T) {
+	defaults := Config{
+		SubnetCIDRs:   []string{"10.0.0.0/24"},
+		FlushInterval: Duration{10 * time.Second},
+		Servers:       []string{"http://flag-server/write-network-statistics"},
+	}
+
+	config, err := parseConfig([]byte(`
+subnetCIDRs:
+- 10.0.0.0/8
+- 192.168.0.0/16
+excludeCIDRs:
+- 10.1.0.0/16
+flushInterval: 30s
+tls:
+  insecureSkipVerify: true
+`), defaults)
+	require.NoError(t, err)
+	require.Equal(t, Config{
+		SubnetCIDRs:   []string{"10.0.0.0/8", "192.168.0.0/16"},
+		ExcludeCIDRs:  []string{"10.1.0.0/16"},
+		FlushInterval: Duration{30 * time.Second},
+		Servers:       []string{"http://flag-server/write-network-statistics"},
+		TLS:           TLSConfig{InsecureSkipVerify: true},
+	}, config)
+
+	// JSON is valid YAML, so it is accepted as well.
+	config, err = parseConfig([]byte(`{"servers": ["https://a", "https://b"]}`), defaults)
+	require.NoError(t, err)
+	require.Equal(t, []string{"https://a", "https://b"}, config.Servers)
+	require.Equal(t, defaults.SubnetCIDRs, config.SubnetCIDRs)
+
+	_, err = parseConfig([]byte(`subnetCIDRs: ["fd00::/64"]`), defaults)
+	require.Error(t, err)
+	// Parsing doesn't change the defaults.
+	require.Equal(t, []string{"10.0.0.0/24"}, defaults.SubnetCIDRs)
+
+	_, err = parseConfig([]byte(`flushInterval: 0s`), defaults)
+	require.Error(t, err)
+
+	_, err = parseConfig([]byte(`unknownSetting: true`), defaults)
+	require.Error(t, err)
+
+	// The legacy payload version can't carry interfaces to HTTP servers.
+	_, err = parseConfig([]byte(`interfaceDimension: true`), defaults)
+	require.Error(t, err)
+	_, err = parseConfig([]byte(`{"interfaceDimension": true, "payloadVersion": 2}`), defaults)
+	require.NoError(t, err)
+	_, err = parseConfig([]byte(`{"interfaceDimension": true, "servers": ["grpc://server:8081"]}`), defaults)
+	require.NoError(t, err)
+}
+
+func TestConfigWithServerConfig(t *testing.T) {
+	config := Config{
+		SubnetCIDRs:   []string{"10.0.0.0/8"},
+		ExcludeCIDRs:  []string{"10.1.0.0/16"},
+		Aggregation:   "ip-pair",
+		FlushInterval: Duration{10 * time.Second},
+		Servers:       []string{"http://server"},
+	}
+	require.Equal(t, config, config.withServerConfig(serverConfig{Revision: "a"}))
+	require.Equal(t, Config{
+		SubnetCIDRs:   []string{"10.0.0.0/8"},
+		ExcludeCIDRs:  []string{},
+		Aggregation:   "server-port",
+		FlushInterval: Duration{time.Minute},
+		Servers:       []string{"http://server"},
+	}, config.withServerConfig(serverConfig{ExcludeCIDRs: []string{}, Aggregation: "server-port", FlushInterval: time.Minute}))
+}
+
+func TestWatchConfigFile(t *testing.T) {
+	defaults := Config{
+		SubnetCIDRs:   []string{"10.0.0.0/24"},
+		FlushInterval: Duration{10 * time.Second},
+		Servers:       []string{"http://server"},
+	}
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`flushInterval: 30s`), 0o644))
+	config, content, err := loadConfigFile(path, defaults)
+	require.NoError(t, err)
+	require.Equal(t, 30*time.Second, config.FlushInterval.Duration)
+
+	// Changes made before the file is watched are applied as well.
+	require.NoError(t, os.WriteFile(path, []byte(`flushInterval: 1m`), 0o644))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	select {
+	case config := <-watchConfigFile(ctx, path, time.Millisecond, defaults, content):
+		require.Equal(t, time.Minute, config.FlushInterval.Duration)
+	case <-time.After(5 * time.Second):
+		t.Fatal("config change not applied")
+	}
+}
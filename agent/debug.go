@@ -0,0 +1,174 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/polarsignals/kubezonnet/byteorder"
+	"github.com/polarsignals/kubezonnet/payload"
+)
+
+// FlowPeeker is implemented by FlowSources that can return the flows of the
+// current window without resetting them.
+type FlowPeeker interface {
+	Peek() ([]payload.IPKey, []payload.IPValue, error)
+}
+
+// DebugFlow is a flow of the current window, as shown by the debug endpoint.
+type DebugFlow struct {
+	SrcIP     string `json:"srcIP"`
+	SrcPort   uint16 `json:"srcPort"`
+	SrcPod    string `json:"srcPod,omitempty"`
+	DstIP     string `json:"dstIP"`
+	DstPort   uint16 `json:"dstPort"`
+	DstPod    string `json:"dstPod,omitempty"`
+	Interface string `json:"interface,omitempty"`
+	Bytes     uint64 `json:"bytes"`
+}
+
+var (
+	errNotRunning = errors.New("agent is not running yet")
+	errNoPeeking  = errors.New("flow source does not support peeking at the current window")
+)
+
+// peekFlows returns the flows of the current window, scaled up by the
+// sample rate of the source. The source is held while it is read, so that it
+// isn't replaced and closed in the meantime.
+func (a *Agent) peekFlows() ([]payload.IPKey, []payload.IPValue, error) {
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+	if a.source == nil {
+		return nil, nil, errNotRunning
+	}
+	peeker, ok := a.source.(FlowPeeker)
+	if !ok {
+		return nil, nil, errNoPeeking
+	}
+	keys, values, err := peeker.Peek()
+	if err != nil {
+		return nil, nil, err
+	}
+	scaleSampled(a.source, values)
+	return keys, values, nil
+}
+
+// DebugFlowsHandler serves the flows captured in the current window, without
+// resetting them. IPs of pods on the node are resolved to the pods'
+// namespace/name.
+//
+// Query parameters:
+//   - format: "table" (default) or "json".
+//   - sort: "bytes" (default), "src" or "dst".
+//   - order: "desc" (default for bytes) or "asc" (default otherwise).
+func (a *Agent) DebugFlowsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys, values, err := a.peekFlows()
+		switch {
+		case errors.Is(err, errNotRunning):
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		case errors.Is(err, errNoPeeking):
+			http.Error(w, err.Error(), http.StatusNotImplemented)
+			return
+		case err != nil:
+			http.Error(w, fmt.Sprintf("failed to read flows: %v", err), http.StatusInternalServerError)
+			return
+		}
+		_, pods := a.components()
+
+		podNames := map[uint32]string{}
+		if pods != nil {
+			for _, pod := range pods.List() {
+				for _, podIP := range pod.Status.PodIPs {
+					ip := net.ParseIP(podIP.IP)
+					if ip == nil || ip.To4() == nil {
+						continue
+					}
+					podNames[ipToUint32(ip)] = pod.Namespace + "/" + pod.Name
+				}
+			}
+		}
+
+		interfaces := interfaceNames(keys)
+		flows := make([]DebugFlow, 0, len(keys))
+		for i, key := range keys {
+			flows = append(flows, DebugFlow{
+				SrcIP:     formatIP(key.SrcIP),
+				SrcPort:   key.SrcPort,
+				SrcPod:    podNames[byteorder.Ntohl(key.SrcIP)],
+				DstIP:     formatIP(key.DstIP),
+				DstPort:   key.DstPort,
+				DstPod:    podNames[byteorder.Ntohl(key.DstIP)],
+				Interface: interfaceName(interfaces, key.Ifindex),
+				Bytes:     values[i].PacketSize,
+			})
+		}
+
+		query := r.URL.Query()
+		if err := sortDebugFlows(flows, query.Get("sort"), query.Get("order")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		switch query.Get("format") {
+		case "json":
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(flows); err != nil {
+				http.Error(w, fmt.Sprintf("failed to encode flows: %v", err), http.StatusInternalServerError)
+			}
+		case "", "table":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(tw, "SOURCE\tSOURCE POD\tDESTINATION\tDESTINATION POD\tINTERFACE\tBYTES")
+			for _, flow := range flows {
+				fmt.Fprintf(tw, "%s:%d\t%s\t%s:%d\t%s\t%s\t%d\n", flow.SrcIP, flow.SrcPort, flow.SrcPod, flow.DstIP, flow.DstPort, flow.DstPod, flow.Interface, flow.Bytes)
+			}
+			tw.Flush()
+		default:
+			http.Error(w, fmt.Sprintf("unknown format %q", query.Get("format")), http.StatusBadRequest)
+		}
+	})
+}
+
+func sortDebugFlows(flows []DebugFlow, by, order string) error {
+	var less func(a, b DebugFlow) bool
+	switch by {
+	case "", "bytes":
+		less = func(a, b DebugFlow) bool { return a.Bytes < b.Bytes }
+		if order == "" {
+			order = "desc"
+		}
+	case "src":
+		less = func(a, b DebugFlow) bool {
+			if c := netip.MustParseAddr(a.SrcIP).Compare(netip.MustParseAddr(b.SrcIP)); c != 0 {
+				return c < 0
+			}
+			return a.SrcPort < b.SrcPort
+		}
+	case "dst":
+		less = func(a, b DebugFlow) bool {
+			if c := netip.MustParseAddr(a.DstIP).Compare(netip.MustParseAddr(b.DstIP)); c != 0 {
+				return c < 0
+			}
+			return a.DstPort < b.DstPort
+		}
+	default:
+		return fmt.Errorf("unknown sort %q", by)
+	}
+
+	switch order {
+	case "", "asc":
+		sort.SliceStable(flows, func(i, j int) bool { return less(flows[i], flows[j]) })
+	case "desc":
+		sort.SliceStable(flows, func(i, j int) bool { return less(flows[j], flows[i]) })
+	default:
+		return fmt.Errorf("unknown order %q", order)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/polarsignals/kubezonnet/byteorder"
+	"github.com/polarsignals/kubezonnet/payload"
+)
+
+func TestDebugFlowsHandler(t *testing.T) {
+	local := byteorder.Htonl(0x0a000001)  // 10.0.0.1
+	remote := byteorder.Htonl(0x0a000102) // 10.0.1.2
+
+	source := &fakeSource{}
+	source.add(payload.IPKey{SrcIP: local, DstIP: remote, SrcPort: 40000, DstPort: 80}, payload.IPValue{PacketSize: 10})
+	source.add(payload.IPKey{SrcIP: remote, DstIP: local, SrcPort: 80, DstPort: 40000}, payload.IPValue{PacketSize: 20})
+
+	a, err := New(Options{
+		Node: "node-a",
+		Config: Config{
+			SubnetCIDRs:   []string{"10.0.0.0/16"},
+			FlushInterval: Duration{10 * time.Second},
+			Servers:       []string{"http://server"},
+		},
+		Source: source,
+		Pods: fakePods{{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "client"},
+			Status:     v1.PodStatus{PodIPs: []v1.PodIP{{IP: "10.0.0.1"}}},
+		}},
+	})
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	a.DebugFlowsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/flows?format=json", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var flows []DebugFlow
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&flows))
+	require.Equal(t, []DebugFlow{
+		{SrcIP: "10.0.1.2", SrcPort: 80, DstIP: "10.0.0.1", DstPort: 40000, DstPod: "default/client", Bytes: 20},
+		{SrcIP: "10.0.0.1", SrcPort: 40000, SrcPod: "default/client", DstIP: "10.0.1.2", DstPort: 80, Bytes: 10},
+	}, flows)
+
+	// Peeking must not reset the current window.
+	keys, _, err := source.Collect(context.Background())
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+
+	rec = httptest.NewRecorder()
+	a.DebugFlowsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/flows?sort=size", nil))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+}
@@ -0,0 +1,244 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Modes for discovering the CIDRs to monitor automatically.
+const (
+	// CIDRDiscoveryNodes uses Node.spec.podCIDRs and the node addresses.
+	CIDRDiscoveryNodes = "nodes"
+	// CIDRDiscoveryCilium uses the IPAM spec and addresses of CiliumNodes.
+	CIDRDiscoveryCilium = "cilium"
+	// CIDRDiscoveryPods uses the IPs of all pods in the cluster. Every agent
+	// watches all pods, which loads the API server in large clusters, and
+	// only as many pods as fit into the subnet map are monitored.
+	CIDRDiscoveryPods = "pods"
+)
+
+var ciliumNodeResource = schema.GroupVersionResource{
+	Group:    "cilium.io",
+	Version:  "v2",
+	Resource: "ciliumnodes",
+}
+
+// discoveryDebounce is how long to wait for further changes before
+// recomputing the CIDRs, so that a rollout doesn't cause an update per pod.
+const discoveryDebounce = time.Second
+
+// discoverCIDRs watches the cluster for the CIDRs to monitor according to
+// mode. Every time they change, the full sorted set is sent on the returned
+// channel. If mode is empty, nil is returned and nothing is watched.
+func discoverCIDRs(ctx context.Context, kubeConfig *rest.Config, mode string) (<-chan []string, error) {
+	switch mode {
+	case "":
+		return nil, nil
+	case CIDRDiscoveryNodes, CIDRDiscoveryPods:
+		clientset, err := kubernetes.NewForConfig(kubeConfig)
+		if err != nil {
+			return nil, fmt.Errorf("create kubernetes client: %w", err)
+		}
+		factory := informers.NewSharedInformerFactory(clientset, 0)
+		if mode == CIDRDiscoveryNodes {
+			return watchCIDRs(ctx, factory.Core().V1().Nodes().Informer(), nodeCIDRs), nil
+		}
+		return watchCIDRs(ctx, factory.Core().V1().Pods().Informer(), podCIDRs), nil
+	case CIDRDiscoveryCilium:
+		discoveryClient, err := discovery.NewDiscoveryClientForConfig(kubeConfig)
+		if err != nil {
+			return nil, fmt.Errorf("create discovery client: %w", err)
+		}
+		// Without the CRD, the informer would retry silently and never
+		// discover anything.
+		if err := requireResource(discoveryClient, ciliumNodeResource); err != nil {
+			return nil, fmt.Errorf("%w, is Cilium installed?", err)
+		}
+		client, err := dynamic.NewForConfig(kubeConfig)
+		if err != nil {
+			return nil, fmt.Errorf("create dynamic kubernetes client: %w", err)
+		}
+		informer := dynamicinformer.NewFilteredDynamicInformer(client, ciliumNodeResource, metav1.NamespaceAll, 0, cache.Indexers{}, nil)
+		return watchCIDRs(ctx, informer.Informer(), ciliumNodeCIDRs), nil
+	default:
+		return nil, fmt.Errorf("unknown CIDR discovery mode %q", mode)
+	}
+}
+
+// requireResource checks that the API server serves resource, such as a
+// resource defined by a CRD.
+func requireResource(client discovery.DiscoveryInterface, resource schema.GroupVersionResource) error {
+	groupVersion := resource.GroupVersion().String()
+	resources, err := client.ServerResourcesForGroupVersion(groupVersion)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("list resources of %s: %w", groupVersion, err)
+	}
+	if resources != nil {
+		for _, r := range resources.APIResources {
+			if r.Name == resource.Resource {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("the API server doesn't serve %s", resource.GroupResource())
+}
+
+func watchCIDRs(ctx context.Context, informer cache.SharedIndexInformer, extract func(obj interface{}) []string) <-chan []string {
+	ch := make(chan []string)
+	changed := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+
+	_, _ = informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { notify() },
+		UpdateFunc: func(interface{}, interface{}) { notify() },
+		DeleteFunc: func(interface{}) { notify() },
+	})
+	go informer.Run(ctx.Done())
+
+	go func() {
+		defer close(ch)
+
+		if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+			return
+		}
+
+		var last []string
+		for {
+			cidrs := collectCIDRs(informer.GetStore().List(), extract)
+			if last == nil || !slices.Equal(cidrs, last) {
+				select {
+				case ch <- cidrs:
+				case <-ctx.Done():
+					return
+				}
+				last = cidrs
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-changed:
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(discoveryDebounce):
+			}
+		}
+	}()
+
+	return ch
+}
+
+// collectCIDRs returns the sorted and de-duplicated IPv4 CIDRs of objs.
+// Single IPs are returned as /32 CIDRs.
+func collectCIDRs(objs []interface{}, extract func(obj interface{}) []string) []string {
+	seen := map[string]struct{}{}
+	for _, obj := range objs {
+		for _, s := range extract(obj) {
+			if ip := net.ParseIP(s); ip != nil {
+				s += "/32"
+			}
+			ip, ipNet, err := net.ParseCIDR(s)
+			if err != nil || ip.To4() == nil {
+				continue
+			}
+			seen[ipNet.String()] = struct{}{}
+		}
+	}
+
+	res := make([]string, 0, len(seen))
+	for cidr := range seen {
+		res = append(res, cidr)
+	}
+	slices.Sort(res)
+	return res
+}
+
+func nodeCIDRs(obj interface{}) []string {
+	node, ok := obj.(*v1.Node)
+	if !ok {
+		return nil
+	}
+
+	// Node addresses are included for hostNetwork pods.
+	res := slices.Clone(node.Spec.PodCIDRs)
+	for _, address := range node.Status.Addresses {
+		if address.Type == v1.NodeInternalIP {
+			res = append(res, address.Address)
+		}
+	}
+	return res
+}
+
+func podCIDRs(obj interface{}) []string {
+	pod, ok := obj.(*v1.Pod)
+	if !ok {
+		return nil
+	}
+
+	res := make([]string, 0, len(pod.Status.PodIPs))
+	for _, podIP := range pod.Status.PodIPs {
+		res = append(res, podIP.IP)
+	}
+	return res
+}
+
+func ciliumNodeCIDRs(obj interface{}) []string {
+	node, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil
+	}
+
+	// Cluster-pool IPAM.
+	res, _, _ := unstructured.NestedStringSlice(node.Object, "spec", "ipam", "podCIDRs")
+
+	// Multi-pool IPAM.
+	pools, _, _ := unstructured.NestedSlice(node.Object, "spec", "ipam", "pools", "allocated")
+	for _, pool := range pools {
+		pool, ok := pool.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		cidrs, _, _ := unstructured.NestedStringSlice(pool, "cidrs")
+		res = append(res, cidrs...)
+	}
+
+	addresses, _, _ := unstructured.NestedSlice(node.Object, "spec", "addresses")
+	for _, address := range addresses {
+		address, ok := address.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if t, _, _ := unstructured.NestedString(address, "type"); t != string(v1.NodeInternalIP) {
+			continue
+		}
+		if ip, _, _ := unstructured.NestedString(address, "ip"); ip != "" {
+			res = append(res, ip)
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,61 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCollectCIDRs(t *testing.T) {
+	nodes := []interface{}{
+		&v1.Node{
+			Spec: v1.NodeSpec{PodCIDRs: []string{"10.0.1.0/24", "fd00:1::/64"}},
+			Status: v1.NodeStatus{Addresses: []v1.NodeAddress{
+				{Type: v1.NodeInternalIP, Address: "192.168.0.1"},
+				{Type: v1.NodeExternalIP, Address: "34.1.2.3"},
+			}},
+		},
+		&v1.Node{
+			Spec: v1.NodeSpec{PodCIDRs: []string{"10.0.0.0/24", "10.0.1.0/24"}},
+		},
+	}
+	require.Equal(t, []string{"10.0.0.0/24", "10.0.1.0/24", "192.168.0.1/32"}, collectCIDRs(nodes, nodeCIDRs))
+
+	ciliumNodes := []interface{}{
+		&unstructured.Unstructured{Object: map[string]interface{}{
+			"spec": map[string]interface{}{
+				"addresses": []interface{}{
+					map[string]interface{}{"type": "InternalIP", "ip": "192.168.0.2"},
+					map[string]interface{}{"type": "CiliumInternalIP", "ip": "10.2.0.10"},
+				},
+				"ipam": map[string]interface{}{
+					"podCIDRs": []interface{}{"10.2.0.0/24"},
+					"pools": map[string]interface{}{
+						"allocated": []interface{}{
+							map[string]interface{}{"pool": "default", "cidrs": []interface{}{"10.3.0.0/26", "10.3.0.64/26"}},
+						},
+					},
+				},
+			},
+		}},
+	}
+	require.Equal(t, []string{"10.2.0.0/24", "10.3.0.0/26", "10.3.0.64/26", "192.168.0.2/32"}, collectCIDRs(ciliumNodes, ciliumNodeCIDRs))
+}
+
+func TestRequireResource(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	require.ErrorContains(t, requireResource(client.Discovery(), ciliumNodeResource), "doesn't serve ciliumnodes.cilium.io")
+
+	client.Resources = []*metav1.APIResourceList{{
+		GroupVersion: "cilium.io/v2",
+		APIResources: []metav1.APIResource{{Name: "ciliumendpoints"}},
+	}}
+	require.Error(t, requireResource(client.Discovery(), ciliumNodeResource))
+
+	client.Resources[0].APIResources = append(client.Resources[0].APIResources, metav1.APIResource{Name: "ciliumnodes"})
+	require.NoError(t, requireResource(client.Discovery(), ciliumNodeResource))
+}
@@ -0,0 +1,534 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/polarsignals/kubezonnet/byteorder"
+	"github.com/polarsignals/kubezonnet/flowpb"
+	"github.com/polarsignals/kubezonnet/payload"
+)
+
+// Schemes of servers that batches are streamed to over gRPC, in plain text
+// or with TLS.
+const (
+	schemeGRPC  = "grpc"
+	schemeGRPCS = "grpcs"
+)
+
+// isGRPCServer reports whether server is the URL of a gRPC flow service.
+func isGRPCServer(server string) bool {
+	return strings.HasPrefix(server, schemeGRPC+"://") || strings.HasPrefix(server, schemeGRPCS+"://")
+}
+
+// splitServers splits servers into the ones batches are sent to by HTTP and
+// the ones they are streamed to by gRPC.
+func splitServers(servers []string) (httpServers, grpcServers []string) {
+	for _, server := range servers {
+		if isGRPCServer(server) {
+			grpcServers = append(grpcServers, server)
+		} else {
+			httpServers = append(httpServers, server)
+		}
+	}
+	return httpServers, grpcServers
+}
+
+// grpcTarget returns the address of a gRPC server URL and whether TLS is
+// used.
+func grpcTarget(server string) (string, bool, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return "", false, err
+	}
+	if u.Host == "" {
+		return "", false, fmt.Errorf("gRPC server %q has no host", server)
+	}
+	return u.Host, u.Scheme == schemeGRPCS, nil
+}
+
+// serverConfig is the configuration servers ask agents to use. Zero values
+// keep the agent's own settings.
+type serverConfig struct {
+	// Revision identifies the configuration, empty if the server doesn't
+	// hold a central configuration.
+	Revision      string
+	SubnetCIDRs   []string
+	ExcludeCIDRs  []string
+	Aggregation   string
+	SampleRate    uint32
+	FlushInterval time.Duration
+}
+
+// ackTimeout is how long the acknowledgement of a batch is waited for before
+// the stream is given up.
+var ackTimeout = 30 * time.Second
+
+// maxReconnectBackoff bounds the time between attempts to open a stream to a
+// server that can't be reached.
+var maxReconnectBackoff = time.Minute
+
+// GRPCSink streams batches to kubezonnet servers over long-lived gRPC
+// streams. Once started, streams are kept open even while there is nothing
+// to send, so that servers know the agent and can change its configuration.
+// Servers acknowledge every batch and may ask the agent to back off, which
+// delays the next flush.
+type GRPCSink struct {
+	configs chan serverConfig
+
+	mtx   sync.Mutex
+	conns map[string]*grpcConn
+	// servers are the servers in the configured order, the configuration
+	// is only followed from the first one.
+	servers []string
+	tls     TLSConfig
+	// hello introduces the agent on every stream, nil until the sink is
+	// started.
+	hello *flowpb.Hello
+}
+
+// NewGRPCSink returns a sink that streams batches to all of the servers,
+// which are URLs with the grpc or grpcs scheme.
+func NewGRPCSink(servers []string, tlsConfig TLSConfig) (*GRPCSink, error) {
+	s := &GRPCSink{
+		configs: make(chan serverConfig, 1),
+		conns:   map[string]*grpcConn{},
+	}
+	if err := s.Update(servers, tlsConfig); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Update changes the servers batches are streamed to. The streams of servers
+// that are kept stay open, unless the TLS configuration changed. On error the
+// previous settings are kept.
+func (s *GRPCSink) Update(servers []string, tlsConfig TLSConfig) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	conns := make(map[string]*grpcConn, len(servers))
+	var errs []error
+	for _, server := range servers {
+		if conn, found := s.conns[server]; found && tlsConfig == s.tls {
+			conns[server] = conn
+			continue
+		}
+		conn, err := newGRPCConn(server, tlsConfig, s.pushConfig)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", server, err))
+			continue
+		}
+		conns[server] = conn
+	}
+	if err := errors.Join(errs...); err != nil {
+		for server, conn := range conns {
+			if s.conns[server] != conn {
+				conn.close()
+			}
+		}
+		return err
+	}
+
+	for server, conn := range s.conns {
+		if conns[server] != conn {
+			conn.close()
+		}
+	}
+	if s.hello != nil {
+		for server, conn := range conns {
+			if s.conns[server] != conn {
+				conn.start(s.hello)
+			}
+		}
+	}
+	s.conns = conns
+	s.servers = servers
+	s.tls = tlsConfig
+	return nil
+}
+
+// start opens the streams to all servers, introducing the agent described by
+// reg, and keeps them open until the sink is closed. Batches can only be
+// written once the sink is started.
+func (s *GRPCSink) start(reg payload.Registration) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.hello = &flowpb.Hello{
+		Node:         reg.Node,
+		AgentVersion: reg.AgentVersion,
+		CaptureMode:  reg.CaptureMode,
+		InstanceId:   reg.InstanceID,
+	}
+	for _, conn := range s.conns {
+		conn.start(s.hello)
+	}
+}
+
+func (s *GRPCSink) Write(ctx context.Context, batch Batch) error {
+	s.mtx.Lock()
+	conns := make([]*grpcConn, 0, len(s.conns))
+	for _, conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.mtx.Unlock()
+	if len(conns) == 0 {
+		return nil
+	}
+
+	msg := &flowpb.AgentMessage{Message: &flowpb.AgentMessage_Batch{Batch: flowBatch(batch)}}
+	var errs []error
+	for _, conn := range conns {
+		if err := conn.write(ctx, batch, msg); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", conn.server, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes the streams to all servers.
+func (s *GRPCSink) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, conn := range s.conns {
+		conn.close()
+	}
+	s.conns = map[string]*grpcConn{}
+	s.servers = nil
+	return nil
+}
+
+// configUpdates returns the configurations sent by servers, only the latest
+// one is kept until it is received.
+func (s *GRPCSink) configUpdates() <-chan serverConfig {
+	return s.configs
+}
+
+// pushConfig sends the configuration of server to the config updates, if
+// server is the first server.
+func (s *GRPCSink) pushConfig(server string, config serverConfig) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if len(s.servers) == 0 || s.servers[0] != server {
+		return
+	}
+	sendLatest(s.configs, config)
+}
+
+// sendLatest sends config on a channel with a buffer of one, replacing a
+// configuration that wasn't received yet.
+func sendLatest(configs chan serverConfig, config serverConfig) {
+	for {
+		select {
+		case configs <- config:
+			return
+		default:
+		}
+		select {
+		case <-configs:
+		default:
+		}
+	}
+}
+
+// flowBatch converts a batch to its protobuf representation.
+func flowBatch(batch Batch) *flowpb.FlowBatch {
+	msg := &flowpb.FlowBatch{
+		Sequence:    batch.Sequence,
+		WindowEnd:   timestamppb.New(batch.Time),
+		Aggregation: batch.Aggregation,
+		SampleRate:  batch.SampleRate,
+		Interfaces:  batch.Interfaces,
+		Records:     make([]*flowpb.FlowRecord, len(batch.Keys)),
+	}
+	if !batch.Start.IsZero() {
+		msg.WindowStart = timestamppb.New(batch.Start)
+	}
+	for i, key := range batch.Keys {
+		msg.Records[i] = &flowpb.FlowRecord{
+			SrcIp:        byteorder.Ntohl(key.SrcIP),
+			DstIp:        byteorder.Ntohl(key.DstIP),
+			SrcPort:      uint32(key.SrcPort),
+			DstPort:      uint32(key.DstPort),
+			Bytes:        batch.Values[i].PacketSize,
+			SquaredSizes: batch.Values[i].SquaredSizes,
+			Ifindex:      key.Ifindex,
+		}
+	}
+	return msg
+}
+
+// grpcConn is the connection to a server, on which a stream is kept open once
+// it is started, and reopened by the next write if it broke in the meantime.
+type grpcConn struct {
+	server string
+	client *grpc.ClientConn
+	// onConfig is called with the configurations sent by the server.
+	onConfig func(server string, config serverConfig)
+	ctx      context.Context
+	cancel   context.CancelFunc
+	// retryBackoff is the first wait before reconnecting.
+	retryBackoff time.Duration
+
+	mtx sync.Mutex
+	// hello introduces the agent on every stream, nil until the
+	// connection is started.
+	hello  *flowpb.Hello
+	stream *grpcStream
+	// resumeAt is when the server allows sending again after asking the
+	// agent to back off.
+	resumeAt time.Time
+}
+
+type grpcStream struct {
+	stream flowpb.FlowService_StreamClient
+	cancel context.CancelFunc
+	// acks receives the latest sequence number acknowledged by the server.
+	acks chan uint64
+	// done is closed once the stream broke, with err set to the reason.
+	done chan struct{}
+	err  error
+}
+
+func newGRPCConn(server string, tlsConfig TLSConfig, onConfig func(server string, config serverConfig)) (*grpcConn, error) {
+	target, secure, err := grpcTarget(server)
+	if err != nil {
+		return nil, err
+	}
+	creds := insecure.NewCredentials()
+	if secure {
+		config, err := tlsConfig.tlsConfig()
+		if err != nil {
+			return nil, fmt.Errorf("configure tls: %w", err)
+		}
+		creds = credentials.NewTLS(config)
+	}
+	client, err := grpc.NewClient(target, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, fmt.Errorf("create client: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &grpcConn{
+		server:       server,
+		client:       client,
+		onConfig:     onConfig,
+		ctx:          ctx,
+		cancel:       cancel,
+		retryBackoff: sendRetryBackoff,
+	}, nil
+}
+
+// write sends a batch and waits for its acknowledgement, retrying on a new
+// stream if the stream broke. The server deduplicates batches sent again by
+// their sequence number.
+func (c *grpcConn) write(ctx context.Context, batch Batch, msg *flowpb.AgentMessage) error {
+	c.mtx.Lock()
+	wait := time.Until(c.resumeAt)
+	c.mtx.Unlock()
+	if wait > 0 {
+		log.Printf("server %s asked to back off, waiting %v", c.server, wait)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := c.send(ctx, batch, msg)
+		if err == nil || attempt == sendAttempts || ctx.Err() != nil || rejected(err) {
+			return err
+		}
+		log.Printf("streaming data to %s failed, retrying: %v", c.server, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(time.Duration(attempt) * sendRetryBackoff):
+		}
+	}
+}
+
+func (c *grpcConn) send(ctx context.Context, batch Batch, msg *flowpb.AgentMessage) error {
+	st, err := c.open()
+	if err != nil {
+		return err
+	}
+	if err := st.stream.Send(msg); err != nil {
+		c.drop(st)
+		return fmt.Errorf("send batch: %w", err)
+	}
+
+	timeout := time.NewTimer(ackTimeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case seq := <-st.acks:
+			if seq == batch.Sequence {
+				return nil
+			}
+		case <-st.done:
+			return fmt.Errorf("stream broke: %w", st.err)
+		case <-timeout.C:
+			c.drop(st)
+			return errors.New("timed out waiting for acknowledgement")
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// start introduces the agent with hello on every stream, and keeps a stream
+// open until the connection is closed.
+func (c *grpcConn) start(hello *flowpb.Hello) {
+	c.mtx.Lock()
+	c.hello = hello
+	c.mtx.Unlock()
+	go c.connect()
+}
+
+// connect opens a stream, and opens it again whenever it broke, backing off
+// while the server can't be reached, until the connection is closed.
+func (c *grpcConn) connect() {
+	backoff := c.retryBackoff
+	for {
+		st, err := c.open()
+		if err == nil {
+			backoff = c.retryBackoff
+			select {
+			case <-st.done:
+				log.Printf("stream to %s broke, reconnecting: %v", c.server, st.err)
+			case <-c.ctx.Done():
+				return
+			}
+		} else if c.ctx.Err() == nil {
+			log.Printf("connecting to %s failed, retrying in %v: %v", c.server, backoff, err)
+		}
+
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxReconnectBackoff)
+	}
+}
+
+// open returns the current stream, or opens a new one introducing the agent.
+func (c *grpcConn) open() (*grpcStream, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.stream != nil {
+		return c.stream, nil
+	}
+	if c.hello == nil {
+		return nil, errors.New("sink not started")
+	}
+
+	ctx, cancel := context.WithCancel(c.ctx)
+	stream, err := flowpb.NewFlowServiceClient(c.client).Stream(ctx)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("open stream: %w", err)
+	}
+	hello := &flowpb.AgentMessage{Message: &flowpb.AgentMessage_Hello{Hello: c.hello}}
+	if err := stream.Send(hello); err != nil {
+		cancel()
+		return nil, fmt.Errorf("send hello: %w", err)
+	}
+
+	st := &grpcStream{
+		stream: stream,
+		cancel: cancel,
+		acks:   make(chan uint64, 1),
+		done:   make(chan struct{}),
+	}
+	c.stream = st
+	go c.receive(st)
+	return st, nil
+}
+
+// receive handles the messages of the server until the stream breaks.
+func (c *grpcConn) receive(st *grpcStream) {
+	for {
+		msg, err := st.stream.Recv()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = errors.New("closed by server")
+			}
+			st.err = err
+			c.drop(st)
+			close(st.done)
+			return
+		}
+
+		switch m := msg.Message.(type) {
+		case *flowpb.ServerMessage_Ack:
+			// Batches are sent one at a time, so only the latest
+			// acknowledgement matters.
+			select {
+			case <-st.acks:
+			default:
+			}
+			st.acks <- m.Ack.GetSequence()
+		case *flowpb.ServerMessage_Backpressure:
+			delay := m.Backpressure.GetDelay().AsDuration()
+			c.mtx.Lock()
+			c.resumeAt = time.Now().Add(delay)
+			c.mtx.Unlock()
+		case *flowpb.ServerMessage_Config:
+			config := serverConfig{
+				Revision:     m.Config.GetRevision(),
+				SubnetCIDRs:  m.Config.GetSubnetCidrs(),
+				ExcludeCIDRs: m.Config.GetExcludeCidrs(),
+				Aggregation:  m.Config.GetAggregation(),
+				SampleRate:   m.Config.GetSampleRate(),
+			}
+			if interval := m.Config.GetFlushInterval(); interval != nil {
+				config.FlushInterval = interval.AsDuration()
+			}
+			c.onConfig(c.server, config)
+		default:
+			// Messages added by later versions of the server.
+		}
+	}
+}
+
+// rejected reports whether the server rejected a batch for good, such as for
+// exceeding its limits, rather than failing transiently.
+func rejected(err error) bool {
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.ResourceExhausted:
+		return true
+	}
+	return false
+}
+
+// drop closes st, so that the next write opens a new stream.
+func (c *grpcConn) drop(st *grpcStream) {
+	c.mtx.Lock()
+	if c.stream == st {
+		c.stream = nil
+	}
+	c.mtx.Unlock()
+	st.cancel()
+}
+
+func (c *grpcConn) close() {
+	c.cancel()
+	c.client.Close()
+}
@@ -0,0 +1,264 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/polarsignals/kubezonnet/byteorder"
+	"github.com/polarsignals/kubezonnet/flowpb"
+	"github.com/polarsignals/kubezonnet/payload"
+)
+
+// fakeFlowService records the streams and batches of agents. It answers
+// every batch with the responses returned by respond.
+type fakeFlowService struct {
+	flowpb.UnimplementedFlowServiceServer
+
+	respond func(batch *flowpb.FlowBatch) []*flowpb.ServerMessage
+	// greet is sent to every agent after its hello.
+	greet []*flowpb.ServerMessage
+
+	mtx     sync.Mutex
+	hellos  []*flowpb.Hello
+	batches []*flowpb.FlowBatch
+}
+
+func (f *fakeFlowService) Stream(stream flowpb.FlowService_StreamServer) error {
+	msg, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	f.mtx.Lock()
+	f.hellos = append(f.hellos, msg.GetHello())
+	f.mtx.Unlock()
+	for _, response := range f.greet {
+		if err := stream.Send(response); err != nil {
+			return err
+		}
+	}
+
+	for {
+		msg, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		f.mtx.Lock()
+		f.batches = append(f.batches, msg.GetBatch())
+		f.mtx.Unlock()
+
+		for _, response := range f.respond(msg.GetBatch()) {
+			if response == nil {
+				return errors.New("breaking the stream")
+			}
+			if err := stream.Send(response); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func ack(batch *flowpb.FlowBatch) *flowpb.ServerMessage {
+	return &flowpb.ServerMessage{Message: &flowpb.ServerMessage_Ack{Ack: &flowpb.Ack{Sequence: batch.Sequence}}}
+}
+
+// startFakeFlowService serves f and returns its URL.
+func startFakeFlowService(t *testing.T, f *fakeFlowService) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	flowpb.RegisterFlowServiceServer(server, f)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+	return "grpc://" + lis.Addr().String()
+}
+
+func testBatch(seq uint64) Batch {
+	return Batch{
+		Node:       "node-a",
+		Time:       time.Now(),
+		InstanceID: "instance",
+		Sequence:   seq,
+		Interfaces: map[uint32]string{3: "eth0"},
+		Keys:       []payload.IPKey{{SrcIP: byteorder.Htonl(1), DstIP: byteorder.Htonl(2), SrcPort: 40000, DstPort: 80, Ifindex: 3}},
+		Values:     []payload.IPValue{{PacketSize: 10}},
+	}
+}
+
+// startGRPCSink returns a started sink streaming to servers.
+func startGRPCSink(t *testing.T, servers ...string) *GRPCSink {
+	sink, err := NewGRPCSink(servers, TLSConfig{})
+	require.NoError(t, err)
+	t.Cleanup(func() { sink.Close() })
+	sink.start(payload.Registration{Node: "node-a", InstanceID: "instance", CaptureMode: "netfilter"})
+	return sink
+}
+
+func TestGRPCSink(t *testing.T) {
+	f := &fakeFlowService{respond: func(batch *flowpb.FlowBatch) []*flowpb.ServerMessage {
+		return []*flowpb.ServerMessage{ack(batch)}
+	}}
+	sink := startGRPCSink(t, startFakeFlowService(t, f))
+
+	require.NoError(t, sink.Write(context.Background(), testBatch(1)))
+	require.NoError(t, sink.Write(context.Background(), testBatch(2)))
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	// Both batches are sent on the same stream.
+	require.Len(t, f.hellos, 1)
+	require.Equal(t, "node-a", f.hellos[0].Node)
+	require.Equal(t, "instance", f.hellos[0].InstanceId)
+	require.Equal(t, "netfilter", f.hellos[0].CaptureMode)
+	require.Len(t, f.batches, 2)
+	require.Equal(t, uint64(2), f.batches[1].Sequence)
+	require.Equal(t, map[uint32]string{3: "eth0"}, f.batches[0].Interfaces)
+	// IPs are sent in host byte order.
+	require.Equal(t, &flowpb.FlowRecord{SrcIp: 1, DstIp: 2, SrcPort: 40000, DstPort: 80, Bytes: 10, Ifindex: 3}, f.batches[0].Records[0])
+}
+
+func TestGRPCSinkConnect(t *testing.T) {
+	sendRetryBackoff = 10 * time.Millisecond
+	defer func() { sendRetryBackoff = time.Second }()
+
+	f := &fakeFlowService{
+		respond: func(batch *flowpb.FlowBatch) []*flowpb.ServerMessage { return nil },
+		greet:   []*flowpb.ServerMessage{{Message: &flowpb.ServerMessage_Config{Config: &flowpb.ConfigUpdate{Revision: "a"}}}},
+	}
+	// The server isn't reachable yet when the sink starts.
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := lis.Addr().String()
+	require.NoError(t, lis.Close())
+	sink := startGRPCSink(t, "grpc://"+addr)
+	time.Sleep(50 * time.Millisecond)
+
+	lis, err = net.Listen("tcp", addr)
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	flowpb.RegisterFlowServiceServer(server, f)
+	go server.Serve(lis)
+	defer server.Stop()
+
+	// The agent connects and is configured without sending a batch.
+	select {
+	case config := <-sink.configUpdates():
+		require.Equal(t, serverConfig{Revision: "a"}, config)
+	case <-time.After(10 * time.Second):
+		t.Fatal("no config update received")
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	require.Equal(t, "node-a", f.hellos[0].Node)
+	require.Empty(t, f.batches)
+}
+
+func TestGRPCSinkRetries(t *testing.T) {
+	sendRetryBackoff = time.Millisecond
+	defer func() { sendRetryBackoff = time.Second }()
+
+	var mtx sync.Mutex
+	broken := false
+	f := &fakeFlowService{respond: func(batch *flowpb.FlowBatch) []*flowpb.ServerMessage {
+		mtx.Lock()
+		defer mtx.Unlock()
+		// Breaks the stream once, before acknowledging the batch.
+		if !broken {
+			broken = true
+			return []*flowpb.ServerMessage{nil}
+		}
+		return []*flowpb.ServerMessage{ack(batch)}
+	}}
+	sink := startGRPCSink(t, startFakeFlowService(t, f))
+
+	require.NoError(t, sink.Write(context.Background(), testBatch(5)))
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	// The batch is sent again with the same sequence number on a new stream.
+	require.Len(t, f.hellos, 2)
+	require.Len(t, f.batches, 2)
+	require.Equal(t, uint64(5), f.batches[0].Sequence)
+	require.Equal(t, uint64(5), f.batches[1].Sequence)
+}
+
+func TestGRPCSinkConfigFirstServer(t *testing.T) {
+	withConfig := func(revision string) *fakeFlowService {
+		return &fakeFlowService{respond: func(batch *flowpb.FlowBatch) []*flowpb.ServerMessage {
+			return []*flowpb.ServerMessage{
+				{Message: &flowpb.ServerMessage_Config{Config: &flowpb.ConfigUpdate{Revision: revision}}},
+				ack(batch),
+			}
+		}}
+	}
+	first, second := startFakeFlowService(t, withConfig("a")), startFakeFlowService(t, withConfig("b"))
+	sink := startGRPCSink(t, first, second)
+
+	// Both servers sent their configuration before acknowledging the
+	// batch, only the first one's is followed.
+	require.NoError(t, sink.Write(context.Background(), testBatch(1)))
+	require.Equal(t, serverConfig{Revision: "a"}, <-sink.configUpdates())
+	select {
+	case config := <-sink.configUpdates():
+		t.Fatalf("unexpected config update %+v", config)
+	default:
+	}
+
+	require.NoError(t, sink.Update([]string{second, first}, TLSConfig{}))
+	require.NoError(t, sink.Write(context.Background(), testBatch(2)))
+	require.Equal(t, serverConfig{Revision: "b"}, <-sink.configUpdates())
+}
+
+func TestGRPCSinkServerMessages(t *testing.T) {
+	f := &fakeFlowService{respond: func(batch *flowpb.FlowBatch) []*flowpb.ServerMessage {
+		return []*flowpb.ServerMessage{
+			{Message: &flowpb.ServerMessage_Config{Config: &flowpb.ConfigUpdate{FlushInterval: durationpb.New(time.Minute), SubnetCidrs: []string{"10.0.0.0/8"}, SampleRate: 4, Revision: "a"}}},
+			ack(batch),
+			{Message: &flowpb.ServerMessage_Backpressure{Backpressure: &flowpb.Backpressure{Delay: durationpb.New(200 * time.Millisecond)}}},
+		}
+	}}
+	sink := startGRPCSink(t, startFakeFlowService(t, f))
+
+	require.NoError(t, sink.Write(context.Background(), testBatch(1)))
+	select {
+	case config := <-sink.configUpdates():
+		require.Equal(t, serverConfig{Revision: "a", SubnetCIDRs: []string{"10.0.0.0/8"}, SampleRate: 4, FlushInterval: time.Minute}, config)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no config update received")
+	}
+
+	// The next batch waits for the backoff the server asked for.
+	require.Eventually(t, func() bool {
+		sink.mtx.Lock()
+		defer sink.mtx.Unlock()
+		for _, conn := range sink.conns {
+			conn.mtx.Lock()
+			defer conn.mtx.Unlock()
+			return !conn.resumeAt.IsZero()
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, sink.Write(ctx, testBatch(2)), context.DeadlineExceeded)
+}
+
+func TestSplitServers(t *testing.T) {
+	httpServers, grpcServers := splitServers([]string{"http://a:8080", "grpc://b:8081", "grpcs://c:8081"})
+	require.Equal(t, []string{"http://a:8080"}, httpServers)
+	require.Equal(t, []string{"grpc://b:8081", "grpcs://c:8081"}, grpcServers)
+
+	_, err := NewGRPCSink([]string{"grpc://"}, TLSConfig{})
+	require.Error(t, err)
+}
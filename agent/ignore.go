@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/polarsignals/kubezonnet/payload"
+)
+
+// IgnoreAnnotation excludes the traffic of a pod, or of all pods in a
+// namespace, from the statistics if set to "true".
+const IgnoreAnnotation = payload.IgnoreAnnotation
+
+// NamespaceGetter gets namespaces by name.
+type NamespaceGetter interface {
+	Get(name string) (*v1.Namespace, bool)
+}
+
+// hasIgnoreAnnotation reports whether obj is annotated with IgnoreAnnotation.
+func hasIgnoreAnnotation(obj metav1.Object) bool {
+	return payload.Ignored(obj.GetAnnotations())
+}
+
+// ignoredPod reports whether pod or its namespace are annotated with
+// IgnoreAnnotation. namespaces may be nil, then only the pod is checked.
+func ignoredPod(pod *v1.Pod, namespaces NamespaceGetter) bool {
+	if hasIgnoreAnnotation(pod) {
+		return true
+	}
+	if namespaces == nil {
+		return false
+	}
+	namespace, found := namespaces.Get(pod.Namespace)
+	return found && hasIgnoreAnnotation(namespace)
+}
+
+// informerNamespaceGetter gets namespaces from an informer's store.
+type informerNamespaceGetter struct {
+	store cache.Store
+}
+
+func (g informerNamespaceGetter) Get(name string) (*v1.Namespace, bool) {
+	obj, found, err := g.store.GetByKey(name)
+	if err != nil || !found {
+		return nil, false
+	}
+	return obj.(*v1.Namespace), true
+}
+
+// watchNamespaces watches the namespaces of the cluster. It returns once the
+// informer has synced.
+func watchNamespaces(ctx context.Context, kubeConfig *rest.Config) (NamespaceGetter, error) {
+	clientset, err := kubernetes.NewForConfig(kubeConfig)
+	if err != nil {
+		return nil, fmt.Errorf("creating kubernetes client: %w", err)
+	}
+
+	informer := informers.NewSharedInformerFactory(clientset, 0).Core().V1().Namespaces().Informer()
+	go informer.Run(ctx.Done())
+
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return nil, fmt.Errorf("watch namespaces: %w", ctx.Err())
+	}
+	return informerNamespaceGetter{store: informer.GetStore()}, nil
+}
@@ -0,0 +1,50 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type fakeNamespaces map[string]*v1.Namespace
+
+func (n fakeNamespaces) Get(name string) (*v1.Namespace, bool) {
+	namespace, found := n[name]
+	return namespace, found
+}
+
+func TestIgnoredPod(t *testing.T) {
+	namespaces := fakeNamespaces{
+		"default": {ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+		"load-test": {ObjectMeta: metav1.ObjectMeta{
+			Name:        "load-test",
+			Annotations: map[string]string{IgnoreAnnotation: "true"},
+		}},
+	}
+
+	pod := testPod("a", "10.0.0.1")
+	require.False(t, ignoredPod(&pod, namespaces))
+	require.False(t, ignoredPod(&pod, nil))
+
+	pod.Namespace = "load-test"
+	require.True(t, ignoredPod(&pod, namespaces))
+	require.False(t, ignoredPod(&pod, nil))
+
+	pod.Namespace = "default"
+	pod.Annotations = map[string]string{IgnoreAnnotation: "false"}
+	require.False(t, ignoredPod(&pod, namespaces))
+	pod.Annotations[IgnoreAnnotation] = "true"
+	require.True(t, ignoredPod(&pod, nil))
+
+	// Ignored pods are remembered as such.
+	c := newPodIPCache(func(pod *v1.Pod) bool { return ignoredPod(pod, namespaces) })
+	other := testPod("b", "10.0.0.2")
+	host := testPod("c", "10.0.1.1")
+	host.Spec.HostNetwork = true
+	host.Annotations = pod.Annotations
+	c.observe(time.Now(), &pod, &other, &host)
+	require.Equal(t, map[uint32]bool{0x0a000001: true, 0x0a000002: false, 0x0a000101: false}, c.ips(time.Now(), time.Minute))
+}
@@ -0,0 +1,278 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// FlowRecord is the JSON representation of a single flow, as written by the
+// JSON based sinks.
+type FlowRecord struct {
+	Time        time.Time `json:"time"`
+	Node        string    `json:"node"`
+	Aggregation string    `json:"aggregation,omitempty"`
+	SampleRate  uint32    `json:"sampleRate,omitempty"`
+	SrcIP       string    `json:"srcIP"`
+	SrcPort     uint16    `json:"srcPort"`
+	DstIP       string    `json:"dstIP"`
+	DstPort     uint16    `json:"dstPort"`
+	Interface   string    `json:"interface,omitempty"`
+	Bytes       uint64    `json:"bytes"`
+}
+
+// encodeJSONLines encodes a batch as newline-delimited JSON, one FlowRecord
+// per line.
+func encodeJSONLines(batch Batch) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for i, key := range batch.Keys {
+		if err := enc.Encode(FlowRecord{
+			Time:        batch.Time,
+			Node:        batch.Node,
+			Aggregation: batch.Aggregation,
+			SampleRate:  batch.SampleRate,
+			SrcIP:       formatIP(key.SrcIP),
+			SrcPort:     key.SrcPort,
+			DstIP:       formatIP(key.DstIP),
+			DstPort:     key.DstPort,
+			Interface:   interfaceName(batch.Interfaces, key.Ifindex),
+			Bytes:       batch.Values[i].PacketSize,
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// JSONSink writes batches as newline-delimited JSON to a writer, such as
+// stdout.
+type JSONSink struct {
+	mtx sync.Mutex
+	w   io.Writer
+}
+
+// NewJSONSink returns a sink writing newline-delimited JSON to w.
+func NewJSONSink(w io.Writer) *JSONSink {
+	return &JSONSink{w: w}
+}
+
+func (s *JSONSink) Write(_ context.Context, batch Batch) error {
+	content, err := encodeJSONLines(batch)
+	if err != nil {
+		return fmt.Errorf("encode flows: %w", err)
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	_, err = s.w.Write(content)
+	return err
+}
+
+// RotatingFileSink writes batches as newline-delimited JSON to a file, which
+// is rotated once it exceeds a maximum size. Rotated files are suffixed with
+// .1 (most recent) up to .N, older ones are removed.
+type RotatingFileSink struct {
+	mtx      sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	f    *os.File
+	size int64
+}
+
+// NewRotatingFileSink opens or creates the file at path. maxFiles is the
+// number of rotated files to keep in addition to the current one.
+func NewRotatingFileSink(path string, maxSize int64, maxFiles int) (*RotatingFileSink, error) {
+	if maxSize <= 0 {
+		return nil, errors.New("maximum file size must be greater than zero")
+	}
+	if maxFiles < 0 {
+		return nil, errors.New("maximum number of files must not be negative")
+	}
+
+	f, size, err := openAppend(path)
+	if err != nil {
+		return nil, err
+	}
+	return &RotatingFileSink{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+		f:        f,
+		size:     size,
+	}, nil
+}
+
+// openAppend opens or creates the file at path for appending and returns its
+// size.
+func openAppend(path string) (*os.File, int64, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, 0, fmt.Errorf("open %s: %w", path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, fmt.Errorf("stat %s: %w", path, err)
+	}
+	return f, info.Size(), nil
+}
+
+func (s *RotatingFileSink) Write(_ context.Context, batch Batch) error {
+	content, err := encodeJSONLines(batch)
+	if err != nil {
+		return fmt.Errorf("encode flows: %w", err)
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	// If rotating fails, the batch is still appended to the current file
+	// and rotating is tried again on the next write.
+	var rotateErr error
+	if s.size > 0 && s.size+int64(len(content)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			rotateErr = fmt.Errorf("rotate %s: %w", s.path, err)
+		}
+	}
+
+	n, err := s.f.Write(content)
+	s.size += int64(n)
+	return errors.Join(rotateErr, err)
+}
+
+// rotate moves the current file aside and starts a new one. The current file
+// is only closed once the new one is open, so that the sink keeps a usable
+// file if rotating fails.
+func (s *RotatingFileSink) rotate() error {
+	if s.maxFiles == 0 {
+		if err := s.f.Truncate(0); err != nil {
+			return err
+		}
+		s.size = 0
+		return nil
+	}
+
+	for i := s.maxFiles - 1; i > 0; i-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Rename(s.path, s.path+".1"); err != nil {
+		return err
+	}
+	f, size, err := openAppend(s.path)
+	if err != nil {
+		// The current file was moved to .1 and is still written to.
+		return err
+	}
+	previous := s.f
+	s.f, s.size = f, size
+	return previous.Close()
+}
+
+// Close closes the current file.
+func (s *RotatingFileSink) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.f.Close()
+}
+
+// socketWriteTimeout is how long a Unix socket client may block a write
+// before it is disconnected.
+var socketWriteTimeout = time.Second
+
+// SocketSink streams batches as newline-delimited JSON to every client
+// connected to a Unix socket. Clients only receive batches flushed while they
+// are connected.
+type SocketSink struct {
+	listener net.Listener
+
+	mtx     sync.Mutex
+	clients map[net.Conn]*bufio.Writer
+}
+
+// NewSocketSink listens on a Unix socket at path, replacing a stale socket
+// left behind by a previous process.
+func NewSocketSink(path string) (*SocketSink, error) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("remove stale socket: %w", err)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("listen on %s: %w", path, err)
+	}
+
+	s := &SocketSink{
+		listener: listener,
+		clients:  map[net.Conn]*bufio.Writer{},
+	}
+	go s.accept()
+	return s, nil
+}
+
+func (s *SocketSink) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Println("failed to accept socket connection:", err)
+			}
+			return
+		}
+
+		s.mtx.Lock()
+		s.clients[conn] = bufio.NewWriter(conn)
+		s.mtx.Unlock()
+	}
+}
+
+func (s *SocketSink) Write(_ context.Context, batch Batch) error {
+	content, err := encodeJSONLines(batch)
+	if err != nil {
+		return fmt.Errorf("encode flows: %w", err)
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for conn, w := range s.clients {
+		_ = conn.SetWriteDeadline(time.Now().Add(socketWriteTimeout))
+		_, err := w.Write(content)
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			// Slow or disconnected clients are dropped rather than
+			// delaying the agent.
+			conn.Close()
+			delete(s.clients, conn)
+		}
+	}
+	return nil
+}
+
+// Close stops listening and disconnects all clients.
+func (s *SocketSink) Close() error {
+	err := s.listener.Close()
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for conn := range s.clients {
+		conn.Close()
+		delete(s.clients, conn)
+	}
+	return err
+}
@@ -0,0 +1,185 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/polarsignals/kubezonnet/byteorder"
+	"github.com/polarsignals/kubezonnet/payload"
+)
+
+func TestRotatingFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flows.jsonl")
+	batch := Batch{
+		Node: "node-a",
+		Time: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		Keys: []payload.IPKey{
+			{SrcIP: byteorder.Htonl(0x0a000001), DstIP: byteorder.Htonl(0x0a000002), SrcPort: 40000, DstPort: 80},
+		},
+		Values: []payload.IPValue{{PacketSize: 1500}},
+	}
+
+	content, err := encodeJSONLines(batch)
+	require.NoError(t, err)
+
+	// Room for two batches per file, keeping one rotated file.
+	s, err := NewRotatingFileSink(path, int64(2*len(content)), 1)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, s.Write(context.Background(), batch))
+	}
+	require.NoError(t, s.Close())
+
+	require.Equal(t, 1, countLines(t, path))
+	require.Equal(t, 2, countLines(t, path+".1"))
+	require.NoFileExists(t, path+".2")
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	var record FlowRecord
+	require.NoError(t, json.NewDecoder(f).Decode(&record))
+	require.Equal(t, FlowRecord{
+		Time:    batch.Time,
+		Node:    "node-a",
+		SrcIP:   "10.0.0.1",
+		SrcPort: 40000,
+		DstIP:   "10.0.0.2",
+		DstPort: 80,
+		Bytes:   1500,
+	}, record)
+}
+
+func TestRotatingFileSinkRotateFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flows.jsonl")
+	batch := Batch{
+		Node:   "node-a",
+		Keys:   []payload.IPKey{{SrcIP: byteorder.Htonl(0x0a000001), DstIP: byteorder.Htonl(0x0a000002)}},
+		Values: []payload.IPValue{{PacketSize: 1500}},
+	}
+
+	s, err := NewRotatingFileSink(path, 1, 1)
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.Write(context.Background(), batch))
+
+	// The current file can't be moved aside, so it is kept writing to.
+	require.NoError(t, os.MkdirAll(filepath.Join(path+".1", "blocker"), 0o755))
+	require.Error(t, s.Write(context.Background(), batch))
+	require.Equal(t, 2, countLines(t, path))
+
+	// Rotating is tried again on the next write.
+	require.NoError(t, os.RemoveAll(path+".1"))
+	require.NoError(t, s.Write(context.Background(), batch))
+	require.Equal(t, 1, countLines(t, path))
+	require.Equal(t, 2, countLines(t, path+".1"))
+}
+
+func TestJSONSink(t *testing.T) {
+	var buf bytes.Buffer
+	s := NewJSONSink(&buf)
+	batch := Batch{
+		Node:        "node-a",
+		Time:        time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		Aggregation: payload.AggregationServerPort,
+		SampleRate:  4,
+		Interfaces:  map[uint32]string{2: "eth0"},
+		Keys: []payload.IPKey{
+			{SrcIP: byteorder.Htonl(0x0a000001), DstIP: byteorder.Htonl(0x0a000002), DstPort: 80, Ifindex: 2},
+			{SrcIP: byteorder.Htonl(0x0a000001), DstIP: byteorder.Htonl(0x0a000003), DstPort: 443, Ifindex: 3},
+		},
+		Values: []payload.IPValue{{PacketSize: 1500}, {PacketSize: 60}},
+	}
+	require.NoError(t, s.Write(context.Background(), batch))
+	require.NoError(t, s.Write(context.Background(), batch))
+
+	// Every flow is a JSON object on its own line.
+	lines := bytes.Split(bytes.TrimSuffix(buf.Bytes(), []byte("\n")), []byte("\n"))
+	require.Len(t, lines, 4)
+	require.JSONEq(t, `{"time":"2024-01-01T00:00:00Z","node":"node-a","aggregation":"server-port","sampleRate":4,"srcIP":"10.0.0.1","srcPort":0,"dstIP":"10.0.0.2","dstPort":80,"interface":"eth0","bytes":1500}`, string(lines[0]))
+	require.JSONEq(t, `{"time":"2024-01-01T00:00:00Z","node":"node-a","aggregation":"server-port","sampleRate":4,"srcIP":"10.0.0.1","srcPort":0,"dstIP":"10.0.0.3","dstPort":443,"interface":"if3","bytes":60}`, string(lines[1]))
+	require.Equal(t, lines[:2], lines[2:])
+}
+
+func TestSocketSink(t *testing.T) {
+	socketWriteTimeout = 500 * time.Millisecond
+	defer func() { socketWriteTimeout = time.Second }()
+
+	path := filepath.Join(t.TempDir(), "flows.sock")
+	s, err := NewSocketSink(path)
+	require.NoError(t, err)
+	defer s.Close()
+
+	clients := func() int {
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		return len(s.clients)
+	}
+	connect := func() net.Conn {
+		n := clients()
+		conn, err := net.Dial("unix", path)
+		require.NoError(t, err)
+		require.Eventually(t, func() bool { return clients() == n+1 }, 5*time.Second, time.Millisecond)
+		return conn
+	}
+
+	reader := connect()
+	defer reader.Close()
+	// Never reads, so its socket buffer fills up.
+	slow := connect()
+	defer slow.Close()
+	disconnected := connect()
+	require.NoError(t, disconnected.Close())
+
+	// Large enough to exceed the socket buffer of the slow client.
+	var batch Batch
+	for i := range 10000 {
+		batch.Keys = append(batch.Keys, payload.IPKey{SrcIP: byteorder.Htonl(0x0a000001), DstIP: byteorder.Htonl(0x0a000002), DstPort: uint16(i)})
+		batch.Values = append(batch.Values, payload.IPValue{PacketSize: 1500})
+	}
+	received := make(chan [][]byte)
+	go func() {
+		var lines [][]byte
+		scanner := bufio.NewScanner(reader)
+		for len(lines) < len(batch.Keys) && scanner.Scan() {
+			lines = append(lines, bytes.Clone(scanner.Bytes()))
+		}
+		received <- lines
+	}()
+
+	// Slow and disconnected clients are dropped without failing the write.
+	require.NoError(t, s.Write(context.Background(), batch))
+	lines := <-received
+	require.Len(t, lines, len(batch.Keys))
+	for i, line := range lines {
+		var record FlowRecord
+		require.NoError(t, json.Unmarshal(line, &record))
+		require.Equal(t, uint16(i), record.DstPort)
+	}
+	require.Equal(t, 1, clients())
+}
+
+func countLines(t *testing.T, path string) int {
+	t.Helper()
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	n := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		n++
+	}
+	require.NoError(t, scanner.Err())
+	return n
+}
@@ -0,0 +1,177 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/rest"
+)
+
+// Sources of the pods running on the agent's node.
+const (
+	// PodSourceAPIServer watches the pods of the node using the API server.
+	PodSourceAPIServer = "apiserver"
+	// PodSourceKubelet polls the pods from the node's kubelet.
+	PodSourceKubelet = "kubelet"
+)
+
+// DefaultKubeletURL is the kubelet's API on the node, which the agent can
+// reach on localhost as it runs in the host network.
+const DefaultKubeletURL = "https://localhost:10250"
+
+const (
+	defaultKubeletPollInterval = 10 * time.Second
+	kubeletRequestTimeout      = 10 * time.Second
+	// kubeletRetryInterval is how often the first poll is retried.
+	kubeletRetryInterval = time.Second
+)
+
+// KubeletOptions configures how pods are read from the kubelet.
+type KubeletOptions struct {
+	// URL of the kubelet's API, DefaultKubeletURL if empty.
+	URL string
+	// InsecureSkipVerify disables verifying the kubelet's serving
+	// certificate, which is self-signed unless the kubelet requests it from
+	// the cluster's CA.
+	InsecureSkipVerify bool
+	// PollInterval is how often the pods are read, 10s if zero.
+	PollInterval time.Duration
+}
+
+// kubeletPodLister lists the pods last read from the kubelet's /pods
+// endpoint. The requests are authenticated with the credentials of the
+// agent's kubeconfig, usually its ServiceAccount token, which needs to be
+// allowed to get nodes/proxy.
+type kubeletPodLister struct {
+	client *http.Client
+	url    string
+	// podIPs records the IPs of every poll, if set.
+	podIPs *podIPCache
+
+	mtx  sync.RWMutex
+	pods []*v1.Pod
+}
+
+func newKubeletPodLister(kubeConfig *rest.Config, opts KubeletOptions) (*kubeletPodLister, error) {
+	url := opts.URL
+	if url == "" {
+		url = DefaultKubeletURL
+	}
+
+	config := rest.CopyConfig(kubeConfig)
+	config.Timeout = kubeletRequestTimeout
+	// The kubelet's certificate isn't issued for the API server's name.
+	config.TLSClientConfig.ServerName = ""
+	if opts.InsecureSkipVerify {
+		config.TLSClientConfig.Insecure = true
+		config.TLSClientConfig.CAFile = ""
+		config.TLSClientConfig.CAData = nil
+	}
+	client, err := rest.HTTPClientFor(config)
+	if err != nil {
+		return nil, fmt.Errorf("create kubelet client: %w", err)
+	}
+
+	return &kubeletPodLister{
+		client: client,
+		url:    strings.TrimSuffix(url, "/") + "/pods",
+	}, nil
+}
+
+func (l *kubeletPodLister) List() []*v1.Pod {
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+	return l.pods
+}
+
+// poll reads the pods from the kubelet. On failure the previously read pods
+// are kept.
+func (l *kubeletPodLister) poll(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, l.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("read pods from the kubelet: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("read pods from the kubelet: unexpected status %s", resp.Status)
+	}
+
+	var list v1.PodList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return fmt.Errorf("decode pods from the kubelet: %w", err)
+	}
+	pods := make([]*v1.Pod, 0, len(list.Items))
+	for i := range list.Items {
+		pods = append(pods, &list.Items[i])
+	}
+
+	l.mtx.Lock()
+	l.pods = pods
+	l.mtx.Unlock()
+	if l.podIPs != nil {
+		l.podIPs.observe(time.Now(), pods...)
+	}
+	return nil
+}
+
+// run polls the pods every interval until ctx is cancelled.
+func (l *kubeletPodLister) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := l.poll(ctx); err != nil && ctx.Err() == nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// pollKubeletPods lists the pods on the node by polling the kubelet and
+// records their IPs in podIPs. It returns once the pods were read, retrying
+// as the kubelet may not be ready yet. Failures of the following polls are
+// only logged.
+func pollKubeletPods(ctx context.Context, kubeConfig *rest.Config, opts KubeletOptions, podIPs *podIPCache) (PodLister, error) {
+	lister, err := newKubeletPodLister(kubeConfig, opts)
+	if err != nil {
+		return nil, err
+	}
+	lister.podIPs = podIPs
+
+	interval := opts.PollInterval
+	if interval <= 0 {
+		interval = defaultKubeletPollInterval
+	}
+
+	log.Println("polling pods from the kubelet", lister.url)
+	for {
+		err := lister.poll(ctx)
+		if err == nil {
+			break
+		}
+		log.Println(err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(kubeletRetryInterval):
+		}
+	}
+	go lister.run(ctx, interval)
+
+	return lister, nil
+}
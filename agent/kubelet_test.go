@@ -0,0 +1,96 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+)
+
+// fakeKubelet serves the pods of the node like the kubelet's /pods endpoint.
+type fakeKubelet struct {
+	pods   atomic.Pointer[v1.PodList]
+	failed atomic.Bool
+}
+
+func (k *fakeKubelet) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/pods" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer token" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if k.failed.Load() {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(k.pods.Load())
+}
+
+func testPod(name string, ips ...string) v1.Pod {
+	pod := v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name}}
+	for _, ip := range ips {
+		pod.Status.PodIPs = append(pod.Status.PodIPs, v1.PodIP{IP: ip})
+	}
+	return pod
+}
+
+func TestKubeletPodLister(t *testing.T) {
+	kubelet := &fakeKubelet{}
+	kubelet.pods.Store(&v1.PodList{Items: []v1.Pod{testPod("a", "10.0.0.1"), testPod("b", "10.0.0.2")}})
+	server := httptest.NewTLSServer(kubelet)
+	defer server.Close()
+
+	// The kubelet's certificate is verified with the cluster's CA, but not
+	// for the API server's name.
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	kubeConfig := &rest.Config{
+		Host:        "https://kubernetes.default.svc",
+		BearerToken: "token",
+		TLSClientConfig: rest.TLSClientConfig{
+			CAData:     ca,
+			ServerName: "kubernetes.default.svc",
+		},
+	}
+
+	ctx := context.Background()
+	lister, err := newKubeletPodLister(kubeConfig, KubeletOptions{URL: server.URL + "/"})
+	require.NoError(t, err)
+	require.Empty(t, lister.List())
+
+	require.NoError(t, lister.poll(ctx))
+	pods := lister.List()
+	require.Len(t, pods, 2)
+	require.Equal(t, "a", pods[0].Name)
+	require.Equal(t, "10.0.0.2", pods[1].Status.PodIPs[0].IP)
+
+	// The previous pods are kept if the kubelet fails.
+	kubelet.failed.Store(true)
+	require.Error(t, lister.poll(ctx))
+	require.Len(t, lister.List(), 2)
+
+	kubelet.failed.Store(false)
+	kubelet.pods.Store(&v1.PodList{Items: []v1.Pod{testPod("c", "10.0.0.3")}})
+	require.NoError(t, lister.poll(ctx))
+	require.Equal(t, "c", lister.List()[0].Name)
+
+	// Without credentials the kubelet refuses the request.
+	lister, err = newKubeletPodLister(&rest.Config{}, KubeletOptions{URL: server.URL, InsecureSkipVerify: true})
+	require.NoError(t, err)
+	require.Error(t, lister.poll(ctx))
+
+	// A kubelet with a self-signed certificate isn't trusted by default.
+	lister, err = newKubeletPodLister(&rest.Config{BearerToken: "token"}, KubeletOptions{URL: server.URL})
+	require.NoError(t, err)
+	require.Error(t, lister.poll(ctx))
+}
@@ -10,6 +10,19 @@
 #define IP_MF           0x2000
 #define IP_OFFSET       0x1FFF
 #define NEXTHDR_FRAGMENT    44
+#define ETH_HLEN        14
+
+// UDP ports of overlay encapsulations
+#define VXLAN_PORT          4789
+#define VXLAN_LINUX_PORT    8472 // Linux default, used by flannel and Cilium
+#define GENEVE_PORT         6081
+#define VXLAN_HLEN          8
+#define GENEVE_HLEN         8
+
+// How overlay encapsulated packets are handled, see encap_mode
+#define ENCAP_NONE      0 // record encapsulated packets like any other
+#define ENCAP_SKIP      1 // don't record them, their inner packet is recorded before encapsulation
+#define ENCAP_DECAP     2 // record their inner packet
 
 extern int bpf_dynptr_from_skb(struct __sk_buff *skb, __u64 flags,
                   struct bpf_dynptr *ptr__uninit) __ksym;
@@ -21,10 +34,23 @@ struct ip_key {
     __u32 dest_ip;
     __u16 src_port;
     __u16 dest_port;
+    __u32 ifindex; // interface the packet leaves the node on
 };
 
 struct ip_value {
     __u64 packet_size;
+    __u64 squared_sizes; // only recorded when sampling, to estimate the error margin
+};
+
+struct lpm_key {
+    __u32 prefixlen;
+    __u32 addr;
+};
+
+struct pressure_state {
+    __u64 entries;
+    __u32 signalled;
+    __u32 pad;
 };
 
 // Map to store cumulative packet sizes for each source-destination pair
@@ -35,36 +61,169 @@ struct {
     __uint(max_entries, 1024);
 } ip_map SEC(".maps");
 
-volatile const __u32 subnet_prefix;
-volatile const __u32 subnet_mask;
+// CIDRs to monitor, both source and destination must be contained for a packet to be recorded.
+// Large enough to hold a /32 per pod when the CIDRs are discovered from pod IPs.
+struct {
+    __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+    __type(key, struct lpm_key);
+    __type(value, __u8);
+    __uint(max_entries, 65536);
+    __uint(map_flags, BPF_F_NO_PREALLOC);
+} subnet_map SEC(".maps");
+
+// CIDRs to never record, takes precedence over subnet_map
+struct {
+    __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+    __type(key, struct lpm_key);
+    __type(value, __u8);
+    __uint(max_entries, 256);
+    __uint(map_flags, BPF_F_NO_PREALLOC);
+} exclude_map SEC(".maps");
+
+// Number of entries added to ip_map in the current window, reset by the agent when it flushes
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __type(key, __u32);
+    __type(value, struct pressure_state);
+    __uint(max_entries, 1);
+} pressure_state_map SEC(".maps");
+
+// Signals the agent to flush early, once per window, when ip_map crosses the high-water mark
+struct {
+    __uint(type, BPF_MAP_TYPE_RINGBUF);
+    __uint(max_entries, 4096);
+} pressure_events SEC(".maps");
+
+// Only 1 in sample_rate packets is recorded if greater than 1
+volatile const __u32 sample_rate;
 
-static int handle_v4(struct __sk_buff *skb)
+// Number of ip_map entries at which the agent is signalled, 0 disables signalling
+volatile const __u32 high_water_mark;
+
+// How overlay encapsulated packets are handled, one of the ENCAP_* modes
+volatile const __u32 encap_mode;
+
+static __always_inline void track_new_entry(void)
+{
+    __u32 zero = 0;
+    struct pressure_state *state = bpf_map_lookup_elem(&pressure_state_map, &zero);
+    if (!state)
+        return;
+
+    __sync_fetch_and_add(&state->entries, 1);
+    if (high_water_mark == 0 || state->entries < high_water_mark || state->signalled)
+        return;
+
+    // Concurrent CPUs may both get here, the agent coalesces duplicate signals.
+    state->signalled = 1;
+
+    __u64 *event = bpf_ringbuf_reserve(&pressure_events, sizeof(__u64), 0);
+    if (!event)
+        return;
+    *event = state->entries;
+    bpf_ringbuf_submit(event, 0);
+}
+
+static __always_inline int ip_in_map(void *map, __u32 addr)
+{
+    struct lpm_key key = {
+        .prefixlen = 32,
+        .addr = addr,
+    };
+
+    return bpf_map_lookup_elem(map, &key) != NULL;
+}
+
+// Returns a pointer to len bytes at offset of the packet, copied into buf if needed. Programs read through a
+// dynptr, the legacy program for kernels without skb dynptrs (<6.4) passes a NULL ptr to use bpf_skb_load_bytes
+// instead. As this is inlined with a constant ptr, each program only references one of them.
+static __always_inline void *read_packet(struct __sk_buff *skb, const struct bpf_dynptr *ptr, __u32 offset,
+                                         void *buf, __u32 len)
+{
+    if (ptr)
+        return bpf_dynptr_slice(ptr, offset, buf, len);
+    if (bpf_skb_load_bytes(skb, offset, buf, len))
+        return NULL;
+    return buf;
+}
+
+// Returns the offset of the inner IPv4 header if the packet with the given outer IPv4 header at offset
+// is IPIP, VXLAN or Geneve encapsulated, 0 otherwise.
+static __always_inline __u32 inner_offset(struct __sk_buff *skb, const struct bpf_dynptr *ptr,
+                                          const struct iphdr *ip, __u32 offset)
+{
+    offset += ip->ihl * 4;
+    if (ip->protocol == IPPROTO_IPIP)
+        return offset;
+    if (ip->protocol != IPPROTO_UDP)
+        return 0;
+
+    u8 udp_buf[sizeof(struct udphdr)] = {};
+    struct udphdr *udp = read_packet(skb, ptr, offset, udp_buf, sizeof(udp_buf));
+    if (!udp)
+        return 0;
+    offset += sizeof(struct udphdr);
+
+    switch (bpf_ntohs(udp->dest)) {
+        case VXLAN_PORT:
+        case VXLAN_LINUX_PORT:
+            return offset + VXLAN_HLEN + ETH_HLEN;
+        case GENEVE_PORT: {
+            // The low 6 bits of the first byte are the length of the options in 4 byte multiples
+            u8 gnv_buf[1] = {};
+            u8 *gnv = read_packet(skb, ptr, offset, gnv_buf, sizeof(gnv_buf));
+            if (!gnv)
+                return 0;
+            return offset + GENEVE_HLEN + (gnv[0] & 0x3f) * 4 + ETH_HLEN;
+        }
+    }
+
+    return 0;
+}
+
+// Records an IPv4 packet whose IP header starts at offset, leaving the node on ifindex. The packet is read through
+// ptr, or with bpf_skb_load_bytes if it is NULL.
+static __always_inline void handle_v4(struct __sk_buff *skb, const struct bpf_dynptr *ptr, __u32 offset,
+                                      __u32 ifindex)
 {
-    struct bpf_dynptr ptr;
     u8 iph_buf[20] = {};
     struct iphdr *ip;
 
-    if (bpf_dynptr_from_skb(skb, 0, &ptr))
-        return NF_ACCEPT;
+    if (sample_rate > 1 && bpf_get_prandom_u32() % sample_rate != 0)
+        return;
 
-    ip = bpf_dynptr_slice(&ptr, 0, iph_buf, sizeof(iph_buf));
+    ip = read_packet(skb, ptr, offset, iph_buf, sizeof(iph_buf));
     if (!ip)
-        return NF_ACCEPT;
+        return;
+
+    if (encap_mode != ENCAP_NONE) {
+        __u32 inner = inner_offset(skb, ptr, ip, offset);
+        if (inner) {
+            if (encap_mode == ENCAP_SKIP)
+                return;
+            offset = inner;
+            ip = read_packet(skb, ptr, offset, iph_buf, sizeof(iph_buf));
+            if (!ip || ip->version != 4)
+                return;
+        }
+    }
 
-    if ((ip->saddr & subnet_mask) == subnet_prefix && (ip->daddr & subnet_mask) == subnet_prefix) {
+    if (ip_in_map(&subnet_map, ip->saddr) && ip_in_map(&subnet_map, ip->daddr) &&
+        !ip_in_map(&exclude_map, ip->saddr) && !ip_in_map(&exclude_map, ip->daddr)) {
         struct ip_key key = {};
         key.src_ip = ip->saddr;
         key.dest_ip = ip->daddr;
         key.src_port = 0;
         key.dest_port = 0;
+        key.ifindex = ifindex;
 
-        // Extract ports for TCP and UDP
+        // Extract ports for TCP and UDP, only the first fragment of a packet has them
         __u8 protocol = ip->protocol;
         __u8 ihl = ip->ihl;
-        if (protocol == IPPROTO_TCP || protocol == IPPROTO_UDP) {
+        if ((protocol == IPPROTO_TCP || protocol == IPPROTO_UDP) && !(bpf_ntohs(ip->frag_off) & IP_OFFSET)) {
             // TCP and UDP headers both have ports at the same offset (first 4 bytes)
             u8 port_buf[4] = {};
-            __u16 *ports = bpf_dynptr_slice(&ptr, ihl * 4, port_buf, sizeof(port_buf));
+            __u16 *ports = read_packet(skb, ptr, offset + ihl * 4, port_buf, sizeof(port_buf));
             if (ports) {
                 key.src_port = bpf_ntohs(ports[0]);
                 key.dest_port = bpf_ntohs(ports[1]);
@@ -72,30 +231,45 @@ static int handle_v4(struct __sk_buff *skb)
         }
 
         __u64 packet_size = (__u64)bpf_ntohs(ip->tot_len);
+        __u64 squared_size = sample_rate > 1 ? packet_size * packet_size : 0;
 
         // Lookup or initialize the value in the map
         struct ip_value *value = bpf_map_lookup_elem(&ip_map, &key);
         if (value) {
             // Increment the packet size
             __sync_fetch_and_add(&value->packet_size, packet_size);
+            __sync_fetch_and_add(&value->squared_sizes, squared_size);
         } else {
             // Initialize a new entry
             struct ip_value new_value = {};
             new_value.packet_size = packet_size;
-            bpf_map_update_elem(&ip_map, &key, &new_value, BPF_ANY);
+            new_value.squared_sizes = squared_size;
+            if (bpf_map_update_elem(&ip_map, &key, &new_value, BPF_NOEXIST) == 0) {
+                track_new_entry();
+            } else {
+                // Another CPU created the entry in the meantime
+                value = bpf_map_lookup_elem(&ip_map, &key);
+                if (value) {
+                    __sync_fetch_and_add(&value->packet_size, packet_size);
+                    __sync_fetch_and_add(&value->squared_sizes, squared_size);
+                }
+            }
         }
     }
-
-    return NF_ACCEPT;
 }
 
 SEC("netfilter/postrouting")
 int nf_postrouting_hook(struct bpf_nf_ctx *ctx) {
     struct __sk_buff *skb = (struct __sk_buff *)ctx->skb;
+    const struct net_device *out = ctx->state->out;
+    __u32 ifindex = out ? out->ifindex : 0;
+    struct bpf_dynptr ptr;
 
     switch (bpf_ntohs(ctx->skb->protocol)) {
         case ETH_P_IP:
-            return handle_v4(skb);
+            if (bpf_dynptr_from_skb(skb, 0, &ptr) == 0)
+                handle_v4(skb, &ptr, 0, ifindex);
+            return NF_ACCEPT;
         case ETH_P_IPV6:
             return NF_ACCEPT; // don't support IPv6 yet
         default:
@@ -105,4 +279,28 @@ int nf_postrouting_hook(struct bpf_nf_ctx *ctx) {
     return NF_ACCEPT;
 }
 
+// Attached to the egress of interfaces by capture profiles where packets bypass netfilter, the packet
+// starts with the Ethernet header.
+SEC("tcx/egress")
+int tcx_egress_hook(struct __sk_buff *skb) {
+    struct bpf_dynptr ptr;
+
+    if (bpf_ntohs(skb->protocol) == ETH_P_IP && bpf_dynptr_from_skb(skb, 0, &ptr) == 0)
+        handle_v4(skb, &ptr, ETH_HLEN, skb->ifindex);
+
+    return TCX_NEXT;
+}
+
+// Fallback for kernels without netfilter eBPF programs and skb dynptrs (<6.4), attached to the root cgroup. Only sees
+// packets sent by sockets of processes, including pods, rather than all routed packets. The packet starts with the IP
+// header. The interface isn't recorded, as skb->ifindex is the interface of the sender's network namespace, such as a
+// pod's eth0, rather than the one the packet leaves the node on.
+SEC("cgroup_skb/egress")
+int cgroup_skb_egress_hook(struct __sk_buff *skb) {
+    if (bpf_ntohs(skb->protocol) == ETH_P_IP)
+        handle_v4(skb, NULL, 0, 0);
+
+    return 1; // allow
+}
+
 char __license[] SEC("license") = "Dual MIT/GPL";
@@ -17,9 +17,24 @@ type kubezonnetIpKey struct {
 	DestIp   uint32
 	SrcPort  uint16
 	DestPort uint16
+	Ifindex  uint32
 }
 
-type kubezonnetIpValue struct{ PacketSize uint64 }
+type kubezonnetIpValue struct {
+	PacketSize   uint64
+	SquaredSizes uint64
+}
+
+type kubezonnetLpmKey struct {
+	Prefixlen uint32
+	Addr      uint32
+}
+
+type kubezonnetPressureState struct {
+	Entries   uint64
+	Signalled uint32
+	Pad       uint32
+}
 
 // loadKubezonnet returns the embedded CollectionSpec for kubezonnet.
 func loadKubezonnet() (*ebpf.CollectionSpec, error) {
@@ -62,14 +77,20 @@ type kubezonnetSpecs struct {
 //
 // It can be passed ebpf.CollectionSpec.Assign.
 type kubezonnetProgramSpecs struct {
-	NfPostroutingHook *ebpf.ProgramSpec `ebpf:"nf_postrouting_hook"`
+	CgroupSkbEgressHook *ebpf.ProgramSpec `ebpf:"cgroup_skb_egress_hook"`
+	NfPostroutingHook   *ebpf.ProgramSpec `ebpf:"nf_postrouting_hook"`
+	TcxEgressHook       *ebpf.ProgramSpec `ebpf:"tcx_egress_hook"`
 }
 
 // kubezonnetMapSpecs contains maps before they are loaded into the kernel.
 //
 // It can be passed ebpf.CollectionSpec.Assign.
 type kubezonnetMapSpecs struct {
-	IpMap *ebpf.MapSpec `ebpf:"ip_map"`
+	ExcludeMap       *ebpf.MapSpec `ebpf:"exclude_map"`
+	IpMap            *ebpf.MapSpec `ebpf:"ip_map"`
+	PressureEvents   *ebpf.MapSpec `ebpf:"pressure_events"`
+	PressureStateMap *ebpf.MapSpec `ebpf:"pressure_state_map"`
+	SubnetMap        *ebpf.MapSpec `ebpf:"subnet_map"`
 }
 
 // kubezonnetObjects contains all objects after they have been loaded into the kernel.
@@ -91,12 +112,20 @@ func (o *kubezonnetObjects) Close() error {
 //
 // It can be passed to loadKubezonnetObjects or ebpf.CollectionSpec.LoadAndAssign.
 type kubezonnetMaps struct {
-	IpMap *ebpf.Map `ebpf:"ip_map"`
+	ExcludeMap       *ebpf.Map `ebpf:"exclude_map"`
+	IpMap            *ebpf.Map `ebpf:"ip_map"`
+	PressureEvents   *ebpf.Map `ebpf:"pressure_events"`
+	PressureStateMap *ebpf.Map `ebpf:"pressure_state_map"`
+	SubnetMap        *ebpf.Map `ebpf:"subnet_map"`
 }
 
 func (m *kubezonnetMaps) Close() error {
 	return _KubezonnetClose(
+		m.ExcludeMap,
 		m.IpMap,
+		m.PressureEvents,
+		m.PressureStateMap,
+		m.SubnetMap,
 	)
 }
 
@@ -104,12 +133,16 @@ func (m *kubezonnetMaps) Close() error {
 //
 // It can be passed to loadKubezonnetObjects or ebpf.CollectionSpec.LoadAndAssign.
 type kubezonnetPrograms struct {
-	NfPostroutingHook *ebpf.Program `ebpf:"nf_postrouting_hook"`
+	CgroupSkbEgressHook *ebpf.Program `ebpf:"cgroup_skb_egress_hook"`
+	NfPostroutingHook   *ebpf.Program `ebpf:"nf_postrouting_hook"`
+	TcxEgressHook       *ebpf.Program `ebpf:"tcx_egress_hook"`
 }
 
 func (p *kubezonnetPrograms) Close() error {
 	return _KubezonnetClose(
+		p.CgroupSkbEgressHook,
 		p.NfPostroutingHook,
+		p.TcxEgressHook,
 	)
 }
 
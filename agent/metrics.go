@@ -0,0 +1,50 @@
+package agent
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+type metrics struct {
+	flushes        prometheus.Counter
+	earlyFlushes   prometheus.Counter
+	flowsCollected prometheus.Counter
+	flowsSent      prometheus.Counter
+	// flowsDroppedNonLocal counts flows not sent by pods on the node.
+	flowsDroppedNonLocal prometheus.Counter
+	flowsIgnored         prometheus.Counter
+	sinkErrors           prometheus.Counter
+}
+
+func newMetrics(reg prometheus.Registerer) *metrics {
+	return &metrics{
+		flushes: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "kubezonnet_agent_flushes_total",
+			Help: "The number of times flows were collected from the flow source.",
+		}),
+		earlyFlushes: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "kubezonnet_agent_early_flushes_total",
+			Help: "The number of flushes triggered before the flush interval because the flow source crossed its high-water mark.",
+		}),
+		flowsCollected: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "kubezonnet_agent_flows_collected_total",
+			Help: "The number of flows collected from the flow source, before filtering and aggregation.",
+		}),
+		flowsSent: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "kubezonnet_agent_flows_sent_total",
+			Help: "The number of flows written to the sinks, after filtering and aggregation.",
+		}),
+		flowsDroppedNonLocal: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "kubezonnet_agent_flows_dropped_non_local_total",
+			Help: "The number of flows collected from the flow source that were dropped as they weren't sent by a pod on the node.",
+		}),
+		flowsIgnored: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "kubezonnet_agent_flows_ignored_total",
+			Help: "The number of flows collected from the flow source that were dropped as their pod or its namespace is annotated with kubezonnet.io/ignore.",
+		}),
+		sinkErrors: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "kubezonnet_agent_sink_errors_total",
+			Help: "The number of failed writes to sinks.",
+		}),
+	}
+}
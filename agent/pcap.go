@@ -0,0 +1,103 @@
+package agent
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Link types of pcap files.
+const (
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+	linkTypeLinuxSLL = 113
+	linkTypeIPv4     = 228
+)
+
+const (
+	pcapMagicMicroseconds = 0xa1b2c3d4
+	pcapMagicNanoseconds  = 0xa1b23c4d
+	// pcapMaxPacket bounds the size of a single packet, larger packets are
+	// a sign of a corrupt file.
+	pcapMaxPacket = 256 * 1024
+)
+
+// pcapReader reads packets from a pcap file (not pcapng) as Ethernet frames.
+type pcapReader struct {
+	r        io.Reader
+	order    binary.ByteOrder
+	linkType uint32
+}
+
+func newPcapReader(r io.Reader) (*pcapReader, error) {
+	var header [24]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("read pcap header: %w", err)
+	}
+
+	p := &pcapReader{r: r}
+	switch binary.LittleEndian.Uint32(header[:4]) {
+	case pcapMagicMicroseconds, pcapMagicNanoseconds:
+		p.order = binary.LittleEndian
+	default:
+		switch binary.BigEndian.Uint32(header[:4]) {
+		case pcapMagicMicroseconds, pcapMagicNanoseconds:
+			p.order = binary.BigEndian
+		default:
+			return nil, errors.New("not a pcap file")
+		}
+	}
+
+	p.linkType = p.order.Uint32(header[20:24]) & 0xffff
+	switch p.linkType {
+	case linkTypeEthernet, linkTypeRaw, linkTypeLinuxSLL, linkTypeIPv4:
+	default:
+		return nil, fmt.Errorf("unsupported pcap link type %d", p.linkType)
+	}
+	return p, nil
+}
+
+// next returns the next packet as an Ethernet frame, or io.EOF after the last
+// packet. Packets of other link types get a synthetic Ethernet header.
+func (p *pcapReader) next() ([]byte, error) {
+	var header [16]byte
+	if _, err := io.ReadFull(p.r, header[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("read packet header: %w", err)
+		}
+		return nil, err
+	}
+
+	size := p.order.Uint32(header[8:12])
+	if size > pcapMaxPacket {
+		return nil, fmt.Errorf("packet of %d bytes exceeds the maximum of %d", size, pcapMaxPacket)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(p.r, data); err != nil {
+		return nil, fmt.Errorf("read packet: %w", err)
+	}
+
+	switch p.linkType {
+	case linkTypeRaw, linkTypeIPv4:
+		etherType := uint16(0x0800)
+		if len(data) > 0 && data[0]>>4 == 6 {
+			etherType = 0x86DD
+		}
+		return withEthernetHeader(etherType, data), nil
+	case linkTypeLinuxSLL:
+		if len(data) < 16 {
+			return nil, errors.New("truncated Linux cooked capture header")
+		}
+		return withEthernetHeader(binary.BigEndian.Uint16(data[14:16]), data[16:]), nil
+	default:
+		return data, nil
+	}
+}
+
+func withEthernetHeader(etherType uint16, packet []byte) []byte {
+	frame := make([]byte, 14+len(packet))
+	binary.BigEndian.PutUint16(frame[12:14], etherType)
+	copy(frame[14:], packet)
+	return frame
+}
@@ -0,0 +1,87 @@
+package agent
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// podIPCache remembers the IPs of the pods on the node until some time after
+// they were last seen, so that the traffic of short-lived pods that were
+// deleted before their flows were collected is still kept.
+type podIPCache struct {
+	// ignored reports whether the traffic of a pod is ignored, if set.
+	ignored func(*v1.Pod) bool
+
+	mtx     sync.Mutex
+	entries map[uint32]podIPEntry
+}
+
+type podIPEntry struct {
+	lastSeen time.Time
+	ignored  bool
+}
+
+func newPodIPCache(ignored func(*v1.Pod) bool) *podIPCache {
+	return &podIPCache{ignored: ignored, entries: map[uint32]podIPEntry{}}
+}
+
+// observe records that the IPv4 addresses of pods were in use at now.
+func (c *podIPCache) observe(now time.Time, pods ...*v1.Pod) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for _, pod := range pods {
+		// Host network pods share the node's IPs, whose traffic can't be
+		// attributed to them.
+		ignored := !pod.Spec.HostNetwork && c.ignored != nil && c.ignored(pod)
+		for _, podIP := range pod.Status.PodIPs {
+			ip := net.ParseIP(podIP.IP)
+			if ip == nil || ip.To4() == nil {
+				continue
+			}
+			if entry := c.entries[ipToUint32(ip)]; now.After(entry.lastSeen) {
+				c.entries[ipToUint32(ip)] = podIPEntry{lastSeen: now, ignored: ignored}
+			}
+		}
+	}
+}
+
+// ips returns the IPs seen within retention before now, in host byte order,
+// mapped to whether the traffic of their pod is ignored. Older IPs are
+// forgotten, as they may have been reused by another node.
+func (c *podIPCache) ips(now time.Time, retention time.Duration) map[uint32]bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	ips := make(map[uint32]bool, len(c.entries))
+	for ip, entry := range c.entries {
+		if now.Sub(entry.lastSeen) > retention {
+			delete(c.entries, ip)
+			continue
+		}
+		ips[ip] = entry.ignored
+	}
+	return ips
+}
+
+// handler returns an informer event handler recording the pods' IPs, which
+// also sees the pods created and deleted in between flushes.
+func (c *podIPCache) handler() cache.ResourceEventHandler {
+	observe := func(obj interface{}) {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		if pod, ok := obj.(*v1.Pod); ok {
+			c.observe(time.Now(), pod)
+		}
+	}
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc:    observe,
+		UpdateFunc: func(_, obj interface{}) { observe(obj) },
+		DeleteFunc: observe,
+	}
+}
@@ -0,0 +1,33 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestPodIPCache(t *testing.T) {
+	c := newPodIPCache(nil)
+	start := time.Now()
+	a, b := testPod("a", "10.0.0.1", "fd00::1"), testPod("b", "10.0.0.2")
+
+	c.observe(start, &a, &b)
+	require.Equal(t, map[uint32]bool{0x0a000001: false, 0x0a000002: false}, c.ips(start, time.Minute))
+
+	// b was deleted, its IP is kept until the retention passed.
+	c.observe(start.Add(30*time.Second), &a)
+	require.Len(t, c.ips(start.Add(time.Minute), time.Minute), 2)
+	require.Equal(t, map[uint32]bool{0x0a000001: false}, c.ips(start.Add(61*time.Second), time.Minute))
+
+	// Observations out of order don't move the last seen time back.
+	c.observe(start, &a)
+	require.Len(t, c.ips(start.Add(90*time.Second), time.Minute), 1)
+
+	// Pods created and deleted between flushes are seen by the informer.
+	handler := c.handler()
+	pod := testPod("c", "10.0.0.3")
+	handler.OnDelete(cache.DeletedFinalStateUnknown{Key: "default/c", Obj: &pod})
+	require.Contains(t, c.ips(time.Now(), time.Minute), uint32(0x0a000003))
+}
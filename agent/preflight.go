@@ -0,0 +1,267 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/btf"
+	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/rlimit"
+	"golang.org/x/sys/unix"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// CheckStatus is the outcome of a preflight check.
+type CheckStatus int
+
+const (
+	CheckPass CheckStatus = iota
+	// CheckWarn means the agent may not work correctly, or the check
+	// couldn't tell.
+	CheckWarn
+	CheckFail
+)
+
+func (s CheckStatus) String() string {
+	switch s {
+	case CheckPass:
+		return "PASS"
+	case CheckWarn:
+		return "WARN"
+	case CheckFail:
+		return "FAIL"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// CheckResult is the result of a single preflight check.
+type CheckResult struct {
+	Name   string
+	Status CheckStatus
+	Detail string
+}
+
+// CheckOptions configures the preflight checks.
+type CheckOptions struct {
+	// CNIConfDir is the directory of the node's CNI network configuration.
+	CNIConfDir string
+	// KubeConfig is used to read the CNI's configuration from the cluster.
+	// If nil, the in-cluster config or ~/.kube/config is used.
+	KubeConfig *rest.Config
+}
+
+// minKernelVersion is the first kernel supporting netfilter eBPF programs.
+var minKernelVersion = [2]int{6, 4}
+
+// minFallbackKernelVersion is the first kernel supporting the cgroup_skb
+// fallback, which needs ring buffers and batch map operations.
+var minFallbackKernelVersion = [2]int{5, 8}
+
+// requiredKfuncs are the kernel functions the eBPF program calls.
+var requiredKfuncs = []string{"bpf_dynptr_from_skb", "bpf_dynptr_slice"}
+
+// RunChecks verifies that the node supports running the agent.
+func RunChecks(ctx context.Context, opts CheckOptions) []CheckResult {
+	results := []CheckResult{checkKernelVersion()}
+
+	spec, err := btf.LoadKernelSpec()
+	if err != nil {
+		results = append(results, CheckResult{Name: "kernel BTF", Status: CheckWarn, Detail: err.Error() + ", falling back to cgroup_skb"})
+	} else {
+		results = append(results, CheckResult{Name: "kernel BTF", Status: CheckPass, Detail: "available"})
+		results = append(results, checkKfuncs(spec))
+	}
+
+	results = append(results, checkNetfilterLink(), checkCgroupV2("/sys/fs/cgroup"))
+	return append(results, checkCNI(ctx, opts)...)
+}
+
+func checkKernelVersion() CheckResult {
+	result := CheckResult{Name: "kernel version"}
+
+	release, err := kernelRelease()
+	if err != nil {
+		result.Status, result.Detail = CheckFail, err.Error()
+		return result
+	}
+
+	version, err := parseKernelVersion(release)
+	if err != nil {
+		result.Status, result.Detail = CheckWarn, err.Error()
+		return result
+	}
+	switch {
+	case olderThan(version, minFallbackKernelVersion):
+		result.Status = CheckFail
+		result.Detail = fmt.Sprintf("%s, the agent requires %d.%d or newer", release, minFallbackKernelVersion[0], minFallbackKernelVersion[1])
+	case olderThan(version, minKernelVersion):
+		result.Status = CheckWarn
+		result.Detail = fmt.Sprintf("%s, netfilter eBPF programs require %d.%d or newer, falling back to capturing packets of processes with cgroup_skb", release, minKernelVersion[0], minKernelVersion[1])
+	default:
+		result.Status, result.Detail = CheckPass, release
+	}
+	return result
+}
+
+func olderThan(version, minVersion [2]int) bool {
+	return version[0] < minVersion[0] || version[0] == minVersion[0] && version[1] < minVersion[1]
+}
+
+func kernelRelease() (string, error) {
+	var uname unix.Utsname
+	if err := unix.Uname(&uname); err != nil {
+		return "", err
+	}
+	return unix.ByteSliceToString(uname.Release[:]), nil
+}
+
+// parseKernelVersion parses the major and minor version of a kernel release
+// such as "6.8.0-1015-gcp".
+func parseKernelVersion(release string) ([2]int, error) {
+	var major, minor int
+	if _, err := fmt.Sscanf(release, "%d.%d", &major, &minor); err != nil {
+		return [2]int{}, fmt.Errorf("unexpected kernel release %q", release)
+	}
+	return [2]int{major, minor}, nil
+}
+
+func checkKfuncs(spec *btf.Spec) CheckResult {
+	result := CheckResult{Name: "kfuncs"}
+
+	var missing []string
+	for _, name := range requiredKfuncs {
+		var fn *btf.Func
+		if err := spec.TypeByName(name, &fn); err != nil {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		result.Status, result.Detail = CheckWarn, "missing "+strings.Join(missing, ", ")+", falling back to cgroup_skb"
+		return result
+	}
+	result.Status, result.Detail = CheckPass, strings.Join(requiredKfuncs, ", ")
+	return result
+}
+
+// checkNetfilterLink attaches a program that accepts all packets to the
+// netfilter postrouting hook.
+func checkNetfilterLink() CheckResult {
+	result := CheckResult{Name: "netfilter BPF link"}
+
+	if err := rlimit.RemoveMemlock(); err != nil {
+		result.Status, result.Detail = CheckFail, fmt.Sprintf("removing memlock: %v", err)
+		return result
+	}
+
+	prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Type:       ebpf.Netfilter,
+		AttachType: ebpf.AttachNetfilter,
+		License:    "GPL",
+		Instructions: asm.Instructions{
+			asm.Mov.Imm(asm.R0, 1), // NF_ACCEPT
+			asm.Return(),
+		},
+	})
+	if err != nil {
+		result.Status, result.Detail = CheckWarn, fmt.Sprintf("load netfilter program: %v, falling back to cgroup_skb", err)
+		return result
+	}
+	defer prog.Close()
+
+	l, err := link.AttachNetfilter(link.NetfilterOptions{
+		ProtocolFamily: 2, // IPv4
+		HookNumber:     4, // netfilter postrouting
+		Program:        prog,
+	})
+	if err != nil {
+		result.Status, result.Detail = CheckWarn, fmt.Sprintf("attach netfilter: %v, falling back to cgroup_skb", err)
+		return result
+	}
+	l.Close()
+
+	result.Status, result.Detail = CheckPass, "attached to postrouting"
+	return result
+}
+
+func checkCgroupV2(path string) CheckResult {
+	result := CheckResult{Name: "cgroup v2"}
+
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		result.Status, result.Detail = CheckWarn, err.Error()
+		return result
+	}
+	if stat.Type != unix.CGROUP2_SUPER_MAGIC {
+		result.Status, result.Detail = CheckWarn, path+" is not a cgroup v2 hierarchy"
+		return result
+	}
+	result.Status, result.Detail = CheckPass, "mounted at "+path
+	return result
+}
+
+func checkCNI(ctx context.Context, opts CheckOptions) []CheckResult {
+	cni, path, err := DetectCNI(opts.CNIConfDir)
+	if err != nil {
+		return []CheckResult{{Name: "CNI", Status: CheckWarn, Detail: err.Error()}}
+	}
+	results := []CheckResult{{Name: "CNI", Status: CheckPass, Detail: fmt.Sprintf("%s (from %s)", cni, path)}}
+	if cni != CNICilium {
+		return results
+	}
+
+	result := CheckResult{Name: "Cilium host routing"}
+	kubeConfig := opts.KubeConfig
+	if kubeConfig == nil {
+		kubeConfig, err = loadKubeConfig()
+	}
+	var client kubernetes.Interface
+	if err == nil {
+		client, err = kubernetes.NewForConfig(kubeConfig)
+	}
+	if err != nil {
+		result.Status, result.Detail = CheckWarn, fmt.Sprintf("can't read the Cilium configuration: %v", err)
+		return append(results, result)
+	}
+	return append(results, checkCiliumHostRouting(ctx, client))
+}
+
+// checkCiliumHostRouting reads the routing mode from Cilium's ConfigMap.
+// With eBPF host routing, packets bypass netfilter and are only captured with
+// a capture profile attaching to the network cards.
+func checkCiliumHostRouting(ctx context.Context, client kubernetes.Interface) CheckResult {
+	result := CheckResult{Name: "Cilium host routing"}
+
+	config, err := readCiliumConfig(ctx, client)
+	if err != nil {
+		result.Status, result.Detail = CheckWarn, err.Error()
+		return result
+	}
+
+	switch {
+	case config["enable-host-legacy-routing"] == "true":
+		result.Status = CheckPass
+		result.Detail = fmt.Sprintf("legacy host routing, %s routing mode", config.routingMode())
+	case config.ebpfHostRouting():
+		result.Status = CheckWarn
+		result.Detail = fmt.Sprintf("eBPF host routing bypasses netfilter, %s routing mode, requires the cilium-ebpf capture profiles", config.routingMode())
+	default:
+		result.Status = CheckPass
+		result.Detail = fmt.Sprintf("legacy host routing as BPF masquerading is disabled, %s routing mode", config.routingMode())
+	}
+	return result
+}
+
+// ChecksFailed reports whether any of the results failed.
+func ChecksFailed(results []CheckResult) bool {
+	for _, result := range results {
+		if result.Status == CheckFail {
+			return true
+		}
+	}
+	return false
+}
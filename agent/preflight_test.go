@@ -0,0 +1,54 @@
+package agent
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParseKernelVersion(t *testing.T) {
+	for release, expected := range map[string][2]int{
+		"6.4.0":                    {6, 4},
+		"6.10.3-arch1-1":           {6, 10},
+		"5.15.0-1052-gke":          {5, 15},
+		"6.1.112+":                 {6, 1},
+		"6.8.0-1015-gcp.cos":       {6, 8},
+		"4.18.0-553.el8_10.x86_64": {4, 18},
+	} {
+		version, err := parseKernelVersion(release)
+		require.NoError(t, err, release)
+		require.Equal(t, expected, version, release)
+	}
+
+	_, err := parseKernelVersion("unknown")
+	require.Error(t, err)
+}
+
+func TestCheckCiliumHostRouting(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		data     map[string]string
+		expected CheckStatus
+	}{
+		{name: "legacy", data: map[string]string{"enable-host-legacy-routing": "true"}, expected: CheckPass},
+		{name: "ebpf", data: map[string]string{"enable-host-legacy-routing": "false"}, expected: CheckWarn},
+		{name: "bpf masquerade", data: map[string]string{"enable-bpf-masquerade": "true"}, expected: CheckWarn},
+		{name: "iptables masquerade", data: map[string]string{"enable-bpf-masquerade": "false"}, expected: CheckPass},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset(&v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "cilium-config"},
+				Data:       tc.data,
+			})
+			result := checkCiliumHostRouting(context.Background(), client)
+			require.Equal(t, tc.expected, result.Status, result.Detail)
+		})
+	}
+
+	result := checkCiliumHostRouting(context.Background(), fake.NewSimpleClientset())
+	require.Equal(t, CheckWarn, result.Status)
+}
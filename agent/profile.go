@@ -0,0 +1,239 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/cilium/ebpf/btf"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// CaptureProfileAuto detects the capture profile from the node's CNI.
+const CaptureProfileAuto = "auto"
+
+// Hooks the eBPF program can be attached to.
+const (
+	// HookNetfilter attaches to the netfilter postrouting hook, which sees
+	// all routed traffic unless the CNI bypasses netfilter.
+	HookNetfilter = "netfilter"
+	// HookTCX attaches to the egress of the profile's interfaces.
+	HookTCX = "tcx"
+	// HookCgroupSkb attaches to the egress of the root cgroup, seeing the
+	// packets sent by all processes including pods but not routed packets.
+	// It is the fallback for kernels older than 6.4, which support neither
+	// of the other hooks.
+	HookCgroupSkb = "cgroup_skb"
+)
+
+// Ways overlay encapsulated (IPIP, VXLAN or Geneve) packets are handled.
+const (
+	// EncapNone records encapsulated packets like any other.
+	EncapNone = "none"
+	// EncapSkip doesn't record encapsulated packets, as their inner packet
+	// was already recorded before encapsulation.
+	EncapSkip = "skip"
+	// EncapDecap records the inner packet of encapsulated packets.
+	EncapDecap = "decap"
+)
+
+// CaptureProfile describes how traffic is captured with a CNI.
+type CaptureProfile struct {
+	Name string
+	// Hook is where the eBPF program is attached, HookNetfilter or HookTCX.
+	Hook string
+	// Interfaces are glob patterns of the interfaces the program is attached
+	// to with HookTCX.
+	Interfaces []string
+	// Encap is how overlay encapsulated packets are handled.
+	Encap string
+}
+
+// physicalInterfaces match the usual names of network cards.
+var physicalInterfaces = []string{"eth*", "ens*", "enp*", "eno*", "enX*"}
+
+var captureProfiles = map[string]CaptureProfile{
+	// Cilium with legacy host routing passes traffic through netfilter, in
+	// tunnel mode the tunnel packets do as well.
+	"cilium":        {Hook: HookNetfilter, Encap: EncapNone},
+	"cilium-tunnel": {Hook: HookNetfilter, Encap: EncapSkip},
+	// With eBPF host routing Cilium redirects traffic to the network cards,
+	// bypassing netfilter.
+	"cilium-ebpf":        {Hook: HookTCX, Interfaces: physicalInterfaces, Encap: EncapNone},
+	"cilium-ebpf-tunnel": {Hook: HookTCX, Interfaces: physicalInterfaces, Encap: EncapDecap},
+	// Calico's IPIP and VXLAN overlays as well as flannel's VXLAN backend
+	// encapsulate in the kernel after the inner packet passed netfilter.
+	"calico":  {Hook: HookNetfilter, Encap: EncapSkip},
+	"flannel": {Hook: HookNetfilter, Encap: EncapSkip},
+	// The AWS VPC CNI and kindnet route natively.
+	"aws-vpc": {Hook: HookNetfilter, Encap: EncapNone},
+	"kindnet": {Hook: HookNetfilter, Encap: EncapNone},
+	// default captures everything passing netfilter.
+	"default": {Hook: HookNetfilter, Encap: EncapNone},
+	// cgroup-skb forces the fallback for old kernels.
+	"cgroup-skb": {Hook: HookCgroupSkb, Encap: EncapNone},
+}
+
+func init() {
+	for name, profile := range captureProfiles {
+		profile.Name = name
+		captureProfiles[name] = profile
+	}
+}
+
+// CaptureProfileNames returns the names of the built-in capture profiles.
+func CaptureProfileNames() []string {
+	names := make([]string, 0, len(captureProfiles))
+	for name := range captureProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LookupCaptureProfile returns the built-in capture profile with the given
+// name.
+func LookupCaptureProfile(name string) (CaptureProfile, error) {
+	profile, found := captureProfiles[name]
+	if !found {
+		return CaptureProfile{}, fmt.Errorf("unknown capture profile %q, must be one of %s", name, strings.Join(CaptureProfileNames(), ", "))
+	}
+	return profile, nil
+}
+
+// DetectCaptureProfile picks the capture profile for the CNI configured in
+// cniConfDir. For Cilium, the routing modes are read from its ConfigMap with
+// client, if set. The returned string explains the choice.
+func DetectCaptureProfile(ctx context.Context, cniConfDir string, client kubernetes.Interface) (CaptureProfile, string, error) {
+	cni, path, err := DetectCNI(cniConfDir)
+	if err != nil {
+		return CaptureProfile{}, "", fmt.Errorf("detect CNI: %w", err)
+	}
+
+	name := "default"
+	reason := fmt.Sprintf("%s CNI detected from %s", cni, path)
+	switch cni {
+	case CNICilium:
+		name = "cilium"
+		if client == nil {
+			reason += ", assuming legacy host routing and native routing"
+			break
+		}
+		config, err := readCiliumConfig(ctx, client)
+		if err != nil {
+			reason += fmt.Sprintf(", assuming legacy host routing and native routing: %v", err)
+			break
+		}
+		if config.ebpfHostRouting() {
+			name = "cilium-ebpf"
+		}
+		if config.tunnel() {
+			name += "-tunnel"
+		}
+		reason += fmt.Sprintf(", %s routing mode, eBPF host routing %t", config.routingMode(), config.ebpfHostRouting())
+	case CNICalico, CNIFlannel, CNIAWSVPC, CNIKindnet:
+		name = cni
+	}
+
+	profile, err := LookupCaptureProfile(name)
+	return profile, reason, err
+}
+
+// kernelSupport describes which hooks the running kernel supports.
+type kernelSupport struct {
+	// netfilter requires netfilter eBPF links and skb dynptrs (6.4).
+	netfilter bool
+	// tcx requires TCX links (6.6) and skb dynptrs.
+	tcx bool
+}
+
+func detectKernelSupport() (kernelSupport, error) {
+	release, err := kernelRelease()
+	if err != nil {
+		return kernelSupport{}, err
+	}
+	version, err := parseKernelVersion(release)
+	if err != nil {
+		return kernelSupport{}, err
+	}
+	// Vendor kernels may backport skb dynptrs, but not the hooks.
+	spec, err := btf.LoadKernelSpec()
+	if err != nil {
+		return kernelSupport{}, fmt.Errorf("load kernel BTF: %w", err)
+	}
+	var fn *btf.Func
+	skbDynptr := spec.TypeByName("bpf_dynptr_from_skb", &fn) == nil
+
+	return kernelSupportFor(version, skbDynptr), nil
+}
+
+func kernelSupportFor(version [2]int, skbDynptr bool) kernelSupport {
+	atLeast := func(major, minor int) bool {
+		return version[0] > major || version[0] == major && version[1] >= minor
+	}
+	return kernelSupport{
+		netfilter: skbDynptr && atLeast(6, 4),
+		tcx:       skbDynptr && atLeast(6, 6),
+	}
+}
+
+// hook returns the hook to attach to in place of hook. The cgroup_skb hook
+// replaces unsupported hooks, as it also sees the traffic bypassing
+// netfilter that the TCX hook is used for.
+func (k kernelSupport) hook(hook string) string {
+	switch hook {
+	case "", HookNetfilter:
+		if k.netfilter {
+			return HookNetfilter
+		}
+	case HookTCX:
+		if k.tcx {
+			return HookTCX
+		}
+	default:
+		return hook
+	}
+	return HookCgroupSkb
+}
+
+// ciliumConfig is the data of Cilium's ConfigMap.
+type ciliumConfig map[string]string
+
+func readCiliumConfig(ctx context.Context, client kubernetes.Interface) (ciliumConfig, error) {
+	cm, err := client.CoreV1().ConfigMaps("kube-system").Get(ctx, "cilium-config", metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("read the Cilium configuration: %w", err)
+	}
+	return ciliumConfig(cm.Data), nil
+}
+
+// routingMode returns "tunnel" or "native".
+func (c ciliumConfig) routingMode() string {
+	if mode := c["routing-mode"]; mode != "" {
+		return mode
+	}
+	// Before Cilium 1.14 the routing mode was configured with the tunnel
+	// protocol.
+	if c["tunnel"] == "disabled" {
+		return "native"
+	}
+	return "tunnel"
+}
+
+func (c ciliumConfig) tunnel() bool {
+	return c.routingMode() == "tunnel"
+}
+
+// ebpfHostRouting reports whether Cilium likely uses eBPF host routing, which
+// requires BPF masquerading unless explicitly disabled.
+func (c ciliumConfig) ebpfHostRouting() bool {
+	switch c["enable-host-legacy-routing"] {
+	case "true":
+		return false
+	case "false":
+		return true
+	}
+	return c["enable-bpf-masquerade"] == "true"
+}
@@ -0,0 +1,77 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestDetectCaptureProfile(t *testing.T) {
+	ciliumDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(ciliumDir, "05-cilium.conflist"), []byte(`{"plugins": [{"type": "cilium-cni"}]}`), 0o644))
+
+	for _, tc := range []struct {
+		name     string
+		data     map[string]string
+		expected string
+	}{
+		{name: "legacy native", data: map[string]string{"routing-mode": "native", "enable-host-legacy-routing": "true"}, expected: "cilium"},
+		{name: "legacy tunnel", data: map[string]string{"routing-mode": "tunnel", "enable-host-legacy-routing": "true"}, expected: "cilium-tunnel"},
+		{name: "ebpf native", data: map[string]string{"routing-mode": "native", "enable-bpf-masquerade": "true"}, expected: "cilium-ebpf"},
+		{name: "ebpf tunnel", data: map[string]string{"enable-host-legacy-routing": "false"}, expected: "cilium-ebpf-tunnel"},
+		{name: "pre 1.14 native", data: map[string]string{"tunnel": "disabled"}, expected: "cilium"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset(&v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "cilium-config"},
+				Data:       tc.data,
+			})
+			profile, _, err := DetectCaptureProfile(context.Background(), ciliumDir, client)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, profile.Name)
+		})
+	}
+
+	// Without Cilium's configuration the defaults are assumed.
+	profile, _, err := DetectCaptureProfile(context.Background(), ciliumDir, fake.NewSimpleClientset())
+	require.NoError(t, err)
+	require.Equal(t, "cilium", profile.Name)
+
+	kindnetDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(kindnetDir, "10-kindnet.conflist"), []byte(`{"name": "kindnet", "plugins": [{"type": "ptp"}, {"type": "portmap"}]}`), 0o644))
+	profile, _, err = DetectCaptureProfile(context.Background(), kindnetDir, nil)
+	require.NoError(t, err)
+	require.Equal(t, captureProfiles["kindnet"], profile)
+
+	_, err = LookupCaptureProfile("weave")
+	require.Error(t, err)
+}
+
+func TestKernelSupport(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		version   [2]int
+		skbDynptr bool
+		hooks     map[string]string
+	}{
+		{name: "6.8", version: [2]int{6, 8}, skbDynptr: true, hooks: map[string]string{"": HookNetfilter, HookNetfilter: HookNetfilter, HookTCX: HookTCX}},
+		{name: "6.4", version: [2]int{6, 4}, skbDynptr: true, hooks: map[string]string{"": HookNetfilter, HookTCX: HookCgroupSkb}},
+		{name: "5.15", version: [2]int{5, 15}, hooks: map[string]string{"": HookCgroupSkb, HookTCX: HookCgroupSkb}},
+		// Backported kfuncs don't make up for the missing hooks.
+		{name: "5.15 with dynptrs", version: [2]int{5, 15}, skbDynptr: true, hooks: map[string]string{HookNetfilter: HookCgroupSkb}},
+		{name: "6.8 without dynptrs", version: [2]int{6, 8}, hooks: map[string]string{HookNetfilter: HookCgroupSkb, HookCgroupSkb: HookCgroupSkb}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			support := kernelSupportFor(tc.version, tc.skbDynptr)
+			for hook, expected := range tc.hooks {
+				require.Equal(t, expected, support.hook(hook), hook)
+			}
+		})
+	}
+}
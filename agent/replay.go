@@ -0,0 +1,104 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/cilium/ebpf"
+
+	"github.com/polarsignals/kubezonnet/payload"
+)
+
+// Replayer runs recorded packets through the eBPF program with BPF_PROG_RUN
+// instead of capturing live traffic, to test the program without a cluster.
+// The program isn't attached anywhere.
+type Replayer struct {
+	objs kubezonnetObjects
+	prog *ebpf.Program
+}
+
+// NewReplayer loads the eBPF program configured like a BPFSource with opts.
+// Pinning and early flushes are ignored, and so is sampling, to make replays
+// deterministic. Netfilter programs share their packet handling with the TCX
+// program, which is run in their place as it receives the Ethernet frames
+// that pcaps hold.
+func NewReplayer(opts BPFOptions) (*Replayer, error) {
+	opts.HighWaterMark = 0
+	opts.SampleRate = 0
+	spec, _, err := loadSpec(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	hook := opts.Profile.Hook
+	if hook != HookCgroupSkb {
+		hook = HookTCX
+	}
+
+	r := &Replayer{}
+	if err := loadObjects(spec, hook, &r.objs, &ebpf.CollectionOptions{}); err != nil {
+		return nil, fmt.Errorf("load eBPF objects: %w", err)
+	}
+	r.prog = r.objs.TcxEgressHook
+	if hook == HookCgroupSkb {
+		r.prog = r.objs.CgroupSkbEgressHook
+	}
+	return r, nil
+}
+
+// SetCIDRs syncs the CIDRs to monitor and to exclude into the eBPF filter
+// maps.
+func (r *Replayer) SetCIDRs(subnets, excludes []*net.IPNet) error {
+	if err := syncCIDRMap(r.objs.SubnetMap, subnets); err != nil {
+		return fmt.Errorf("update subnet map: %w", err)
+	}
+	if err := syncCIDRMap(r.objs.ExcludeMap, excludes); err != nil {
+		return fmt.Errorf("update exclude map: %w", err)
+	}
+	return nil
+}
+
+// ReplayPcap runs every packet of a pcap file through the program, as if it
+// was leaving the node. The number of replayed packets is returned.
+func (r *Replayer) ReplayPcap(rd io.Reader) (int, error) {
+	packets, err := newPcapReader(rd)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for {
+		frame, err := packets.next()
+		if errors.Is(err, io.EOF) {
+			return n, nil
+		}
+		if err != nil {
+			return n, fmt.Errorf("packet %d: %w", n+1, err)
+		}
+
+		// Both programs are run with the Ethernet frame, cgroup_skb
+		// programs start at the IP header after it.
+		if _, err := r.prog.Run(&ebpf.RunOptions{Data: frame}); err != nil {
+			return n, fmt.Errorf("run packet %d: %w", n+1, err)
+		}
+		n++
+	}
+}
+
+// Flows returns the flows recorded from the replayed packets. The interfaces
+// of flows are meaningless, so they are left out.
+func (r *Replayer) Flows() ([]payload.IPKey, []payload.IPValue, error) {
+	keys, values, err := lookupFlows(r.objs.IpMap)
+	if err != nil {
+		return nil, nil, err
+	}
+	keys, values = dropInterfaces(keys, values)
+	return keys, values, nil
+}
+
+// Close unloads the eBPF program.
+func (r *Replayer) Close() error {
+	return r.objs.Close()
+}
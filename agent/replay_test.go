@@ -0,0 +1,152 @@
+package agent
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/stretchr/testify/require"
+
+	"github.com/polarsignals/kubezonnet/byteorder"
+	"github.com/polarsignals/kubezonnet/payload"
+)
+
+func TestPcapReader(t *testing.T) {
+	for name, expected := range map[string]int{
+		"tcp.pcap":           3,
+		"udp.pcap":           2,
+		"icmp.pcap":          2,
+		"fragments.pcap":     2,
+		"out_of_subnet.pcap": 5,
+		"vxlan.pcap":         1,
+	} {
+		f, err := os.Open(filepath.Join("testdata", name))
+		require.NoError(t, err)
+		defer f.Close()
+
+		r, err := newPcapReader(f)
+		require.NoError(t, err, name)
+
+		n := 0
+		for {
+			frame, err := r.next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			require.NoError(t, err, name)
+			// All frames are IPv4 over Ethernet, udp.pcap has raw IP
+			// packets that get a synthetic Ethernet header.
+			require.Equal(t, []byte{0x08, 0x00}, frame[12:14], name)
+			require.Equal(t, byte(0x45), frame[14], name)
+			n++
+		}
+		require.Equal(t, expected, n, name)
+	}
+
+	_, err := newPcapReader(strings.NewReader("not a pcap file at all"))
+	require.Error(t, err)
+}
+
+// newTestReplayer skips the test if the eBPF program can't be loaded, because
+// it isn't built or the kernel or privileges don't allow it.
+func newTestReplayer(t *testing.T, opts BPFOptions) *Replayer {
+	t.Helper()
+	if len(_KubezonnetBytes) == 0 {
+		t.Skip("eBPF object isn't built, run go generate")
+	}
+
+	r, err := NewReplayer(opts)
+	if errors.Is(err, ebpf.ErrNotSupported) || errors.Is(err, os.ErrPermission) {
+		t.Skip("can't load the eBPF program:", err)
+	}
+	require.NoError(t, err)
+	t.Cleanup(func() { r.Close() })
+
+	_, subnet, _ := net.ParseCIDR("10.0.0.0/16")
+	_, exclude, _ := net.ParseCIDR("10.0.3.0/24")
+	require.NoError(t, r.SetCIDRs([]*net.IPNet{subnet}, []*net.IPNet{exclude}))
+	return r
+}
+
+func TestReplay(t *testing.T) {
+	a := byteorder.Htonl(0x0a000001) // 10.0.0.1
+	b := byteorder.Htonl(0x0a000101) // 10.0.1.1
+	c := byteorder.Htonl(0x0a000202) // 10.0.2.2
+
+	type flow struct {
+		key   payload.IPKey
+		bytes uint64
+	}
+	for _, tc := range []struct {
+		pcap    string
+		profile CaptureProfile
+		flows   []flow
+	}{{
+		pcap: "tcp.pcap",
+		flows: []flow{
+			{payload.IPKey{SrcIP: a, DstIP: b, SrcPort: 40000, DstPort: 8080}, 180},
+			{payload.IPKey{SrcIP: b, DstIP: a, SrcPort: 8080, DstPort: 40000}, 40},
+		},
+	}, {
+		pcap:  "udp.pcap",
+		flows: []flow{{payload.IPKey{SrcIP: a, DstIP: c, SrcPort: 5353, DstPort: 53}, 160}},
+	}, {
+		pcap:  "icmp.pcap",
+		flows: []flow{{payload.IPKey{SrcIP: a, DstIP: b}, 168}},
+	}, {
+		// Only the first fragment has ports.
+		pcap: "fragments.pcap",
+		flows: []flow{
+			{payload.IPKey{SrcIP: a, DstIP: b, SrcPort: 4000, DstPort: 5000}, 1500},
+			{payload.IPKey{SrcIP: a, DstIP: b}, 520},
+		},
+	}, {
+		pcap:  "out_of_subnet.pcap",
+		flows: []flow{{payload.IPKey{SrcIP: a, DstIP: b, SrcPort: 40001, DstPort: 443}, 40}},
+	}, {
+		// The outer packet is between node IPs outside of the subnet.
+		pcap: "vxlan.pcap",
+	}, {
+		pcap:    "vxlan.pcap",
+		profile: captureProfiles["cilium-ebpf-tunnel"],
+		flows:   []flow{{payload.IPKey{SrcIP: a, DstIP: b, SrcPort: 40000, DstPort: 8080}, 100}},
+	}, {
+		// The fallback for old kernels reads the packets without dynptrs.
+		pcap:    "tcp.pcap",
+		profile: captureProfiles["cgroup-skb"],
+		flows: []flow{
+			{payload.IPKey{SrcIP: a, DstIP: b, SrcPort: 40000, DstPort: 8080}, 180},
+			{payload.IPKey{SrcIP: b, DstIP: a, SrcPort: 8080, DstPort: 40000}, 40},
+		},
+	}, {
+		pcap:    "fragments.pcap",
+		profile: captureProfiles["cgroup-skb"],
+		flows: []flow{
+			{payload.IPKey{SrcIP: a, DstIP: b, SrcPort: 4000, DstPort: 5000}, 1500},
+			{payload.IPKey{SrcIP: a, DstIP: b}, 520},
+		},
+	}} {
+		t.Run(tc.pcap+"/"+tc.profile.Name, func(t *testing.T) {
+			r := newTestReplayer(t, BPFOptions{Profile: tc.profile})
+
+			f, err := os.Open(filepath.Join("testdata", tc.pcap))
+			require.NoError(t, err)
+			defer f.Close()
+			_, err = r.ReplayPcap(f)
+			require.NoError(t, err)
+
+			keys, values, err := r.Flows()
+			require.NoError(t, err)
+			flows := make([]flow, 0, len(keys))
+			for i, key := range keys {
+				flows = append(flows, flow{key, values[i].PacketSize})
+			}
+			require.ElementsMatch(t, tc.flows, flows)
+		})
+	}
+}
@@ -0,0 +1,527 @@
+package agent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/polarsignals/kubezonnet/payload"
+)
+
+// Batch is the data of a single flush, after filtering and aggregation.
+type Batch struct {
+	// Node is the node the flows were captured on.
+	Node string
+	// Start is when the window of the batch started, the previous flush.
+	Start time.Time
+	// Time is when the flows were collected, the end of the window.
+	Time time.Time
+	// InstanceID identifies the agent process, it changes on restarts.
+	InstanceID string
+	// Sequence numbers the batches of the agent process starting at 1.
+	Sequence uint64
+	// AgentVersion is the version of the agent.
+	AgentVersion string
+	// CaptureMode describes how the flows were captured, if known.
+	CaptureMode string
+	// Aggregation is the aggregation mode the ports were collapsed with.
+	Aggregation string
+	// SampleRate is N if 1 in N packets was captured, in which case the
+	// packet sizes are estimates. 0 if all packets were captured.
+	SampleRate uint32
+	// Interfaces maps the interface indexes of keys to interface names.
+	// Nil if the interface dimension is disabled, in which case the
+	// interfaces of keys are 0.
+	Interfaces map[uint32]string
+	Keys       []payload.IPKey
+	Values     []payload.IPValue
+}
+
+// interfaceName returns the name of the interface with the given index, or
+// "if<index>" if it couldn't be resolved. Empty if names is nil, as the
+// interface dimension is disabled.
+func interfaceName(names map[uint32]string, ifindex uint32) string {
+	if names == nil || ifindex == 0 {
+		return ""
+	}
+	if name, found := names[ifindex]; found {
+		return name
+	}
+	return "if" + strconv.FormatUint(uint64(ifindex), 10)
+}
+
+// Sink receives the batch of every flush that contains data. Sinks must not
+// retain the batch after Write returns.
+type Sink interface {
+	Write(ctx context.Context, batch Batch) error
+}
+
+// HTTPSink sends batches to kubezonnet servers. Once the agent registered,
+// servers that support registration choose the payload version and
+// compression, and the central configuration of the first server is followed.
+type HTTPSink struct {
+	configs chan serverConfig
+
+	mtx     sync.RWMutex
+	servers []string
+	client  *http.Client
+	version int
+	// registration announces the agent to servers, nil until the agent
+	// registered.
+	registration *payload.Registration
+	// formats are the payload formats of the servers that were registered
+	// with.
+	formats map[string]payloadFormat
+	// revision is the revision of the central configuration that was last
+	// sent to the config updates.
+	revision string
+}
+
+// payloadFormat is how payloads sent to a server are encoded.
+type payloadFormat struct {
+	version     int
+	compression string
+}
+
+// NewHTTPSink returns a sink that sends batches to all of the servers,
+// encoded with the given payload version unless a server asks for another.
+func NewHTTPSink(servers []string, tlsConfig TLSConfig, payloadVersion int) (*HTTPSink, error) {
+	s := &HTTPSink{configs: make(chan serverConfig, 1)}
+	if err := s.Update(servers, tlsConfig, payloadVersion); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Update changes the servers batches are sent to and the payload version.
+// Servers are registered with again before the next write. On error the
+// previous settings are kept.
+func (s *HTTPSink) Update(servers []string, tlsConfig TLSConfig, payloadVersion int) error {
+	client, err := tlsConfig.httpClient()
+	if err != nil {
+		return fmt.Errorf("configure tls: %w", err)
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.servers = servers
+	s.client = client
+	s.version = payloadVersion
+	s.formats = map[string]payloadFormat{}
+	return nil
+}
+
+// register announces the agent to all servers and applies their settings.
+// Servers that fail to register are registered with again before the next
+// write. Changes of the central configuration are followed until ctx is done.
+func (s *HTTPSink) register(ctx context.Context, registration payload.Registration) {
+	s.mtx.Lock()
+	s.registration = &registration
+	servers, client := s.servers, s.client
+	s.mtx.Unlock()
+
+	for _, server := range servers {
+		s.format(ctx, client, server)
+	}
+	go s.watchConfig(ctx)
+}
+
+// configUpdates returns the central configurations of the servers, only the
+// latest one is kept until it is received.
+func (s *HTTPSink) configUpdates() <-chan serverConfig {
+	return s.configs
+}
+
+// errRegistrationUnsupported is returned by servers that predate
+// registration.
+var errRegistrationUnsupported = errors.New("server doesn't support registration")
+
+// format returns the payload format for server, registering with it first if
+// the agent registered but the server wasn't registered with yet. Without
+// registration the configured payload version is used.
+func (s *HTTPSink) format(ctx context.Context, client *http.Client, server string) payloadFormat {
+	s.mtx.RLock()
+	format, found := s.formats[server]
+	registration, version := s.registration, s.version
+	s.mtx.RUnlock()
+	if found {
+		return format
+	}
+	format = payloadFormat{version: version}
+	if registration == nil {
+		return format
+	}
+
+	res, err := registerWithServer(ctx, client, server, *registration)
+	switch {
+	case errors.Is(err, errRegistrationUnsupported):
+		log.Printf("%s doesn't support registration, using payload version %d", server, version)
+	case err != nil:
+		log.Printf("registering with %s failed, using payload version %d: %v", server, version, err)
+		return format
+	default:
+		if slices.Contains(payload.Versions, res.PayloadVersion) {
+			format.version = res.PayloadVersion
+		}
+		if res.Compression == payload.CompressionGzip {
+			format.compression = res.Compression
+		}
+		log.Printf("registered with %s, using payload version %d and compression %q", server, format.version, format.compression)
+		if res.Config != nil {
+			s.setConfig(server, *res.Config)
+		}
+	}
+
+	s.mtx.Lock()
+	s.formats[server] = format
+	s.mtx.Unlock()
+	return format
+}
+
+// setConfig sends the central configuration of server to the config updates,
+// if server is the first server and the revision changed.
+func (s *HTTPSink) setConfig(server string, config payload.AgentConfig) {
+	converted, err := fromAgentConfig(config)
+	if err != nil {
+		log.Printf("ignoring invalid configuration of %s: %v", server, err)
+		return
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if len(s.servers) == 0 || s.servers[0] != server || config.Revision == s.revision {
+		return
+	}
+	s.revision = config.Revision
+	sendLatest(s.configs, converted)
+}
+
+// watchConfig long-polls the central configuration of the first server until
+// ctx is done. Failed requests, and servers without a central configuration,
+// are tried again after configRetryInterval.
+func (s *HTTPSink) watchConfig(ctx context.Context) {
+	for {
+		s.mtx.RLock()
+		servers, client, revision := s.servers, s.client, s.revision
+		s.mtx.RUnlock()
+
+		var err error
+		if len(servers) > 0 {
+			var config payload.AgentConfig
+			config, err = fetchConfig(ctx, client, servers[0], revision)
+			switch {
+			case err == nil:
+				s.setConfig(servers[0], config)
+				continue
+			case errors.Is(err, errConfigNotModified):
+				continue
+			case errors.Is(err, errRegistrationUnsupported), ctx.Err() != nil:
+			default:
+				log.Printf("fetching the configuration of %s failed: %v", servers[0], err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(configRetryInterval):
+		}
+	}
+}
+
+// fromAgentConfig converts a central configuration to the settings of the
+// agent.
+func fromAgentConfig(config payload.AgentConfig) (serverConfig, error) {
+	res := serverConfig{
+		Revision:     config.Revision,
+		SubnetCIDRs:  config.SubnetCIDRs,
+		ExcludeCIDRs: config.ExcludeCIDRs,
+		Aggregation:  config.Aggregation,
+		SampleRate:   config.SampleRate,
+	}
+	if config.FlushInterval != "" {
+		interval, err := time.ParseDuration(config.FlushInterval)
+		if err != nil || interval <= 0 {
+			return serverConfig{}, fmt.Errorf("invalid flush interval %q", config.FlushInterval)
+		}
+		res.FlushInterval = interval
+	}
+	return res, nil
+}
+
+func (s *HTTPSink) Write(ctx context.Context, batch Batch) error {
+	s.mtx.RLock()
+	servers, client := s.servers, s.client
+	s.mtx.RUnlock()
+	if len(servers) == 0 {
+		return nil
+	}
+
+	log.Println("sending data to the server")
+	encoded := map[payloadFormat][]byte{}
+	var errs []error
+	for _, server := range servers {
+		format := s.format(ctx, client, server)
+		if format.version < payload.Version2 && (batch.SampleRate > 1 || batch.Interfaces != nil) {
+			// The legacy encoding would leave them out.
+			errs = append(errs, fmt.Errorf("%s: payload version %d can't carry the sample rate or interfaces, version %d or later is required", server, format.version, payload.Version2))
+			continue
+		}
+		content, found := encoded[format]
+		if !found {
+			var err error
+			content, err = encodeBatch(batch, format)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", server, err))
+				continue
+			}
+			encoded[format] = content
+		}
+		// Servers only deduplicate numbered payloads, which the legacy
+		// encoding can't carry.
+		retry := format.version >= payload.Version2 && batch.Sequence != 0
+		if err := sendWithRetries(ctx, client, server, batch.Aggregation, format.compression, content, retry); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", server, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// encodeBatch encodes batch in the given format.
+func encodeBatch(batch Batch, format payloadFormat) ([]byte, error) {
+	content := payload.EncodeWithOptions(batch.Keys, batch.Values, payload.Options{
+		SampleRate: batch.SampleRate,
+		Interfaces: batch.Interfaces,
+		Version:    format.version,
+		Metadata: &payload.Metadata{
+			Node:         batch.Node,
+			AgentVersion: batch.AgentVersion,
+			CaptureMode:  batch.CaptureMode,
+			WindowStart:  batch.Start,
+			WindowEnd:    batch.Time,
+			InstanceID:   batch.InstanceID,
+			Sequence:     batch.Sequence,
+		},
+	})
+	if format.compression != payload.CompressionGzip {
+		return content, nil
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(content); err != nil {
+		return nil, fmt.Errorf("compress payload: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return nil, fmt.Errorf("compress payload: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// registerWithServer registers the agent with server, at
+// payload.RegistrationPath relative to its URL, and returns the settings the
+// server asks for.
+func registerWithServer(ctx context.Context, client *http.Client, server string, registration payload.Registration) (payload.RegistrationResponse, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return payload.RegistrationResponse{}, fmt.Errorf("parse server URL: %w", err)
+	}
+	body, err := json.Marshal(registration)
+	if err != nil {
+		return payload.RegistrationResponse{}, fmt.Errorf("marshal registration: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, registrationTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", u.ResolveReference(&url.URL{Path: payload.RegistrationPath}).String(), bytes.NewReader(body))
+	if err != nil {
+		return payload.RegistrationResponse{}, fmt.Errorf("new request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return payload.RegistrationResponse{}, fmt.Errorf("do request: %w", err)
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return payload.RegistrationResponse{}, errRegistrationUnsupported
+	default:
+		respContent, _ := io.ReadAll(res.Body)
+		return payload.RegistrationResponse{}, fmt.Errorf("registration not successful: %s", respContent)
+	}
+
+	var settings payload.RegistrationResponse
+	if err := json.NewDecoder(res.Body).Decode(&settings); err != nil {
+		return payload.RegistrationResponse{}, fmt.Errorf("decode response: %w", err)
+	}
+	return settings, nil
+}
+
+// registrationTimeout bounds registering with a server, so that an
+// unreachable server doesn't hold up the agent.
+const registrationTimeout = 5 * time.Second
+
+// errConfigNotModified is returned if the central configuration didn't change
+// while it was polled.
+var errConfigNotModified = errors.New("configuration not modified")
+
+// fetchConfig returns the central configuration of server, at
+// payload.ConfigPath relative to its URL. If revision is set, the server waits
+// for the configuration to change from it. Servers without a central
+// configuration return errRegistrationUnsupported.
+func fetchConfig(ctx context.Context, client *http.Client, server, revision string) (payload.AgentConfig, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return payload.AgentConfig{}, fmt.Errorf("parse server URL: %w", err)
+	}
+	ref := &url.URL{Path: payload.ConfigPath}
+	if revision != "" {
+		ref.RawQuery = url.Values{"revision": {revision}}.Encode()
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, configPollTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", u.ResolveReference(ref).String(), nil)
+	if err != nil {
+		return payload.AgentConfig{}, fmt.Errorf("new request: %w", err)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return payload.AgentConfig{}, fmt.Errorf("do request: %w", err)
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return payload.AgentConfig{}, errConfigNotModified
+	case http.StatusNotFound:
+		return payload.AgentConfig{}, errRegistrationUnsupported
+	default:
+		respContent, _ := io.ReadAll(res.Body)
+		return payload.AgentConfig{}, fmt.Errorf("fetching configuration not successful: %s", respContent)
+	}
+
+	var config payload.AgentConfig
+	if err := json.NewDecoder(res.Body).Decode(&config); err != nil {
+		return payload.AgentConfig{}, fmt.Errorf("decode response: %w", err)
+	}
+	return config, nil
+}
+
+// configPollTimeout bounds polling the central configuration, longer than
+// servers wait for it to change.
+const configPollTimeout = time.Minute
+
+// configRetryInterval is how long to wait before polling the central
+// configuration again after a failure.
+var configRetryInterval = 10 * time.Second
+
+// sendAttempts is how often a payload is sent to a server failing with a
+// transient error, waiting sendRetryBackoff times the attempt in between.
+const sendAttempts = 3
+
+var sendRetryBackoff = time.Second
+
+// sendTimeout bounds every attempt of sending a payload, so that a server
+// that stops responding doesn't hold up flushing the source.
+var sendTimeout = 10 * time.Second
+
+// sendWithRetries sends content to server, retrying transient errors if
+// retry is set. Only payloads that servers deduplicate may be retried, as a
+// request that timed out may still have been processed.
+func sendWithRetries(ctx context.Context, client *http.Client, server, aggregation, compression string, content []byte, retry bool) error {
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, sendTimeout)
+		err := sendDataToServer(attemptCtx, client, server, aggregation, compression, content)
+		cancel()
+		var statusErr *writeError
+		if err == nil || !retry || attempt == sendAttempts || errors.As(err, &statusErr) && statusErr.status < 500 {
+			return err
+		}
+		log.Printf("sending data to %s failed, retrying: %v", server, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(time.Duration(attempt) * sendRetryBackoff):
+		}
+	}
+}
+
+// writeError is returned if a server didn't accept a payload.
+type writeError struct {
+	status  int
+	message string
+}
+
+func (e *writeError) Error() string {
+	return "write not successful: " + e.message
+}
+
+func sendDataToServer(ctx context.Context, client *http.Client, server, aggregation, compression string, content []byte) error {
+	req, err := http.NewRequest("POST", server, bytes.NewReader(content))
+	if err != nil {
+		return fmt.Errorf("new request: %w", err)
+	}
+	if aggregation != "" {
+		req.Header.Set(payload.AggregationHeader, aggregation)
+	}
+	if compression != "" {
+		req.Header.Set("Content-Encoding", compression)
+	}
+
+	req = req.WithContext(ctx)
+
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("do request: %w", err)
+	}
+	defer res.Body.Close()
+
+	respContent, err := io.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("read response: %w", err)
+	}
+
+	if res.StatusCode != 200 {
+		return &writeError{status: res.StatusCode, message: string(respContent)}
+	}
+
+	return nil
+}
+
+// debugSink prints a line per flow, only intended for debugging.
+type debugSink struct {
+	w io.Writer
+}
+
+func (s debugSink) Write(_ context.Context, batch Batch) error {
+	for i, key := range batch.Keys {
+		if _, err := fmt.Fprintf(s.w, "%s:%d -> %s:%d: %d bytes\n", formatIP(key.SrcIP), key.SrcPort, formatIP(key.DstIP), key.DstPort, batch.Values[i].PacketSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatIP formats an IPv4 address in network byte order, as found in keys.
+func formatIP(ip uint32) string {
+	return net.IPv4(byte(ip), byte(ip>>8), byte(ip>>16), byte(ip>>24)).String()
+}
@@ -0,0 +1,242 @@
+package agent
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/polarsignals/kubezonnet/byteorder"
+	"github.com/polarsignals/kubezonnet/payload"
+)
+
+func TestHTTPSinkRetries(t *testing.T) {
+	sendRetryBackoff = time.Millisecond
+	defer func() { sendRetryBackoff = time.Second }()
+
+	var mtx sync.Mutex
+	var received []payload.Payload
+	status := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		p, err := payload.DecodePayload(body)
+		require.NoError(t, err)
+
+		mtx.Lock()
+		defer mtx.Unlock()
+		received = append(received, p)
+		// Fails the first attempt of every batch.
+		if len(received)%2 == 1 {
+			http.Error(w, "unavailable", status)
+		}
+	}))
+	defer server.Close()
+
+	batch := Batch{
+		Node:       "node-a",
+		Time:       time.Now(),
+		InstanceID: "instance",
+		Sequence:   7,
+		Keys:       []payload.IPKey{{SrcIP: byteorder.Htonl(1), DstIP: byteorder.Htonl(2)}},
+		Values:     []payload.IPValue{{PacketSize: 10}},
+	}
+
+	sink, err := NewHTTPSink([]string{server.URL}, TLSConfig{}, payload.Version2)
+	require.NoError(t, err)
+	require.NoError(t, sink.Write(context.Background(), batch))
+	require.Len(t, received, 2)
+	// Retries keep the sequence number for the server to deduplicate them.
+	require.Equal(t, received[0].Metadata, received[1].Metadata)
+	require.Equal(t, uint64(7), received[1].Metadata.Sequence)
+
+	// Payloads are rejected for good by client errors.
+	status = http.StatusBadRequest
+	require.Error(t, sink.Write(context.Background(), batch))
+	require.Len(t, received, 3)
+
+	// Legacy payloads aren't deduplicated, so they aren't retried.
+	status = http.StatusServiceUnavailable
+	received = received[:2]
+	require.NoError(t, sink.Update([]string{server.URL}, TLSConfig{}, payload.VersionLegacy))
+	require.Error(t, sink.Write(context.Background(), batch))
+	require.Len(t, received, 3)
+
+	// Nor can they carry the sample rate, so such batches aren't sent.
+	batch.SampleRate = 4
+	require.Error(t, sink.Write(context.Background(), batch))
+	require.Len(t, received, 3)
+}
+
+func TestHTTPSinkTimeout(t *testing.T) {
+	sendRetryBackoff, sendTimeout = time.Millisecond, 100*time.Millisecond
+	defer func() { sendRetryBackoff, sendTimeout = time.Second, 10*time.Second }()
+
+	var mtx sync.Mutex
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		mtx.Lock()
+		attempts++
+		stall := attempts == 1
+		mtx.Unlock()
+		// Stalls the first attempt until the agent gives up on it.
+		if stall {
+			<-r.Context().Done()
+		}
+	}))
+	defer server.Close()
+
+	batch := Batch{
+		Node:       "node-a",
+		InstanceID: "instance",
+		Sequence:   1,
+		Keys:       []payload.IPKey{{SrcIP: byteorder.Htonl(1), DstIP: byteorder.Htonl(2)}},
+		Values:     []payload.IPValue{{PacketSize: 10}},
+	}
+	sink, err := NewHTTPSink([]string{server.URL}, TLSConfig{}, payload.Version2)
+	require.NoError(t, err)
+	require.NoError(t, sink.Write(context.Background(), batch))
+	mtx.Lock()
+	defer mtx.Unlock()
+	require.Equal(t, 2, attempts)
+}
+
+func TestHTTPSinkRegistration(t *testing.T) {
+	var mtx sync.Mutex
+	var registrations []payload.Registration
+	var received []payload.Payload
+	var encodings []string
+	var versions []int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/kubezonnet/register", func(w http.ResponseWriter, r *http.Request) {
+		var reg payload.Registration
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&reg))
+		mtx.Lock()
+		registrations = append(registrations, reg)
+		mtx.Unlock()
+		require.NoError(t, json.NewEncoder(w).Encode(payload.RegistrationResponse{
+			PayloadVersion: payload.Version3,
+			Compression:    payload.CompressionGzip,
+			Config:         &payload.AgentConfig{Revision: "a", FlushInterval: "30s"},
+		}))
+	})
+	write := func(w http.ResponseWriter, r *http.Request) {
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			require.NoError(t, err)
+			body = gz
+		}
+		content, err := io.ReadAll(body)
+		require.NoError(t, err)
+		p, err := payload.DecodePayload(content)
+		require.NoError(t, err)
+
+		mtx.Lock()
+		defer mtx.Unlock()
+		received = append(received, p)
+		encodings = append(encodings, r.Header.Get("Content-Encoding"))
+		versions = append(versions, int(binary.BigEndian.Uint16(content[4:6])))
+	}
+	mux.HandleFunc("/kubezonnet/write-network-statistics", write)
+	// Servers that predate registration only serve payloads.
+	mux.HandleFunc("/old/write-network-statistics", write)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	batch := Batch{
+		Node:       "node-a",
+		InstanceID: "instance",
+		Sequence:   1,
+		Keys:       []payload.IPKey{{SrcIP: byteorder.Htonl(1), DstIP: byteorder.Htonl(2)}},
+		Values:     []payload.IPValue{{PacketSize: 10}},
+	}
+	servers := []string{server.URL + "/kubezonnet/write-network-statistics", server.URL + "/old/write-network-statistics"}
+	sink, err := NewHTTPSink(servers, TLSConfig{}, payload.Version2)
+	require.NoError(t, err)
+
+	// Without registering, the configured version is used.
+	require.NoError(t, sink.Write(context.Background(), batch))
+	require.Empty(t, registrations)
+	require.Equal(t, []string{"", ""}, encodings)
+	require.Equal(t, []int{payload.Version2, payload.Version2}, versions)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reg := payload.Registration{Node: "node-a", InstanceID: "instance", PayloadVersions: payload.Versions}
+	sink.register(ctx, reg)
+	mtx.Lock()
+	require.Equal(t, []payload.Registration{reg}, registrations)
+	mtx.Unlock()
+	require.Equal(t, serverConfig{Revision: "a", FlushInterval: 30 * time.Second}, <-sink.configUpdates())
+
+	received, encodings, versions = nil, nil, nil
+	require.NoError(t, sink.Write(context.Background(), batch))
+	require.Equal(t, []string{"gzip", ""}, encodings)
+	require.Equal(t, []int{payload.Version3, payload.Version2}, versions)
+	require.Equal(t, received[0], received[1])
+	require.Len(t, registrations, 1)
+
+	// Servers are registered with again after an update.
+	require.NoError(t, sink.Update(servers, TLSConfig{}, payload.Version2))
+	require.NoError(t, sink.Write(context.Background(), batch))
+	require.Len(t, registrations, 2)
+}
+
+func TestHTTPSinkWatchConfig(t *testing.T) {
+	var mtx sync.Mutex
+	config := payload.AgentConfig{Revision: "a", SampleRate: 2}
+	changed := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/register", func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		require.NoError(t, json.NewEncoder(w).Encode(payload.RegistrationResponse{Config: &config}))
+	})
+	mux.HandleFunc("/agent-config", func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		current, wait := config, changed
+		mtx.Unlock()
+		if r.URL.Query().Get("revision") == current.Revision {
+			select {
+			case <-wait:
+			case <-r.Context().Done():
+			}
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		require.NoError(t, json.NewEncoder(w).Encode(current))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	sink, err := NewHTTPSink([]string{server.URL + "/write-network-statistics"}, TLSConfig{}, payload.Version2)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sink.register(ctx, payload.Registration{Node: "node-a", InstanceID: "instance"})
+	require.Equal(t, serverConfig{Revision: "a", SampleRate: 2}, <-sink.configUpdates())
+
+	// Changes are picked up by the pending poll.
+	mtx.Lock()
+	config = payload.AgentConfig{Revision: "b", ExcludeCIDRs: []string{"10.1.0.0/16"}, FlushInterval: "1m"}
+	close(changed)
+	changed = make(chan struct{})
+	mtx.Unlock()
+	select {
+	case update := <-sink.configUpdates():
+		require.Equal(t, serverConfig{Revision: "b", ExcludeCIDRs: []string{"10.1.0.0/16"}, FlushInterval: time.Minute}, update)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no config update received")
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/polarsignals/kubezonnet/agent"
+)
+
+// runCheck runs the preflight checks of the check subcommand, printing a
+// report and returning the exit code: 1 if any check failed.
+func runCheck(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	cniConfDir := fs.String("cni-conf-dir", agent.DefaultCNIConfDir, "The directory of the node's CNI network configuration")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: kubezonnet-agent check [flags]")
+		fmt.Fprintln(fs.Output(), "\nVerifies that the node supports running the agent.")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	results := agent.RunChecks(context.Background(), agent.CheckOptions{
+		CNIConfDir: *cniConfDir,
+	})
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, result := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", result.Status, result.Name, result.Detail)
+	}
+	tw.Flush()
+
+	if agent.ChecksFailed(results) {
+		fmt.Println("\nThe agent can't capture traffic on this node.")
+		return 1
+	}
+	return 0
+}
@@ -1,49 +1,191 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
 	"github.com/polarsignals/kubezonnet/agent"
+	"github.com/polarsignals/kubezonnet/payload"
 )
 
+// version is set at build time.
+var version = "dev"
+
 func main() {
-	subnetCidr := flag.String("subnet-cidr", "10.0.0.0/24", "Specify the subnet in CIDR notation (default: 10.0.0.0/24)")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "check":
+			os.Exit(runCheck(os.Args[2:]))
+		case "replay":
+			os.Exit(runReplay(os.Args[2:]))
+		case "unpin":
+			os.Exit(runUnpin(os.Args[2:]))
+		}
+	}
+
+	subnetCidr := flag.String("subnet-cidr", "10.0.0.0/24", "Specify the subnet in CIDR notation, multiple subnets can be separated by commas (default: 10.0.0.0/24)")
 	flushInterval := flag.Duration("flush-interval", 10*time.Second, "The interval at which data is sent to the server")
-	server := flag.String("server", "", "The server to send statistics to")
-	send := flag.Bool("send-data", true, "Whether to enable sending data to the server, only really useful when used with debugging")
+	cidrDiscovery := flag.String("cidr-discovery", "", "Discover the CIDRs to monitor from the cluster, one of \"nodes\" (Node pod CIDRs), \"cilium\" (CiliumNode IPAM) or \"pods\" (all pod IPs, every agent watches all pods in the cluster)")
+	aggregation := flag.String("aggregation", "full", "How to aggregate ports before sending data, one of \"full\" (keep both ports), \"server-port\" (collapse the client's ephemeral port) or \"ip-pair\" (collapse both ports)")
+	server := flag.String("server", "", "The server to send statistics to, grpc:// and grpcs:// URLs stream them over gRPC")
+	configFile := flag.String("config", "", "Path to a YAML or JSON config file, settings in the file take precedence over flags and changes are applied without restarting")
+	send := flag.Bool("send-data", true, "Whether to enable sending data to the server, only really useful when used with debugging. The debug and -output-* outputs are written regardless")
+	payloadVersion := flag.Int("payload-version", payload.VersionLegacy, "The version of the encoding of data sent to servers that don't choose one when the agent registers, 2 and 3 require servers that support them")
+	interfaceDimension := flag.Bool("interface-dimension", false, "Send the interface traffic left the node on, requires a server that supports it and -payload-version=2 or later for HTTP servers")
 	debug := flag.Bool("debug", false, "Turns on extra debugging features, not recommended for production")
+	outputStdout := flag.Bool("output-stdout", false, "Write flows as newline-delimited JSON to stdout")
+	outputFile := flag.String("output-file", "", "Write flows as newline-delimited JSON to this file, for example on a hostPath volume")
+	outputFileMaxSize := flag.Int64("output-file-max-size", 100*1024*1024, "The size in bytes at which the output file is rotated")
+	outputFileMaxFiles := flag.Int("output-file-max-files", 5, "The number of rotated output files to keep")
+	outputSocket := flag.String("output-socket", "", "Stream flows as newline-delimited JSON to clients of a Unix socket at this path")
+	highWaterMark := flag.Float64("map-high-water-mark", 0.8, "Flush early when the fraction of the flow map in use crosses this value, 0 to disable")
+	sampleRate := flag.Uint("sample-rate", 1, "Only capture 1 in N packets and estimate the traffic from the sample, reduces overhead at very high packet rates. Rates above 1 require -payload-version=2 or later for HTTP servers")
+	captureProfile := flag.String("capture-profile", agent.CaptureProfileAuto, "How traffic is captured, \"auto\" detects it from the node's CNI, or one of "+strings.Join(agent.CaptureProfileNames(), ", "))
+	cniConfDir := flag.String("cni-conf-dir", agent.DefaultCNIConfDir, "The directory of the node's CNI network configuration, used to detect the capture profile")
+	bpfPinPath := flag.String("bpf-pin-path", "", "Pin the eBPF maps and link in this bpffs directory (e.g. "+agent.DefaultPinPath+"), so that a restarted agent keeps capturing and adopts the counters, empty to disable")
+	cgroupPath := flag.String("cgroup-path", agent.DefaultCgroupPath, "The cgroup v2 hierarchy to attach to when falling back to cgroup_skb capture on kernels older than 6.4")
+	podSource := flag.String("pod-source", agent.PodSourceAPIServer, "Where to read the pods on the node from, \"apiserver\" (watch the API server) or \"kubelet\" (poll the node's kubelet, requires get on nodes/proxy)")
+	kubeletURL := flag.String("kubelet-url", agent.DefaultKubeletURL, "The URL of the kubelet's API, used with -pod-source=kubelet")
+	kubeletInsecure := flag.Bool("kubelet-insecure-skip-tls-verify", false, "Don't verify the kubelet's serving certificate, for kubelets with self-signed certificates")
+	kubeletPollInterval := flag.Duration("kubelet-poll-interval", 10*time.Second, "The interval at which pods are read from the kubelet")
+	httpAddress := flag.String("http-address", "localhost:7475", "The address to serve the /debug/flows endpoint on, empty to disable. The endpoint exposes the node's flows without authentication, so only listen on other interfaces where the network is trusted")
+	metricsAddress := flag.String("metrics-address", ":7476", "The address to serve metrics on, empty to disable. May be the same as -http-address")
 	node := flag.String("node", "", "The Kubernetes node name of the node the agent is running on")
 	flag.Parse()
 
-	if *subnetCidr == "" {
-		fmt.Println("Error: subnet CIDR cannot be empty")
+	if *node == "" {
+		fmt.Println("Error: node name must not be empty")
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	if *flushInterval <= 0 {
-		fmt.Println("Error: flush interval must be greater than zero")
-		flag.Usage()
-		os.Exit(1)
+	subnetCidrSet := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "subnet-cidr" {
+			subnetCidrSet = true
+		}
+	})
+
+	config := agent.Config{
+		CIDRDiscovery:      *cidrDiscovery,
+		Aggregation:        *aggregation,
+		InterfaceDimension: *interfaceDimension,
+		PayloadVersion:     *payloadVersion,
+		FlushInterval:      agent.Duration{Duration: *flushInterval},
+	}
+	// The default subnet is only a fallback when CIDRs aren't discovered.
+	if *subnetCidr != "" && (subnetCidrSet || *cidrDiscovery == "") {
+		config.SubnetCIDRs = strings.Split(*subnetCidr, ",")
+	}
+	if *server != "" {
+		config.Servers = []string{*server}
 	}
 
-	if *server == "" {
-		fmt.Println("Error: server must not be empty")
-		flag.Usage()
-		os.Exit(1)
+	// With a config file the flags only act as defaults, so the file is
+	// validated by the agent once loaded.
+	if *configFile == "" {
+		if err := config.Validate(); err != nil {
+			fmt.Println("Error:", err)
+			flag.Usage()
+			os.Exit(1)
+		}
 	}
 
-	if *node == "" {
-		fmt.Println("Error: node name must not be empty")
-		flag.Usage()
-		os.Exit(1)
+	var sinks []agent.Sink
+	if *outputStdout {
+		sinks = append(sinks, agent.NewJSONSink(os.Stdout))
+	}
+	if *outputFile != "" {
+		fileSink, err := agent.NewRotatingFileSink(*outputFile, *outputFileMaxSize, *outputFileMaxFiles)
+		if err != nil {
+			log.Fatal("error: ", err)
+		}
+		defer fileSink.Close()
+		sinks = append(sinks, fileSink)
 	}
+	if *outputSocket != "" {
+		socketSink, err := agent.NewSocketSink(*outputSocket)
+		if err != nil {
+			log.Fatal("error: ", err)
+		}
+		defer socketSink.Close()
+		sinks = append(sinks, socketSink)
+	}
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	a, err := agent.New(agent.Options{
+		Node:       *node,
+		Version:    version,
+		Config:     config,
+		ConfigFile: *configFile,
+		SendData:   *send,
+		Debug:      *debug,
+		Sinks:      sinks,
+		Registerer: reg,
+
+		PodSource: *podSource,
+		Kubelet: agent.KubeletOptions{
+			URL:                *kubeletURL,
+			InsecureSkipVerify: *kubeletInsecure,
+			PollInterval:       *kubeletPollInterval,
+		},
+
+		CaptureProfile: *captureProfile,
+		CNIConfDir:     *cniConfDir,
+		BPF: agent.BPFOptions{
+			HighWaterMark: *highWaterMark,
+			SampleRate:    uint32(*sampleRate),
+			PinPath:       *bpfPinPath,
+			CgroupPath:    *cgroupPath,
+		},
+	})
+	if err != nil {
+		log.Fatal("error: ", err)
+	}
+
+	servers := map[string]*http.ServeMux{}
+	mux := func(address string) *http.ServeMux {
+		if servers[address] == nil {
+			servers[address] = http.NewServeMux()
+		}
+		return servers[address]
+	}
+	if *metricsAddress != "" {
+		mux(*metricsAddress).Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	}
+	if *httpAddress != "" {
+		mux(*httpAddress).Handle("/debug/flows", a.DebugFlowsHandler())
+	}
+	for address, handler := range servers {
+		go func() {
+			log.Println("Serving HTTP endpoints on", address)
+			if err := http.ListenAndServe(address, handler); err != nil {
+				log.Fatalf("Failed to start HTTP server: %v", err)
+			}
+		}()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	if err := agent.Run(*node, *subnetCidr, *server, *flushInterval, *debug, *send); err != nil {
+	if err := a.Run(ctx); err != nil {
 		log.Fatal("error: ", err)
 	}
 }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/polarsignals/kubezonnet/agent"
+	"github.com/polarsignals/kubezonnet/payload"
+)
+
+// runReplay runs the packets of a pcap file through the eBPF program and
+// writes the resulting flows to stdout, returning the exit code.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	pcap := fs.String("pcap", "", "The pcap file to replay")
+	subnetCidr := fs.String("subnet-cidr", "10.0.0.0/8", "The CIDRs to monitor, separated by commas")
+	excludeCidr := fs.String("exclude-cidr", "", "The CIDRs to exclude, separated by commas")
+	captureProfile := fs.String("capture-profile", "default", "The capture profile to replay with, one of "+strings.Join(agent.CaptureProfileNames(), ", "))
+	output := fs.String("output", "json", "The output format, \"json\" (newline-delimited flows) or \"payload\" (the binary payload sent to servers)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: kubezonnet-agent replay -pcap <file> [flags]")
+		fmt.Fprintln(fs.Output(), "\nRuns the packets of a pcap file through the eBPF program and prints the recorded flows.")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if err := replay(*pcap, *subnetCidr, *excludeCidr, *captureProfile, *output); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	return 0
+}
+
+func replay(pcap, subnetCidr, excludeCidr, captureProfile, output string) error {
+	if pcap == "" {
+		return fmt.Errorf("no pcap file given")
+	}
+	if output != "json" && output != "payload" {
+		return fmt.Errorf("unknown output format %q", output)
+	}
+	profile, err := agent.LookupCaptureProfile(captureProfile)
+	if err != nil {
+		return err
+	}
+	subnets, err := splitCIDRs(subnetCidr)
+	if err != nil {
+		return err
+	}
+	excludes, err := splitCIDRs(excludeCidr)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(pcap)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := agent.NewReplayer(agent.BPFOptions{Profile: profile})
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if err := r.SetCIDRs(subnets, excludes); err != nil {
+		return err
+	}
+	n, err := r.ReplayPcap(f)
+	if err != nil {
+		return err
+	}
+	keys, values, err := r.Flows()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "replayed %d packets, recorded %d flows\n", n, len(keys))
+
+	if output == "payload" {
+		_, err := os.Stdout.Write(payload.Encode(keys, values))
+		return err
+	}
+	return agent.NewJSONSink(os.Stdout).Write(context.Background(), agent.Batch{
+		Node:   "replay",
+		Time:   time.Now(),
+		Keys:   keys,
+		Values: values,
+	})
+}
+
+// splitCIDRs parses a comma separated list of IPv4 CIDRs.
+func splitCIDRs(list string) ([]*net.IPNet, error) {
+	var cidrs []string
+	for _, cidr := range strings.Split(list, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr != "" {
+			cidrs = append(cidrs, cidr)
+		}
+	}
+	return agent.ParseCIDRs(cidrs)
+}
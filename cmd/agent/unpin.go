@@ -0,0 +1,29 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/polarsignals/kubezonnet/agent"
+)
+
+// runUnpin removes the pinned eBPF objects of the unpin subcommand, returning
+// the exit code.
+func runUnpin(args []string) int {
+	fs := flag.NewFlagSet("unpin", flag.ExitOnError)
+	bpfPinPath := fs.String("bpf-pin-path", agent.DefaultPinPath, "The bpffs directory the agent pinned its eBPF maps and link in")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: kubezonnet-agent unpin [flags]")
+		fmt.Fprintln(fs.Output(), "\nRemoves the eBPF objects pinned by agents, detaching the program from the node once no agent uses it.")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if err := agent.Unpin(*bpfPinPath); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	fmt.Println("Unpinned", *bpfPinPath)
+	return 0
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/yaml"
+
+	"github.com/polarsignals/kubezonnet/payload"
+)
+
+// agentConfigKey is the key of the ConfigMap holding the agent configuration.
+const agentConfigKey = "config.yaml"
+
+// configPollTimeout is how long requests for the agent configuration wait for
+// it to change before they are answered with 304 Not Modified.
+var configPollTimeout = 30 * time.Second
+
+// agentConfigStore holds the configuration of all agents and notifies about
+// changes.
+type agentConfigStore struct {
+	// defaults are the settings of the flags, which the ConfigMap overrides.
+	defaults payload.AgentConfig
+
+	mtx    sync.Mutex
+	config payload.AgentConfig
+	// changed is closed when the configuration changes.
+	changed chan struct{}
+}
+
+func newAgentConfigStore(defaults payload.AgentConfig) *agentConfigStore {
+	return &agentConfigStore{
+		defaults: defaults,
+		config:   withRevision(defaults),
+		changed:  make(chan struct{}),
+	}
+}
+
+// get returns the current configuration and a channel that is closed once it
+// changes.
+func (c *agentConfigStore) get() (payload.AgentConfig, <-chan struct{}) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.config, c.changed
+}
+
+// set replaces the configuration with config on top of the defaults.
+func (c *agentConfigStore) set(config payload.AgentConfig) {
+	merged := c.defaults
+	if config.SubnetCIDRs != nil {
+		merged.SubnetCIDRs = config.SubnetCIDRs
+	}
+	if config.ExcludeCIDRs != nil {
+		merged.ExcludeCIDRs = config.ExcludeCIDRs
+	}
+	if config.Aggregation != "" {
+		merged.Aggregation = config.Aggregation
+	}
+	if config.SampleRate != 0 {
+		merged.SampleRate = config.SampleRate
+	}
+	if config.FlushInterval != "" {
+		merged.FlushInterval = config.FlushInterval
+	}
+	merged = withRevision(merged)
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if merged.Revision == c.config.Revision {
+		return
+	}
+	c.config = merged
+	close(c.changed)
+	c.changed = make(chan struct{})
+	log.Printf("Agent configuration changed to revision %s", merged.Revision)
+}
+
+// withRevision sets the revision of config to a hash of its settings, so that
+// it stays the same across server restarts.
+func withRevision(config payload.AgentConfig) payload.AgentConfig {
+	config.Revision = ""
+	// Marshalling a struct of strings and integers can't fail.
+	content, _ := json.Marshal(config)
+	sum := sha256.Sum256(content)
+	config.Revision = hex.EncodeToString(sum[:8])
+	return config
+}
+
+// parseAgentConfig parses and validates the agent configuration of the
+// ConfigMap.
+func parseAgentConfig(content string) (payload.AgentConfig, error) {
+	var config payload.AgentConfig
+	if err := yaml.UnmarshalStrict([]byte(content), &config); err != nil {
+		return payload.AgentConfig{}, fmt.Errorf("parse config: %w", err)
+	}
+	config.Revision = ""
+
+	for _, cidr := range slices.Concat(config.SubnetCIDRs, config.ExcludeCIDRs) {
+		if _, ipNet, err := net.ParseCIDR(cidr); err != nil || ipNet.IP.To4() == nil {
+			return payload.AgentConfig{}, fmt.Errorf("invalid IPv4 CIDR %q", cidr)
+		}
+	}
+	switch config.Aggregation {
+	case "", payload.AggregationFull, payload.AggregationServerPort, payload.AggregationIPPair:
+	default:
+		return payload.AgentConfig{}, fmt.Errorf("unknown aggregation mode %q", config.Aggregation)
+	}
+	if config.FlushInterval != "" {
+		interval, err := time.ParseDuration(config.FlushInterval)
+		if err != nil || interval <= 0 {
+			return payload.AgentConfig{}, fmt.Errorf("invalid flush interval %q", config.FlushInterval)
+		}
+	}
+	return config, nil
+}
+
+// handleAgentConfig serves the agent configuration, waiting for it to change
+// if the agent already has the current revision.
+func (s *Server) handleAgentConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	config, changed := s.agentConfig.get()
+	if revision := r.URL.Query().Get("revision"); revision != "" && revision == config.Revision {
+		timer := time.NewTimer(configPollTimeout)
+		defer timer.Stop()
+		select {
+		case <-changed:
+			config, _ = s.agentConfig.get()
+		case <-timer.C:
+			w.WriteHeader(http.StatusNotModified)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(config); err != nil {
+		log.Printf("Failed to write agent configuration: %v", err)
+	}
+}
+
+// watchAgentConfig keeps the agent configuration in sync with the ConfigMap
+// name in namespace. Invalid configurations are logged and ignored.
+func (s *Server) watchAgentConfig(namespace, name string) {
+	watchList := cache.NewListWatchFromClient(
+		s.clientset.CoreV1().RESTClient(),
+		"configmaps",
+		namespace,
+		fields.OneTermEqualSelector("metadata.name", name),
+	)
+	_, controller := cache.NewInformer(
+		watchList,
+		&v1.ConfigMap{},
+		0,
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: s.handleAgentConfigMap,
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				s.handleAgentConfigMap(newObj)
+			},
+			DeleteFunc: func(obj interface{}) {
+				log.Printf("Agent configuration %s/%s deleted, using the defaults", namespace, name)
+				s.agentConfig.set(payload.AgentConfig{})
+			},
+		},
+	)
+	controller.Run(make(chan struct{}))
+}
+
+func (s *Server) handleAgentConfigMap(obj interface{}) {
+	cm, ok := obj.(*v1.ConfigMap)
+	if !ok {
+		return
+	}
+	config, err := parseAgentConfig(cm.Data[agentConfigKey])
+	if err != nil {
+		log.Printf("Ignoring invalid agent configuration %s/%s: %v", cm.Namespace, cm.Name, err)
+		return
+	}
+	s.agentConfig.set(config)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/polarsignals/kubezonnet/payload"
+)
+
+func TestParseAgentConfig(t *testing.T) {
+	config, err := parseAgentConfig(`
+subnetCIDRs: ["10.0.0.0/8"]
+excludeCIDRs: ["10.1.0.0/16"]
+aggregation: server-port
+sampleRate: 8
+flushInterval: 30s
+`)
+	require.NoError(t, err)
+	require.Equal(t, payload.AgentConfig{
+		SubnetCIDRs:   []string{"10.0.0.0/8"},
+		ExcludeCIDRs:  []string{"10.1.0.0/16"},
+		Aggregation:   payload.AggregationServerPort,
+		SampleRate:    8,
+		FlushInterval: "30s",
+	}, config)
+
+	for _, content := range []string{
+		`subnetCIDRs: ["fd00::/8"]`,
+		`excludeCIDRs: ["10.0.0.0"]`,
+		`aggregation: none`,
+		`flushInterval: 0s`,
+		`flushInterval: soon`,
+		`servers: ["http://example.com"]`,
+	} {
+		_, err := parseAgentConfig(content)
+		require.Error(t, err, content)
+	}
+}
+
+func TestAgentConfigStore(t *testing.T) {
+	store := newAgentConfigStore(payload.AgentConfig{FlushInterval: "10s"})
+	defaults, changed := store.get()
+	require.Equal(t, "10s", defaults.FlushInterval)
+	require.NotEmpty(t, defaults.Revision)
+
+	// Settings of the ConfigMap override the defaults.
+	store.set(payload.AgentConfig{SampleRate: 4})
+	<-changed
+	config, changed := store.get()
+	require.Equal(t, payload.AgentConfig{Revision: config.Revision, SampleRate: 4, FlushInterval: "10s"}, config)
+	require.NotEqual(t, defaults.Revision, config.Revision)
+
+	// Setting the same configuration isn't a change.
+	store.set(payload.AgentConfig{SampleRate: 4})
+	select {
+	case <-changed:
+		t.Fatal("unexpected change")
+	default:
+	}
+
+	// Revisions only depend on the settings.
+	require.Equal(t, config.Revision, withRevision(payload.AgentConfig{SampleRate: 4, FlushInterval: "10s"}).Revision)
+
+	store.set(payload.AgentConfig{})
+	<-changed
+	config, _ = store.get()
+	require.Equal(t, defaults, config)
+}
+
+func TestHandleAgentConfig(t *testing.T) {
+	configPollTimeout = 50 * time.Millisecond
+	defer func() { configPollTimeout = 30 * time.Second }()
+
+	s := newTestServer()
+	get := func(revision string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.handleAgentConfig(rec, httptest.NewRequest(http.MethodGet, "/agent-config?revision="+revision, nil))
+		return rec
+	}
+	decode := func(rec *httptest.ResponseRecorder) payload.AgentConfig {
+		require.Equal(t, http.StatusOK, rec.Code)
+		var config payload.AgentConfig
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&config))
+		return config
+	}
+
+	// Agents without the current revision get it right away.
+	config := decode(get(""))
+	require.Equal(t, config, decode(get("outdated")))
+
+	// Agents with the current revision wait for a change.
+	require.Equal(t, http.StatusNotModified, get(config.Revision).Code)
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		configPollTimeout = 10 * time.Second
+		done <- get(config.Revision)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	s.handleAgentConfigMap(&v1.ConfigMap{Data: map[string]string{agentConfigKey: "aggregation: ip-pair"}})
+	changed := decode(<-done)
+	require.Equal(t, payload.AggregationIPPair, changed.Aggregation)
+	require.NotEqual(t, config.Revision, changed.Revision)
+
+	// Invalid configurations are ignored.
+	s.handleAgentConfigMap(&v1.ConfigMap{Data: map[string]string{agentConfigKey: "aggregation: none"}})
+	require.Equal(t, changed, decode(get("")))
+}
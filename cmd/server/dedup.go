@@ -0,0 +1,60 @@
+package main
+
+import "time"
+
+// dedupWindowSize is how many of the latest sequence numbers of an agent are
+// remembered to detect duplicates.
+const dedupWindowSize = 64
+
+// sequenceExpiry is how long the sequence window of an agent instance is
+// kept after its last payload. It outlasts the retries of the agents by far,
+// so that payloads of a stopped instance arriving after those of its
+// successor are still detected.
+const sequenceExpiry = 15 * time.Minute
+
+// sequenceWindow tracks which of the latest sequence numbers of an agent
+// process were applied, so that payloads sent again are applied only once.
+type sequenceWindow struct {
+	// node is the node the agent runs on.
+	node string
+	// lastSeen is when the last payload of the agent process was received.
+	lastSeen time.Time
+	// highest is the highest sequence number applied.
+	highest uint64
+	// applied has bit i set if highest-i was applied.
+	applied uint64
+}
+
+// add records the sequence number of a payload. It returns whether the
+// payload was applied before and should be dropped, and how many sequence
+// numbers were skipped since the previous highest one, which may still
+// arrive late.
+func (w *sequenceWindow) add(seq uint64) (duplicate bool, skipped uint64) {
+	switch {
+	case seq > w.highest:
+		shift := seq - w.highest
+		// Sequence numbers before the first one seen were sent before the
+		// server started.
+		if w.highest != 0 {
+			skipped = shift - 1
+		}
+		if shift >= dedupWindowSize {
+			w.applied = 0
+		} else {
+			w.applied <<= shift
+		}
+		w.applied |= 1
+		w.highest = seq
+		return false, skipped
+	case w.highest-seq >= dedupWindowSize:
+		// Too old to tell, most likely a replay.
+		return true, 0
+	default:
+		bit := uint64(1) << (w.highest - seq)
+		if w.applied&bit != 0 {
+			return true, 0
+		}
+		w.applied |= bit
+		return false, 0
+	}
+}
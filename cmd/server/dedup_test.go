@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSequenceWindow(t *testing.T) {
+	type result struct {
+		duplicate bool
+		skipped   uint64
+	}
+	w := &sequenceWindow{}
+	add := func(seq uint64) result {
+		duplicate, skipped := w.add(seq)
+		return result{duplicate, skipped}
+	}
+
+	// The first payload seen may not be the agent's first.
+	require.Equal(t, result{false, 0}, add(5))
+	require.Equal(t, result{false, 0}, add(6))
+	require.Equal(t, result{true, 0}, add(6))
+
+	// 7 and 8 are skipped, but applied once they arrive late.
+	require.Equal(t, result{false, 2}, add(9))
+	require.Equal(t, result{false, 0}, add(8))
+	require.Equal(t, result{true, 0}, add(8))
+	require.Equal(t, result{true, 0}, add(5))
+
+	// Payloads older than the window are dropped.
+	require.Equal(t, result{false, 0}, add(10))
+	require.Equal(t, result{false, dedupWindowSize - 2}, add(10+dedupWindowSize-1))
+	require.Equal(t, result{false, 0}, add(11))
+	require.Equal(t, result{true, 0}, add(10))
+	require.Equal(t, result{false, 0}, add(10+dedupWindowSize))
+	require.Equal(t, result{true, 0}, add(11))
+}
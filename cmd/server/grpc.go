@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/polarsignals/kubezonnet/flowpb"
+	"github.com/polarsignals/kubezonnet/payload"
+)
+
+// flowService receives the flows of agents streaming them over gRPC.
+type flowService struct {
+	flowpb.UnimplementedFlowServiceServer
+
+	server *Server
+	// limiter limits the rate of entries received from all agents, agents
+	// exceeding it are asked to back off. Nil if unlimited.
+	limiter *rate.Limiter
+}
+
+// newFlowService returns the flow service of server. maxEntriesPerSecond
+// limits the rate of entries if greater than 0.
+func newFlowService(server *Server, maxEntriesPerSecond int) *flowService {
+	f := &flowService{server: server}
+	if maxEntriesPerSecond > 0 {
+		f.limiter = rate.NewLimiter(rate.Limit(maxEntriesPerSecond), maxEntriesPerSecond)
+	}
+	return f
+}
+
+func (f *flowService) Stream(stream flowpb.FlowService_StreamServer) error {
+	msg, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	hello := msg.GetHello()
+	if hello == nil || hello.Node == "" || hello.InstanceId == "" {
+		return status.Error(codes.InvalidArgument, "stream must start with a hello naming the node and the agent instance")
+	}
+
+	addr := "unknown address"
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		addr = p.Addr.String()
+	}
+	log.Printf("Agent on node %s opened a stream from %s (version %s, capture mode %s)", hello.Node, addr, hello.AgentVersion, hello.CaptureMode)
+	f.server.seeStream(hello)
+	f.server.metrics.streams.WithLabelValues(hello.Node).Inc()
+	defer func() {
+		f.server.metrics.streams.WithLabelValues(hello.Node).Dec()
+		log.Printf("Agent on node %s closed its stream from %s", hello.Node, addr)
+	}()
+
+	// The agent configuration is sent from another goroutine whenever it
+	// changes, and a stream must not be sent on concurrently.
+	var sendMtx sync.Mutex
+	closed := false
+	send := func(msg *flowpb.ServerMessage) error {
+		sendMtx.Lock()
+		defer sendMtx.Unlock()
+		if closed {
+			return errors.New("stream closed")
+		}
+		return stream.Send(msg)
+	}
+	defer func() {
+		sendMtx.Lock()
+		closed = true
+		sendMtx.Unlock()
+	}()
+
+	// Agents keep their own settings until the configuration is set.
+	config, changed := f.server.agentConfig.get()
+	if config.Revision != withRevision(payload.AgentConfig{}).Revision {
+		if err := send(configUpdate(config)); err != nil {
+			return err
+		}
+	}
+	go func() {
+		for {
+			select {
+			case <-stream.Context().Done():
+				return
+			case <-changed:
+			}
+			config, changed = f.server.agentConfig.get()
+			if err := send(configUpdate(config)); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		msg, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		batch := msg.GetBatch()
+		if batch == nil {
+			return status.Error(codes.InvalidArgument, "expected a batch")
+		}
+		if max := f.server.limits.MaxEntries; max > 0 && len(batch.Records) > max {
+			return status.Errorf(codes.ResourceExhausted, "batch exceeds the limit of %d entries", max)
+		}
+
+		p := payloadFromBatch(hello, batch)
+		if f.server.recordIngestion(p) {
+			f.server.applyPayload(p, batch.Aggregation)
+		} else {
+			log.Printf("Dropping duplicate batch %d from the agent on node %s", batch.Sequence, hello.Node)
+		}
+
+		if err := send(&flowpb.ServerMessage{Message: &flowpb.ServerMessage_Ack{Ack: &flowpb.Ack{
+			Sequence: batch.Sequence,
+		}}}); err != nil {
+			return err
+		}
+		if delay := f.throttle(len(batch.Records)); delay > 0 {
+			if err := send(&flowpb.ServerMessage{Message: &flowpb.ServerMessage_Backpressure{Backpressure: &flowpb.Backpressure{
+				Delay: durationpb.New(delay),
+			}}}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// configUpdate converts the agent configuration to its protobuf
+// representation. A flush interval that fails to parse was rejected by
+// parseAgentConfig already.
+func configUpdate(config payload.AgentConfig) *flowpb.ServerMessage {
+	update := &flowpb.ConfigUpdate{
+		SubnetCidrs:  config.SubnetCIDRs,
+		ExcludeCidrs: config.ExcludeCIDRs,
+		Aggregation:  config.Aggregation,
+		SampleRate:   config.SampleRate,
+		Revision:     config.Revision,
+	}
+	if interval, err := time.ParseDuration(config.FlushInterval); err == nil {
+		update.FlushInterval = durationpb.New(interval)
+	}
+	return &flowpb.ServerMessage{Message: &flowpb.ServerMessage_Config{Config: update}}
+}
+
+// throttle accounts for n received entries and returns for how long the
+// agent should back off to keep within the rate limit.
+func (f *flowService) throttle(n int) time.Duration {
+	if f.limiter == nil || n == 0 {
+		return 0
+	}
+	// The entries were received already, so the reservation is never
+	// cancelled and later agents wait for it as well.
+	now := time.Now()
+	return f.limiter.ReserveN(now, min(n, f.limiter.Burst())).DelayFrom(now)
+}
+
+// payloadFromBatch converts a batch streamed by an agent to the payload it
+// would have sent by HTTP.
+func payloadFromBatch(hello *flowpb.Hello, batch *flowpb.FlowBatch) payload.Payload {
+	p := payload.Payload{
+		SampleRate: batch.SampleRate,
+		Interfaces: len(batch.Interfaces) > 0,
+		Metadata: payload.Metadata{
+			Node:         hello.Node,
+			AgentVersion: hello.AgentVersion,
+			CaptureMode:  hello.CaptureMode,
+			InstanceID:   hello.InstanceId,
+			Sequence:     batch.Sequence,
+		},
+		Entries: make([]payload.Entry, len(batch.Records)),
+	}
+	if p.SampleRate <= 1 {
+		p.SampleRate = 0
+	}
+	if batch.WindowStart != nil {
+		p.Metadata.WindowStart = batch.WindowStart.AsTime()
+	}
+	if batch.WindowEnd != nil {
+		p.Metadata.WindowEnd = batch.WindowEnd.AsTime()
+	}
+	for i, record := range batch.Records {
+		entry := payload.Entry{
+			SrcIP:        record.SrcIp,
+			DstIP:        record.DstIp,
+			SrcPort:      uint16(record.SrcPort),
+			DstPort:      uint16(record.DstPort),
+			Traffic:      record.Bytes,
+			SquaredSizes: record.SquaredSizes,
+		}
+		if record.Ifindex != 0 {
+			name, found := batch.Interfaces[record.Ifindex]
+			if !found {
+				name = "if" + strconv.FormatUint(uint64(record.Ifindex), 10)
+			}
+			entry.Interface = name
+		}
+		p.Entries[i] = entry
+	}
+	return p
+}
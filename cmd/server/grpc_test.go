@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/polarsignals/kubezonnet/flowpb"
+	"github.com/polarsignals/kubezonnet/payload"
+)
+
+// startFlowService serves f and returns a client for it.
+func startFlowService(t *testing.T, f *flowService) flowpb.FlowServiceClient {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	grpcServer := grpc.NewServer()
+	flowpb.RegisterFlowServiceServer(grpcServer, f)
+	go grpcServer.Serve(lis)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return flowpb.NewFlowServiceClient(conn)
+}
+
+func newTestServer() *Server {
+	s := &Server{
+		podIpIndex:        map[uint32]podKey{},
+		nodeIpIndex:       map[uint32]string{},
+		podIndex:          map[podKey]PodInfo{},
+		nodeIndex:         map[string]string{"node-a": "zone-a", "node-b": "zone-b"},
+		statistics:        map[trafficKey]uint64{},
+		variance:          map[trafficKey]float64{},
+		ignoredNamespaces: map[string]bool{},
+		agentInstances:    map[string]string{},
+		sequences:         map[string]*sequenceWindow{},
+		agents:            map[string]*agentInfo{},
+		agentConfig:       newAgentConfigStore(payload.AgentConfig{}),
+		metrics:           newIngestionMetrics(prometheus.NewRegistry()),
+	}
+	for ip, pod := range map[uint32]podKey{1: {"default", "client"}, 2: {"default", "server"}} {
+		s.podIpIndex[ip] = pod
+	}
+	s.podIndex[podKey{"default", "client"}] = PodInfo{Node: "node-a", IPs: []uint32{1}}
+	s.podIndex[podKey{"default", "server"}] = PodInfo{Node: "node-b", IPs: []uint32{2}}
+	return s
+}
+
+func hello(node string) *flowpb.AgentMessage {
+	return &flowpb.AgentMessage{Message: &flowpb.AgentMessage_Hello{Hello: &flowpb.Hello{
+		Node:       node,
+		InstanceId: "instance",
+	}}}
+}
+
+func batch(seq uint64, bytes uint64) *flowpb.AgentMessage {
+	return &flowpb.AgentMessage{Message: &flowpb.AgentMessage_Batch{Batch: &flowpb.FlowBatch{
+		Sequence:  seq,
+		WindowEnd: timestamppb.Now(),
+		Records:   []*flowpb.FlowRecord{{SrcIp: 1, DstIp: 2, SrcPort: 40000, DstPort: 80, Bytes: bytes}},
+	}}}
+}
+
+func TestFlowService(t *testing.T) {
+	s := newTestServer()
+	s.agentConfig = newAgentConfigStore(payload.AgentConfig{FlushInterval: "30s"})
+	client := startFlowService(t, newFlowService(s, 0))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := client.Stream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(hello("node-a")))
+
+	// The configuration is sent as soon as the agent connects.
+	msg, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, 30*time.Second, msg.GetConfig().GetFlushInterval().AsDuration())
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(s.metrics.streams.WithLabelValues("node-a")) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Changes of the configuration are pushed to connected agents.
+	s.agentConfig.set(payload.AgentConfig{SubnetCIDRs: []string{"10.0.0.0/8"}, SampleRate: 4})
+	msg, err = stream.Recv()
+	require.NoError(t, err)
+	config, _ := s.agentConfig.get()
+	require.Equal(t, []string{"10.0.0.0/8"}, msg.GetConfig().GetSubnetCidrs())
+	require.Equal(t, uint32(4), msg.GetConfig().GetSampleRate())
+	require.Equal(t, 30*time.Second, msg.GetConfig().GetFlushInterval().AsDuration())
+	require.Equal(t, config.Revision, msg.GetConfig().GetRevision())
+
+	require.NoError(t, stream.Send(batch(1, 100)))
+	msg, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), msg.GetAck().GetSequence())
+
+	// Batches sent again are acknowledged but not applied twice.
+	require.NoError(t, stream.Send(batch(1, 100)))
+	msg, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), msg.GetAck().GetSequence())
+
+	s.mutex.Lock()
+	require.Equal(t, map[trafficKey]uint64{{pod: podKey{"default", "client"}}: 100}, s.statistics)
+	s.mutex.Unlock()
+	require.Equal(t, 1.0, testutil.ToFloat64(s.metrics.duplicates.WithLabelValues("node-a")))
+
+	require.NoError(t, stream.CloseSend())
+	_, err = stream.Recv()
+	require.Error(t, err)
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(s.metrics.streams.WithLabelValues("node-a")) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestFlowServiceBackpressure(t *testing.T) {
+	s := newTestServer()
+	client := startFlowService(t, newFlowService(s, 1))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := client.Stream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(hello("node-a")))
+
+	// The first entry is within the burst, the second one exceeds the rate.
+	require.NoError(t, stream.Send(batch(1, 100)))
+	msg, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), msg.GetAck().GetSequence())
+
+	require.NoError(t, stream.Send(batch(2, 100)))
+	msg, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), msg.GetAck().GetSequence())
+	msg, err = stream.Recv()
+	require.NoError(t, err)
+	require.Greater(t, msg.GetBackpressure().GetDelay().AsDuration(), time.Duration(0))
+}
+
+func TestFlowServiceRequiresHello(t *testing.T) {
+	client := startFlowService(t, newFlowService(newTestServer(), 0))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := client.Stream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(batch(1, 100)))
+	_, err = stream.Recv()
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestPayloadFromBatch(t *testing.T) {
+	start := time.Unix(100, 0)
+	p := payloadFromBatch(&flowpb.Hello{Node: "node-a", InstanceId: "instance"}, &flowpb.FlowBatch{
+		Sequence:    3,
+		WindowStart: timestamppb.New(start),
+		SampleRate:  1,
+		Interfaces:  map[uint32]string{2: "eth0"},
+		Records: []*flowpb.FlowRecord{
+			{SrcIp: 1, DstIp: 2, Bytes: 10, Ifindex: 2},
+			{SrcIp: 1, DstIp: 3, Bytes: 20, Ifindex: 5},
+		},
+	})
+	require.True(t, p.Interfaces)
+	require.Zero(t, p.SampleRate)
+	require.Equal(t, "node-a", p.Metadata.Node)
+	require.Equal(t, uint64(3), p.Metadata.Sequence)
+	require.True(t, p.Metadata.WindowStart.Equal(start))
+	// Batches without an end don't claim the Unix epoch.
+	require.True(t, p.Metadata.WindowEnd.IsZero())
+	require.Equal(t, "eth0", p.Entries[0].Interface)
+	require.Equal(t, "if5", p.Entries[1].Interface)
+}
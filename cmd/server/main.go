@@ -1,21 +1,31 @@
 package main
 
 import (
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
 	"net/http"
+	"path"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"path/filepath"
 
+	"github.com/polarsignals/kubezonnet/flowpb"
 	"github.com/polarsignals/kubezonnet/payload"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
@@ -29,6 +39,8 @@ import (
 type PodInfo struct {
 	Node string
 	IPs  []uint32
+	// Ignored is set if the pod is annotated with payload.IgnoreAnnotation.
+	Ignored bool
 }
 
 type NodeInfo struct {
@@ -41,11 +53,139 @@ type Server struct {
 	nodeIpIndex map[uint32]string // maps Node IPv4s to Node name (for hostNetwork pods)
 	podIndex    map[podKey]PodInfo
 	nodeIndex   map[string]string // maps node name to Node zone
-	statistics  map[podKey]uint64
-	mutex       sync.RWMutex
+	statistics  map[trafficKey]uint64
+	variance    map[trafficKey]float64 // variance of the estimated traffic from sampling agents
+	// ignoredNamespaces are the namespaces annotated with payload.IgnoreAnnotation.
+	ignoredNamespaces map[string]bool
+	// agentInstances maps node names to the instance ID of their agent.
+	agentInstances map[string]string
+	// sequences tracks the applied payloads of agent instances by their
+	// instance ID, including previous instances until they expire.
+	sequences map[string]*sequenceWindow
+	// sequencesExpired is when expired sequence windows were last removed.
+	sequencesExpired time.Time
+	// agents maps node names to what is known about their agent.
+	agents map[string]*agentInfo
+	mutex  sync.RWMutex
+
+	// includeNamespaces and excludeNamespaces are glob patterns selecting
+	// the namespaces whose traffic is recorded, all if includeNamespaces is
+	// empty.
+	includeNamespaces []string
+	excludeNamespaces []string
+
+	// interfaceDimension attributes traffic to the interface it left the
+	// source node on, for agents that record interfaces.
+	interfaceDimension bool
+
+	// limits bound the size of the payloads of agents.
+	limits payload.Limits
+
+	// agentSettings are negotiated with registering agents.
+	agentSettings agentSettings
+	// agentConfig is the configuration of all agents.
+	agentConfig *agentConfigStore
+
+	metrics *ingestionMetrics
+}
+
+// unknownNode is the node of payloads of agents that don't send metadata.
+const unknownNode = "unknown"
+
+// ingestionMetrics are the per node metrics about the payloads of agents.
+type ingestionMetrics struct {
+	payloads      *prometheus.CounterVec
+	entries       *prometheus.CounterVec
+	restarts      *prometheus.CounterVec
+	duplicates    *prometheus.CounterVec
+	gaps          *prometheus.CounterVec
+	lastWindowEnd *prometheus.GaugeVec
+	streams       *prometheus.GaugeVec
+}
+
+func newIngestionMetrics(reg prometheus.Registerer) *ingestionMetrics {
+	return &ingestionMetrics{
+		payloads: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "kubezonnet_server_payloads_received_total",
+			Help: "The number of payloads received from the agent on a node.",
+		}, []string{"node"}),
+		entries: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "kubezonnet_server_entries_received_total",
+			Help: "The number of entries received from the agent on a node.",
+		}, []string{"node"}),
+		restarts: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "kubezonnet_server_agent_restarts_total",
+			Help: "The number of times the agent on a node was seen restarting.",
+		}, []string{"node"}),
+		duplicates: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "kubezonnet_server_duplicate_payloads_total",
+			Help: "The number of payloads from the agent on a node that were dropped as they had already been applied.",
+		}, []string{"node"}),
+		gaps: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "kubezonnet_server_payload_sequence_gaps_total",
+			Help: "The number of sequence numbers skipped by payloads from the agent on a node, counting payloads that were lost or arrived out of order.",
+		}, []string{"node"}),
+		lastWindowEnd: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "kubezonnet_server_last_window_end_timestamp_seconds",
+			Help: "The end of the collection window of the last payload received from the agent on a node.",
+		}, []string{"node"}),
+		streams: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "kubezonnet_server_agent_streams",
+			Help: "The number of open gRPC streams of the agent on a node, 0 if it isn't connected.",
+		}, []string{"node"}),
+	}
+}
+
+// trafficKey identifies the traffic caused by a pod, iface is only set with
+// the interface dimension enabled.
+type trafficKey struct {
+	pod   podKey
+	iface string
 }
 
 func main() {
+	interfaceDimension := flag.Bool("interface-dimension", false, "Attribute traffic to the interface it left the source node on, adds an interface label to metrics")
+	includeNamespaces := flag.String("include-namespaces", "", "Only record traffic from and to pods in these namespaces, separated by commas and supporting glob patterns such as \"team-*\", all if empty")
+	excludeNamespaces := flag.String("exclude-namespaces", "", "Don't record traffic from and to pods in these namespaces, separated by commas and supporting glob patterns")
+	maxPayloadBytes := flag.Int64("max-payload-bytes", 16<<20, "The maximum size in bytes of a payload or gRPC message of an agent, larger ones are rejected, 0 for no limit")
+	maxPayloadEntries := flag.Int("max-payload-entries", 1<<18, "The maximum number of entries of a payload or streamed batch of an agent, larger ones are rejected, 0 for no limit")
+	grpcAddress := flag.String("grpc-address", "", "Serve the gRPC flow service agents can stream flows to on this address, for example :8081, empty to disable")
+	grpcMaxEntries := flag.Int("grpc-max-entries-per-second", 0, "Ask agents streaming over gRPC to back off when they send more entries per second than this in total, 0 for no limit")
+	agentFlushInterval := flag.Duration("agent-flush-interval", 0, "The flush interval agents that register or stream over gRPC are asked to use unless the agent configuration sets one, 0 to keep their own")
+	agentConfigMap := flag.String("agent-config-map", "", "The ConfigMap holding the configuration of all agents in its config.yaml key, as namespace/name, empty to disable")
+	agentPayloadVersion := flag.Int("agent-payload-version", 0, "The newest payload version registering agents are asked to use, 0 for the newest version both support")
+	agentCompression := flag.String("agent-compression", "", "The compression registering agents that support it are asked to send payloads with, \"gzip\" or empty for none")
+	flag.Parse()
+
+	if *agentPayloadVersion != 0 && !slices.Contains(payload.Versions, *agentPayloadVersion) {
+		log.Fatalf("Invalid -agent-payload-version: unsupported payload version %d", *agentPayloadVersion)
+	}
+	if *agentCompression != "" && *agentCompression != payload.CompressionGzip {
+		log.Fatalf("Invalid -agent-compression: unsupported compression %q", *agentCompression)
+	}
+
+	var agentConfigNamespace, agentConfigName string
+	if *agentConfigMap != "" {
+		var found bool
+		agentConfigNamespace, agentConfigName, found = strings.Cut(*agentConfigMap, "/")
+		if !found || agentConfigNamespace == "" || agentConfigName == "" {
+			log.Fatalf("Invalid -agent-config-map: %q is not of the form namespace/name", *agentConfigMap)
+		}
+	}
+	agentConfigDefaults := payload.AgentConfig{}
+	if *agentFlushInterval > 0 {
+		agentConfigDefaults.FlushInterval = agentFlushInterval.String()
+	}
+
+	includes, err := namespacePatterns(*includeNamespaces)
+	if err != nil {
+		log.Fatalf("Invalid -include-namespaces: %v", err)
+	}
+	excludes, err := namespacePatterns(*excludeNamespaces)
+	if err != nil {
+		log.Fatalf("Invalid -exclude-namespaces: %v", err)
+	}
+
 	config, err := rest.InClusterConfig()
 	if err != nil {
 		kubeconfig := filepath.Join(homedir.HomeDir(), ".kube", "config")
@@ -66,19 +206,65 @@ func main() {
 		nodeIpIndex: map[uint32]string{},
 		podIndex:    map[podKey]PodInfo{},
 		nodeIndex:   map[string]string{},
-		statistics:  map[podKey]uint64{},
+		statistics:  map[trafficKey]uint64{},
+		variance:    map[trafficKey]float64{},
+
+		ignoredNamespaces: map[string]bool{},
+		agentInstances:    map[string]string{},
+		sequences:         map[string]*sequenceWindow{},
+		agents:            map[string]*agentInfo{},
+		includeNamespaces: includes,
+		excludeNamespaces: excludes,
+
+		interfaceDimension: *interfaceDimension,
+		limits: payload.Limits{
+			MaxBytes:   *maxPayloadBytes,
+			MaxEntries: *maxPayloadEntries,
+		},
+		agentSettings: agentSettings{
+			payloadVersion: *agentPayloadVersion,
+			compression:    *agentCompression,
+		},
+		agentConfig: newAgentConfigStore(agentConfigDefaults),
 	}
 
-	// Start watching Pods and Nodes
-	go server.watchPods()
-	go server.watchNodes()
-
 	reg := prometheus.NewRegistry()
 
 	reg.MustRegister(server)
+	server.metrics = newIngestionMetrics(reg)
+
+	// Start watching Pods, Nodes and Namespaces
+	go server.watchPods()
+	go server.watchNodes()
+	go server.watchNamespaces()
+	if agentConfigName != "" {
+		go server.watchAgentConfig(agentConfigNamespace, agentConfigName)
+	}
+
+	if *grpcAddress != "" {
+		lis, err := net.Listen("tcp", *grpcAddress)
+		if err != nil {
+			log.Fatalf("Failed to listen on %s: %v", *grpcAddress, err)
+		}
+		var opts []grpc.ServerOption
+		if *maxPayloadBytes > 0 {
+			opts = append(opts, grpc.MaxRecvMsgSize(int(*maxPayloadBytes)))
+		}
+		grpcServer := grpc.NewServer(opts...)
+		flowpb.RegisterFlowServiceServer(grpcServer, newFlowService(server, *grpcMaxEntries))
+		go func() {
+			log.Printf("Serving the gRPC flow service on %s...", *grpcAddress)
+			if err := grpcServer.Serve(lis); err != nil {
+				log.Fatalf("Failed to serve gRPC: %v", err)
+			}
+		}()
+	}
 
 	http.Handle("/metrics", instrumentHandler(reg, "metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{})))
 	http.Handle("/write-network-statistics", instrumentHandler(reg, "write_statistics", http.HandlerFunc(server.handlePayload)))
+	http.Handle("/register", instrumentHandler(reg, "register", http.HandlerFunc(server.handleRegister)))
+	http.Handle("/agents", instrumentHandler(reg, "agents", http.HandlerFunc(server.handleAgents)))
+	http.Handle("/agent-config", instrumentHandler(reg, "agent_config", http.HandlerFunc(server.handleAgentConfig)))
 	log.Println("Starting server on port 8080...")
 	if err := http.ListenAndServe(":8080", nil); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
@@ -138,6 +324,69 @@ func (s *Server) watchNodes() {
 	controller.Run(make(chan struct{}))
 }
 
+func (s *Server) watchNamespaces() {
+	watchList := cache.NewListWatchFromClient(
+		s.clientset.CoreV1().RESTClient(),
+		"namespaces",
+		metav1.NamespaceAll,
+		fields.Everything(),
+	)
+	_, controller := cache.NewInformer(
+		watchList,
+		&v1.Namespace{},
+		0,
+		cache.ResourceEventHandlerFuncs{
+			AddFunc:    s.onNamespaceAdd,
+			UpdateFunc: s.onNamespaceUpdate,
+			DeleteFunc: s.onNamespaceDelete,
+		},
+	)
+	controller.Run(make(chan struct{}))
+}
+
+// namespacePatterns parses a comma separated list of namespace glob patterns.
+func namespacePatterns(list string) ([]string, error) {
+	if list == "" {
+		return nil, nil
+	}
+	patterns := strings.Split(list, ",")
+	for i, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("pattern %q: %w", pattern, err)
+		}
+		patterns[i] = pattern
+	}
+	return patterns, nil
+}
+
+// matchNamespace reports whether namespace matches any of patterns.
+func matchNamespace(patterns []string, namespace string) bool {
+	for _, pattern := range patterns {
+		// The patterns were validated by namespacePatterns.
+		if matched, _ := path.Match(pattern, namespace); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// ignored reports whether the traffic from or to a pod isn't recorded, as the
+// pod or its namespace are annotated with payload.IgnoreAnnotation, or its
+// namespace isn't selected. Nodes are never ignored. The mutex must be held.
+func (s *Server) ignored(k podKey) bool {
+	if k.namespace == "_node_" {
+		return false
+	}
+	if s.podIndex[k].Ignored || s.ignoredNamespaces[k.namespace] {
+		return true
+	}
+	if len(s.includeNamespaces) > 0 && !matchNamespace(s.includeNamespaces, k.namespace) {
+		return true
+	}
+	return matchNamespace(s.excludeNamespaces, k.namespace)
+}
+
 // ipToUint32 converts an IPv4 address to a uint32
 func ipToUint32(ip net.IP) uint32 {
 	parts := strings.Split(ip.String(), ".")
@@ -187,8 +436,9 @@ func (s *Server) handlePod(obj interface{}) {
 		namespace: pod.Namespace,
 		name:      pod.Name,
 	}] = PodInfo{
-		Node: pod.Spec.NodeName,
-		IPs:  ips,
+		Node:    pod.Spec.NodeName,
+		IPs:     ips,
+		Ignored: payload.Ignored(pod.Annotations),
 	}
 	for _, ip := range ips {
 		// If the pod IP matches the host IP, it's using hostNetwork
@@ -246,7 +496,16 @@ func (s *Server) onPodDelete(obj interface{}) {
 		delete(s.podIndex, k)
 	}
 
-	delete(s.statistics, k)
+	for key := range s.statistics {
+		if key.pod == k {
+			delete(s.statistics, key)
+		}
+	}
+	for key := range s.variance {
+		if key.pod == k {
+			delete(s.variance, key)
+		}
+	}
 	s.mutex.Unlock()
 }
 
@@ -293,16 +552,66 @@ func (s *Server) onNodeDelete(obj interface{}) {
 		}
 	}
 	delete(s.nodeIndex, node.Name)
+	for instanceID, window := range s.sequences {
+		if window.node == node.Name {
+			delete(s.sequences, instanceID)
+		}
+	}
+	delete(s.agentInstances, node.Name)
+	delete(s.agents, node.Name)
 	s.mutex.Unlock()
+	s.metrics.payloads.DeleteLabelValues(node.Name)
+	s.metrics.entries.DeleteLabelValues(node.Name)
+	s.metrics.restarts.DeleteLabelValues(node.Name)
+	s.metrics.duplicates.DeleteLabelValues(node.Name)
+	s.metrics.gaps.DeleteLabelValues(node.Name)
+	s.metrics.lastWindowEnd.DeleteLabelValues(node.Name)
+	s.metrics.streams.DeleteLabelValues(node.Name)
 	log.Printf("Node deleted: %s", node.Name)
 }
 
+func (s *Server) onNamespaceAdd(obj interface{}) {
+	s.handleNamespace(obj)
+}
+
+func (s *Server) onNamespaceUpdate(oldObj, newObj interface{}) {
+	s.handleNamespace(newObj)
+}
+
+func (s *Server) handleNamespace(obj interface{}) {
+	namespace, ok := obj.(*v1.Namespace)
+	if !ok {
+		return
+	}
+	s.mutex.Lock()
+	if payload.Ignored(namespace.Annotations) {
+		s.ignoredNamespaces[namespace.Name] = true
+	} else {
+		delete(s.ignoredNamespaces, namespace.Name)
+	}
+	s.mutex.Unlock()
+}
+
+func (s *Server) onNamespaceDelete(obj interface{}) {
+	namespace, ok := obj.(*v1.Namespace)
+	if !ok {
+		return
+	}
+	s.mutex.Lock()
+	delete(s.ignoredNamespaces, namespace.Name)
+	s.mutex.Unlock()
+}
+
 type flowLog struct {
 	src     podKey
 	srcPort int
 	dst     podKey
 	dstPort int
+	iface   string
 	bytes   int
+	// margin is the 95% confidence error margin of bytes, if it is estimated
+	// from sampled packets.
+	margin float64
 }
 
 func (s *Server) handlePayload(w http.ResponseWriter, r *http.Request) {
@@ -311,18 +620,60 @@ func (s *Server) handlePayload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+	if max := s.limits.MaxBytes; max > 0 && r.ContentLength > max {
+		http.Error(w, fmt.Sprintf("Request body exceeds the limit of %d bytes", max), http.StatusRequestEntityTooLarge)
 		return
 	}
 
-	data, err := payload.Decode(body)
-	if err != nil {
+	// The limits apply to the decompressed payload.
+	var body io.Reader = r.Body
+	switch encoding := r.Header.Get("Content-Encoding"); encoding {
+	case "", "identity":
+	case payload.CompressionGzip:
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to decompress request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	default:
+		http.Error(w, fmt.Sprintf("Unsupported content encoding %q", encoding), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	p, err := payload.NewDecoder(body, s.limits).Decode()
+	var tooLarge *payload.TooLargeError
+	var malformed *payload.MalformedError
+	var corrupt flate.CorruptInputError
+	switch {
+	case errors.As(err, &tooLarge):
+		http.Error(w, fmt.Sprintf("Failed to decode request body: %v", err), http.StatusRequestEntityTooLarge)
+		return
+	case errors.As(err, &malformed), errors.As(err, &corrupt), errors.Is(err, gzip.ErrChecksum), errors.Is(err, gzip.ErrHeader):
 		http.Error(w, fmt.Sprintf("Failed to decode request body: %v", err), http.StatusBadRequest)
 		return
+	case err != nil:
+		http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+		return
+	}
+	if !s.recordIngestion(p) {
+		// Acknowledged, so that the agent stops retrying.
+		log.Printf("Dropping duplicate payload %d from the agent on node %s", p.Metadata.Sequence, p.Metadata.Node)
+		return
 	}
 
+	s.applyPayload(p, r.Header.Get(payload.AggregationHeader))
+}
+
+// applyPayload adds the cross-zone traffic of the payload's entries to the
+// statistics and logs the flows. aggregation is the aggregation mode of the
+// agent, if it sent it.
+func (s *Server) applyPayload(p payload.Payload, aggregation string) {
+	data := p.Entries
+	// Agents that aggregate ports send collapsed ports as 0.
+	aggregated := aggregation != "" && aggregation != payload.AggregationFull
+
 	flowLogs := make([]flowLog, 0, len(data))
 
 	s.mutex.Lock()
@@ -390,23 +741,152 @@ func (s *Server) handlePayload(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
+		if s.ignored(sourcePodKey) || s.ignored(dstPodKey) {
+			continue
+		}
+
 		if srcZone != dstZone {
+			variance := sampleVariance(p.SampleRate, entry.SquaredSizes)
 			flowLogs = append(flowLogs, flowLog{
 				src:     sourcePodKey,
 				srcPort: int(entry.SrcPort),
 				dst:     dstPodKey,
 				dstPort: int(entry.DstPort),
+				iface:   entry.Interface,
 				bytes:   int(entry.Traffic),
+				margin:  errorMargin(variance),
 			})
-			s.statistics[sourcePodKey] += uint64(entry.Traffic)
+			key := trafficKey{pod: sourcePodKey}
+			if s.interfaceDimension {
+				key.iface = entry.Interface
+			}
+			s.statistics[key] += uint64(entry.Traffic)
+			if variance > 0 {
+				s.variance[key] += variance
+			}
 		}
 	}
 
 	s.mutex.Unlock()
 
+	// Flows are logged with the window they were collected in, if the agent
+	// sent it.
+	window := ""
+	if m := p.Metadata; !m.WindowStart.IsZero() && !m.WindowEnd.IsZero() {
+		window = " between " + m.WindowStart.UTC().Format(time.RFC3339) + " and " + m.WindowEnd.UTC().Format(time.RFC3339)
+	}
 	for _, flowLog := range flowLogs {
-		log.Println(flowLog.src, "from port", flowLog.srcPort, "to", flowLog.dst, "at port", flowLog.dstPort, "with", strconv.Itoa(flowLog.bytes), "bytes")
+		via := ""
+		if flowLog.iface != "" {
+			via = " via " + flowLog.iface
+		}
+		if p.SampleRate > 1 {
+			log.Println(flowLog.src, "from port", formatPort(flowLog.srcPort, aggregated), "to", flowLog.dst, "at port", formatPort(flowLog.dstPort, aggregated)+via, "with an estimated", strconv.Itoa(flowLog.bytes), "±", strconv.Itoa(int(flowLog.margin)), "bytes sampled from 1 in", p.SampleRate, "packets"+window)
+			continue
+		}
+		log.Println(flowLog.src, "from port", formatPort(flowLog.srcPort, aggregated), "to", flowLog.dst, "at port", formatPort(flowLog.dstPort, aggregated)+via, "with", strconv.Itoa(flowLog.bytes), "bytes"+window)
+	}
+}
+
+// recordIngestion updates the ingestion metrics of the payload's node and
+// detects restarts of its agent by a new instance ID. It returns false if the
+// payload was already applied.
+func (s *Server) recordIngestion(p payload.Payload) bool {
+	node := p.Metadata.Node
+	if node == "" {
+		node = unknownNode
+	}
+
+	var previous string
+	var seen, duplicate bool
+	var skipped uint64
+	instanceID := p.Metadata.InstanceID
+	if instanceID != "" && node != unknownNode {
+		now := time.Now()
+		s.mutex.Lock()
+		s.expireSequences(now)
+		var window *sequenceWindow
+		window, seen = s.sequences[instanceID]
+		if !seen {
+			window = &sequenceWindow{node: node}
+			s.sequences[instanceID] = window
+		}
+		window.lastSeen = now
+		previous = s.agentInstances[node]
+		// Late payloads of a previous instance don't replace its successor.
+		if !seen {
+			s.agentInstances[node] = instanceID
+		}
+		if s.agentInstances[node] == instanceID {
+			s.seeAgent(p.Metadata)
+		}
+		if p.Metadata.Sequence != 0 {
+			duplicate, skipped = window.add(p.Metadata.Sequence)
+		}
+		s.mutex.Unlock()
+	}
+
+	if duplicate {
+		s.metrics.duplicates.WithLabelValues(node).Inc()
+		return false
+	}
+	s.metrics.payloads.WithLabelValues(node).Inc()
+	s.metrics.entries.WithLabelValues(node).Add(float64(len(p.Entries)))
+	if !p.Metadata.WindowEnd.IsZero() {
+		s.metrics.lastWindowEnd.WithLabelValues(node).Set(float64(p.Metadata.WindowEnd.UnixNano()) / 1e9)
+	}
+	if skipped > 0 {
+		s.metrics.gaps.WithLabelValues(node).Add(float64(skipped))
+	}
+	switch {
+	case seen || instanceID == "" || node == unknownNode:
+	case previous == "":
+		log.Printf("Agent on node %s connected (version %s, capture mode %s)", node, p.Metadata.AgentVersion, p.Metadata.CaptureMode)
+	case previous != instanceID:
+		s.metrics.restarts.WithLabelValues(node).Inc()
+		log.Printf("Agent on node %s restarted (version %s, capture mode %s)", node, p.Metadata.AgentVersion, p.Metadata.CaptureMode)
+	}
+	return true
+}
+
+// expireSequences removes the sequence windows of agent instances that sent
+// no payload for sequenceExpiry, at most once a minute. The mutex must be
+// held.
+func (s *Server) expireSequences(now time.Time) {
+	if now.Sub(s.sequencesExpired) < time.Minute {
+		return
+	}
+	s.sequencesExpired = now
+	for instanceID, window := range s.sequences {
+		if now.Sub(window.lastSeen) >= sequenceExpiry {
+			delete(s.sequences, instanceID)
+		}
+	}
+}
+
+// sampleVariance estimates the variance of the traffic estimated from
+// packets sampled with probability 1/rate, given the sum of the squared sizes
+// of the sampled packets (Horvitz-Thompson estimator).
+func sampleVariance(rate uint32, squaredSizes uint64) float64 {
+	if rate <= 1 {
+		return 0
+	}
+	return float64(rate) * float64(rate-1) * float64(squaredSizes)
+}
+
+// errorMargin returns the 95% confidence error margin of an estimate with the
+// given variance.
+func errorMargin(variance float64) float64 {
+	return 1.96 * math.Sqrt(variance)
+}
+
+// formatPort formats a port for flow logs, ports collapsed by the agent's
+// aggregation are shown as "*".
+func formatPort(port int, aggregated bool) string {
+	if aggregated && port == 0 {
+		return "*"
 	}
+	return strconv.Itoa(port)
 }
 
 var (
@@ -416,23 +896,69 @@ var (
 		[]string{"namespace", "pod"},
 		nil,
 	)
+	errorMarginDesc = prometheus.NewDesc(
+		"pod_cross_zone_network_traffic_bytes_error_margin",
+		"The 95% confidence error margin of pod_cross_zone_network_traffic_bytes_total, for pods whose traffic was estimated by agents sampling packets",
+		[]string{"namespace", "pod"},
+		nil,
+	)
+	interfaceDesc = prometheus.NewDesc(
+		"pod_cross_zone_network_traffic_bytes_total",
+		"The amount of cross-zone traffic the pod caused",
+		[]string{"namespace", "pod", "interface"},
+		nil,
+	)
+	interfaceErrorMarginDesc = prometheus.NewDesc(
+		"pod_cross_zone_network_traffic_bytes_error_margin",
+		"The 95% confidence error margin of pod_cross_zone_network_traffic_bytes_total, for pods whose traffic was estimated by agents sampling packets",
+		[]string{"namespace", "pod", "interface"},
+		nil,
+	)
 )
 
 func (s *Server) Describe(ch chan<- *prometheus.Desc) {
+	if s.interfaceDimension {
+		ch <- interfaceDesc
+		ch <- interfaceErrorMarginDesc
+		return
+	}
 	ch <- desc
+	ch <- errorMarginDesc
+}
+
+// labelValues returns the metric label values of key, with or without the
+// interface label.
+func (s *Server) labelValues(key trafficKey) []string {
+	if s.interfaceDimension {
+		return []string{key.pod.namespace, key.pod.name, key.iface}
+	}
+	return []string{key.pod.namespace, key.pod.name}
 }
 
 func (s *Server) Collect(ch chan<- prometheus.Metric) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	for pod, traffic := range s.statistics {
+	trafficDesc, marginDesc := desc, errorMarginDesc
+	if s.interfaceDimension {
+		trafficDesc, marginDesc = interfaceDesc, interfaceErrorMarginDesc
+	}
+
+	for key, traffic := range s.statistics {
 		ch <- prometheus.MustNewConstMetric(
-			desc,
+			trafficDesc,
 			prometheus.CounterValue,
 			float64(traffic),
-			pod.namespace,
-			pod.name,
+			s.labelValues(key)...,
+		)
+	}
+
+	for key, variance := range s.variance {
+		ch <- prometheus.MustNewConstMetric(
+			marginDesc,
+			prometheus.GaugeValue,
+			errorMargin(variance),
+			s.labelValues(key)...,
 		)
 	}
 }
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/polarsignals/kubezonnet/byteorder"
+	"github.com/polarsignals/kubezonnet/payload"
+)
+
+func TestHandlePayloadLimits(t *testing.T) {
+	s := newTestServer()
+	s.limits = payload.Limits{MaxBytes: 1024, MaxEntries: 2}
+
+	post := func(body []byte) int {
+		rec := httptest.NewRecorder()
+		s.handlePayload(rec, httptest.NewRequest(http.MethodPost, "/write-network-statistics", bytes.NewReader(body)))
+		return rec.Code
+	}
+	entries := func(n int) []byte {
+		keys := make([]payload.IPKey, n)
+		for i := range keys {
+			keys[i] = payload.IPKey{SrcIP: byteorder.Htonl(1), DstIP: byteorder.Htonl(2), SrcPort: uint16(i)}
+		}
+		return payload.Encode(keys, make([]payload.IPValue, n))
+	}
+
+	require.Equal(t, http.StatusOK, post(entries(2)))
+	require.Equal(t, http.StatusRequestEntityTooLarge, post(entries(3)))
+	require.Equal(t, http.StatusRequestEntityTooLarge, post(make([]byte, 2048)))
+	require.Equal(t, http.StatusBadRequest, post(entries(2)[:10]))
+
+	// Bodies of unknown length are checked against the limit as well.
+	s.limits.MaxEntries = 0
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/write-network-statistics", bytes.NewReader(entries(60)))
+	req.ContentLength = -1
+	s.handlePayload(rec, req)
+	require.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+}
+
+func TestHandlePayloadGzip(t *testing.T) {
+	s := newTestServer()
+	s.limits = payload.Limits{MaxBytes: 1024}
+
+	post := func(body []byte, encoding string) int {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/write-network-statistics", bytes.NewReader(body))
+		req.Header.Set("Content-Encoding", encoding)
+		s.handlePayload(rec, req)
+		return rec.Code
+	}
+	compress := func(content []byte) []byte {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		_, err := gz.Write(content)
+		require.NoError(t, err)
+		require.NoError(t, gz.Close())
+		return buf.Bytes()
+	}
+
+	keys := []payload.IPKey{{SrcIP: byteorder.Htonl(1), DstIP: byteorder.Htonl(2), SrcPort: 80}}
+	values := []payload.IPValue{{PacketSize: 100}}
+	require.Equal(t, http.StatusOK, post(compress(payload.Encode(keys, values)), "gzip"))
+	require.Equal(t, uint64(100), s.statistics[trafficKey{pod: podKey{"default", "client"}}])
+
+	require.Equal(t, http.StatusUnsupportedMediaType, post(payload.Encode(keys, values), "br"))
+	require.Equal(t, http.StatusBadRequest, post(payload.Encode(keys, values), "gzip"))
+	corrupt := compress(payload.Encode(keys, values))
+	corrupt[len(corrupt)-5]++
+	require.Equal(t, http.StatusBadRequest, post(corrupt, "gzip"))
+
+	// The limits apply to the decompressed payload.
+	large := payload.Encode(make([]payload.IPKey, 60), make([]payload.IPValue, 60))
+	require.Less(t, len(compress(large)), 1024)
+	require.Equal(t, http.StatusRequestEntityTooLarge, post(compress(large), "gzip"))
+}
+
+func TestHandlePayloadInstances(t *testing.T) {
+	s := newTestServer()
+	post := func(instanceID string, seq uint64) {
+		keys := []payload.IPKey{{SrcIP: byteorder.Htonl(1), DstIP: byteorder.Htonl(2), SrcPort: 80}}
+		values := []payload.IPValue{{PacketSize: 100}}
+		body := payload.EncodeWithOptions(keys, values, payload.Options{
+			Version:  payload.Version2,
+			Metadata: &payload.Metadata{Node: "node-a", InstanceID: instanceID, Sequence: seq},
+		})
+		rec := httptest.NewRecorder()
+		s.handlePayload(rec, httptest.NewRequest(http.MethodPost, "/write-network-statistics", bytes.NewReader(body)))
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+	metric := func(c interface {
+		WithLabelValues(...string) prometheus.Counter
+	}) float64 {
+		return testutil.ToFloat64(c.WithLabelValues("node-a"))
+	}
+	traffic := func() uint64 {
+		return s.statistics[trafficKey{pod: podKey{"default", "client"}}]
+	}
+
+	post("a", 1)
+	post("a", 1)
+	require.Equal(t, uint64(100), traffic())
+	// Duplicates aren't counted as ingested.
+	require.Equal(t, 1.0, metric(s.metrics.payloads))
+	require.Equal(t, 1.0, metric(s.metrics.entries))
+	require.Equal(t, 1.0, metric(s.metrics.duplicates))
+
+	post("b", 1)
+	require.Equal(t, 1.0, metric(s.metrics.restarts))
+	require.Equal(t, "b", s.agentInstances["node-a"])
+
+	// Payloads of the previous instance arriving late are still
+	// deduplicated, and don't count as another restart.
+	post("a", 1)
+	post("a", 2)
+	require.Equal(t, uint64(300), traffic())
+	require.Equal(t, 1.0, metric(s.metrics.restarts))
+	require.Equal(t, 2.0, metric(s.metrics.duplicates))
+	require.Equal(t, "b", s.agentInstances["node-a"])
+	require.Equal(t, "b", s.agents["node-a"].InstanceID)
+
+	// Windows of instances that stopped sending expire.
+	s.sequences["a"].lastSeen = time.Now().Add(-sequenceExpiry)
+	s.sequencesExpired = time.Time{}
+	post("b", 2)
+	require.NotContains(t, s.sequences, "a")
+	require.Contains(t, s.sequences, "b")
+}
+
+func TestNamespacePatterns(t *testing.T) {
+	patterns, err := namespacePatterns("")
+	require.NoError(t, err)
+	require.Nil(t, patterns)
+
+	patterns, err = namespacePatterns("default, team-*,kube-?")
+	require.NoError(t, err)
+	require.Equal(t, []string{"default", "team-*", "kube-?"}, patterns)
+
+	_, err = namespacePatterns("default,team-[")
+	require.Error(t, err)
+
+	require.True(t, matchNamespace(patterns, "default"))
+	require.True(t, matchNamespace(patterns, "team-a"))
+	require.False(t, matchNamespace(patterns, "kube-system"))
+	require.False(t, matchNamespace(nil, "default"))
+}
+
+func TestServerIgnored(t *testing.T) {
+	s := newTestServer()
+	client, node := podKey{"default", "client"}, podKey{"_node_", "node-a"}
+	require.False(t, s.ignored(client))
+
+	// Pods are ignored by their or their namespace's annotation.
+	s.podIndex[client] = PodInfo{Node: "node-a", Ignored: true}
+	require.True(t, s.ignored(client))
+	s.podIndex[client] = PodInfo{Node: "node-a"}
+	s.ignoredNamespaces["default"] = true
+	require.True(t, s.ignored(client))
+	delete(s.ignoredNamespaces, "default")
+
+	// Or if their namespace isn't selected.
+	s.includeNamespaces = []string{"team-*"}
+	require.True(t, s.ignored(client))
+	require.False(t, s.ignored(podKey{"team-a", "client"}))
+	s.includeNamespaces = nil
+	s.excludeNamespaces = []string{"def*"}
+	require.True(t, s.ignored(client))
+	require.False(t, s.ignored(podKey{"team-a", "client"}))
+
+	// Nodes are never ignored.
+	s.includeNamespaces = []string{"team-*"}
+	s.excludeNamespaces = []string{"*"}
+	require.False(t, s.ignored(node))
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/polarsignals/kubezonnet/flowpb"
+	"github.com/polarsignals/kubezonnet/payload"
+)
+
+// Transports agents send flows with.
+const (
+	transportHTTP = "http"
+	transportGRPC = "grpc"
+)
+
+// maxRegistrationBytes limits the size of registration requests.
+const maxRegistrationBytes = 64 << 10
+
+// agentSettings are the settings the server asks registering agents to use.
+type agentSettings struct {
+	// payloadVersion is the newest payload version agents are asked to use,
+	// the newest version both sides support if 0.
+	payloadVersion int
+	// compression is used by agents that support it, none if empty.
+	compression string
+}
+
+// negotiate picks the settings of an agent from its capabilities. Agents
+// that don't announce any payload versions are asked to use the legacy
+// encoding, which all agents can send.
+func (a agentSettings) negotiate(reg payload.Registration) payload.RegistrationResponse {
+	res := payload.RegistrationResponse{PayloadVersion: payload.VersionLegacy}
+	for _, version := range reg.PayloadVersions {
+		if version > res.PayloadVersion && slices.Contains(payload.Versions, version) && (a.payloadVersion == 0 || version <= a.payloadVersion) {
+			res.PayloadVersion = version
+		}
+	}
+	if a.compression != "" && slices.Contains(reg.Compressions, a.compression) {
+		res.Compression = a.compression
+	}
+	return res
+}
+
+// agentInfo is what the server knows about the agent on a node. Agents that
+// didn't register are known from their payloads or streams, without their
+// capabilities.
+type agentInfo struct {
+	payload.Registration
+	// Transport is how the agent sends flows, transportHTTP or
+	// transportGRPC.
+	Transport string `json:"transport"`
+	// Settings were negotiated when the agent registered, nil if it didn't.
+	Settings *payload.RegistrationResponse `json:"settings,omitempty"`
+	// LastSeen is when the agent last registered, opened a stream or sent
+	// a payload.
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var reg payload.Registration
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxRegistrationBytes)).Decode(&reg); err != nil {
+		http.Error(w, "Failed to decode registration: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if reg.Node == "" || reg.InstanceID == "" {
+		http.Error(w, "Registration must name the node and the agent instance", http.StatusBadRequest)
+		return
+	}
+
+	// The configuration is listed separately, as it changes after the
+	// agent registered.
+	settings := s.agentSettings.negotiate(reg)
+	s.mutex.Lock()
+	s.agents[reg.Node] = &agentInfo{
+		Registration: reg,
+		Transport:    transportHTTP,
+		Settings:     &settings,
+		LastSeen:     time.Now(),
+	}
+	s.mutex.Unlock()
+	log.Printf("Agent on node %s registered (version %s, kernel %s, capture mode %s), using payload version %d and compression %q", reg.Node, reg.AgentVersion, reg.KernelRelease, reg.CaptureMode, settings.PayloadVersion, settings.Compression)
+
+	res := settings
+	config, _ := s.agentConfig.get()
+	res.Config = &config
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Printf("Failed to write registration response: %v", err)
+	}
+}
+
+// handleAgents lists the known agents, ordered by node.
+func (s *Server) handleAgents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.mutex.RLock()
+	agents := make([]agentInfo, 0, len(s.agents))
+	for _, agent := range s.agents {
+		agents = append(agents, *agent)
+	}
+	s.mutex.RUnlock()
+	slices.SortFunc(agents, func(a, b agentInfo) int {
+		return strings.Compare(a.Node, b.Node)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(agents); err != nil {
+		log.Printf("Failed to write agents: %v", err)
+	}
+}
+
+// seeAgent records that the agent sending a payload with metadata m is alive,
+// adding it to the known agents if it didn't register. The caller must hold
+// the mutex.
+func (s *Server) seeAgent(m payload.Metadata) {
+	now := time.Now()
+	if agent, found := s.agents[m.Node]; found && agent.InstanceID == m.InstanceID {
+		agent.LastSeen = now
+		return
+	}
+	s.agents[m.Node] = &agentInfo{
+		Registration: payload.Registration{
+			Node:         m.Node,
+			InstanceID:   m.InstanceID,
+			AgentVersion: m.AgentVersion,
+			CaptureMode:  m.CaptureMode,
+		},
+		Transport: transportHTTP,
+		LastSeen:  now,
+	}
+}
+
+// seeStream adds the agent introduced by hello to the known agents. The
+// capabilities and settings of an agent that registered are kept.
+func (s *Server) seeStream(hello *flowpb.Hello) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	agent, found := s.agents[hello.Node]
+	if !found {
+		agent = &agentInfo{}
+		s.agents[hello.Node] = agent
+	}
+	agent.Node = hello.Node
+	agent.InstanceID = hello.InstanceId
+	agent.AgentVersion = hello.AgentVersion
+	agent.CaptureMode = hello.CaptureMode
+	agent.Transport = transportGRPC
+	agent.LastSeen = time.Now()
+}
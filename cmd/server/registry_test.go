@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/polarsignals/kubezonnet/flowpb"
+	"github.com/polarsignals/kubezonnet/payload"
+)
+
+func TestNegotiate(t *testing.T) {
+	reg := payload.Registration{
+		PayloadVersions: []int{payload.VersionLegacy, payload.Version2, payload.Version3, 99},
+		Compressions:    []string{payload.CompressionGzip, "zstd"},
+	}
+
+	// The newest version both sides support, without compression.
+	require.Equal(t, payload.RegistrationResponse{PayloadVersion: payload.Version3}, agentSettings{}.negotiate(reg))
+
+	require.Equal(t, payload.RegistrationResponse{
+		PayloadVersion: payload.Version2,
+		Compression:    payload.CompressionGzip,
+	}, agentSettings{
+		payloadVersion: payload.Version2,
+		compression:    payload.CompressionGzip,
+	}.negotiate(reg))
+
+	// Agents that don't announce their capabilities are asked for the
+	// legacy encoding without compression.
+	require.Equal(t, payload.RegistrationResponse{PayloadVersion: payload.VersionLegacy}, agentSettings{
+		compression: payload.CompressionGzip,
+	}.negotiate(payload.Registration{}))
+}
+
+func TestRegistry(t *testing.T) {
+	s := newTestServer()
+	s.agentSettings = agentSettings{compression: payload.CompressionGzip}
+
+	register := func(reg payload.Registration) *httptest.ResponseRecorder {
+		body, err := json.Marshal(reg)
+		require.NoError(t, err)
+		rec := httptest.NewRecorder()
+		s.handleRegister(rec, httptest.NewRequest(http.MethodPost, "/register", bytes.NewReader(body)))
+		return rec
+	}
+	listAgents := func() []agentInfo {
+		rec := httptest.NewRecorder()
+		s.handleAgents(rec, httptest.NewRequest(http.MethodGet, "/agents", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		var agents []agentInfo
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&agents))
+		return agents
+	}
+
+	reg := payload.Registration{
+		Node:            "node-b",
+		InstanceID:      "instance-b",
+		AgentVersion:    "v1.2.3",
+		KernelRelease:   "6.8.0-1015-gcp",
+		CaptureMode:     "netfilter",
+		PayloadVersions: payload.Versions,
+		Compressions:    []string{payload.CompressionGzip},
+	}
+	rec := register(reg)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var settings payload.RegistrationResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&settings))
+	config, _ := s.agentConfig.get()
+	require.Equal(t, payload.RegistrationResponse{PayloadVersion: payload.Version3, Compression: payload.CompressionGzip, Config: &config}, settings)
+	settings.Config = nil
+
+	require.Equal(t, http.StatusBadRequest, register(payload.Registration{Node: "node-c"}).Code)
+
+	// Agents that didn't register are known from their payloads.
+	require.True(t, s.recordIngestion(payload.Payload{Metadata: payload.Metadata{
+		Node:         "node-a",
+		InstanceID:   "instance-a",
+		AgentVersion: "v1.0.0",
+		Sequence:     1,
+	}}))
+
+	agents := listAgents()
+	require.Len(t, agents, 2)
+	require.Equal(t, payload.Registration{Node: "node-a", InstanceID: "instance-a", AgentVersion: "v1.0.0"}, agents[0].Registration)
+	require.Equal(t, transportHTTP, agents[0].Transport)
+	require.Nil(t, agents[0].Settings)
+	require.Equal(t, reg, agents[1].Registration)
+	require.Equal(t, &settings, agents[1].Settings)
+	require.False(t, agents[1].LastSeen.IsZero())
+
+	// Payloads of a registered agent keep its capabilities.
+	require.True(t, s.recordIngestion(payload.Payload{Metadata: payload.Metadata{Node: "node-b", InstanceID: "instance-b", Sequence: 1}}))
+	agents = listAgents()
+	require.Equal(t, reg, agents[1].Registration)
+
+	// So do streams opened by a registered agent.
+	s.seeStream(&flowpb.Hello{Node: "node-b", InstanceId: "instance-b", AgentVersion: "v1.2.4", CaptureMode: "tcx"})
+	agents = listAgents()
+	want := reg
+	want.AgentVersion, want.CaptureMode = "v1.2.4", "tcx"
+	require.Equal(t, want, agents[1].Registration)
+	require.Equal(t, &settings, agents[1].Settings)
+	require.Equal(t, transportGRPC, agents[1].Transport)
+
+	rec = httptest.NewRecorder()
+	s.handleAgents(rec, httptest.NewRequest(http.MethodPost, "/agents", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
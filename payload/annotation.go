@@ -0,0 +1,14 @@
+package payload
+
+import "strconv"
+
+// IgnoreAnnotation excludes the traffic of a pod, or of all pods in a
+// namespace, from the statistics if set to "true". It is honored by both the
+// agent and the server.
+const IgnoreAnnotation = "kubezonnet.io/ignore"
+
+// Ignored reports whether annotations set IgnoreAnnotation to true.
+func Ignored(annotations map[string]string) bool {
+	ignore, _ := strconv.ParseBool(annotations[IgnoreAnnotation])
+	return ignore
+}
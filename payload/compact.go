@@ -0,0 +1,167 @@
+package payload
+
+import (
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/polarsignals/kubezonnet/byteorder"
+)
+
+// appendCompactEntries appends the fieldCompactEntries encoding of entries
+// with the given columns, whose sizes are ignored. The entries are sorted by
+// their IPs, so that the IPs of consecutive entries are mostly the same or
+// close.
+func appendCompactEntries(buf []byte, columns []column, keys []IPKey, values []IPValue) []byte {
+	order := make([]sortedKey, len(keys))
+	for i, key := range keys {
+		order[i] = sortedKey{
+			ips:   uint64(byteorder.Ntohl(key.SrcIP))<<32 | uint64(byteorder.Ntohl(key.DstIP)),
+			index: i,
+		}
+	}
+	slices.SortFunc(order, func(a, b sortedKey) int {
+		if a.ips != b.ips {
+			return cmp.Compare(a.ips, b.ips)
+		}
+		return cmp.Compare(a.index, b.index)
+	})
+
+	buf = binary.AppendUvarint(buf, uint64(len(columns)))
+	for _, c := range columns {
+		buf = append(buf, c.typ)
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(keys)))
+
+	var srcIP, dstIP uint32
+	for _, sorted := range order {
+		i := sorted.index
+		key := keys[i]
+		for _, c := range columns {
+			switch c.typ {
+			case columnSrcIP:
+				ip := uint32(sorted.ips >> 32)
+				buf = binary.AppendVarint(buf, int64(ip)-int64(srcIP))
+				srcIP = ip
+			case columnDstIP:
+				ip := uint32(sorted.ips)
+				buf = binary.AppendVarint(buf, int64(ip)-int64(dstIP))
+				dstIP = ip
+			case columnSrcPort:
+				buf = binary.AppendUvarint(buf, uint64(key.SrcPort))
+			case columnDstPort:
+				buf = binary.AppendUvarint(buf, uint64(key.DstPort))
+			case columnTraffic:
+				buf = binary.AppendUvarint(buf, values[i].PacketSize)
+			case columnSquaredSizes:
+				buf = binary.AppendUvarint(buf, values[i].SquaredSizes)
+			case columnIfindex:
+				buf = binary.AppendUvarint(buf, uint64(key.Ifindex))
+			}
+		}
+	}
+	return buf
+}
+
+// sortedKey is the position of a key in the sorted order of keys, with its
+// IPs in host byte order.
+type sortedKey struct {
+	ips   uint64
+	index int
+}
+
+// decodeCompactColumns decodes the compact entries field of the given
+// length. The interface indexes are returned separately, to be resolved once
+// the interface table is known.
+func (d *Decoder) decodeCompactColumns(length uint64) ([]Entry, []uint32, error) {
+	r := &fieldReader{r: d.r, n: length}
+	errColumns := errors.New("unexpected length of buffer for number of columns")
+	numColumns, err := readUvarint(r, errColumns)
+	if err != nil {
+		return nil, nil, err
+	}
+	if numColumns > r.n {
+		return nil, nil, malformed(errColumns)
+	}
+	columns := make([]byte, numColumns)
+	if err := d.readFullFrom(r, columns, errColumns); err != nil {
+		return nil, nil, err
+	}
+
+	errEntries := errors.New("unexpected length of buffer for number of entries")
+	numEntries, err := readUvarint(r, errEntries)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Every value takes at least a byte.
+	if numColumns == 0 && numEntries > 0 || numColumns > 0 && numEntries > r.n/numColumns {
+		return nil, nil, malformed(errEntries)
+	}
+	if err := d.checkEntries(numEntries, numColumns); err != nil {
+		return nil, nil, err
+	}
+
+	entries := make([]Entry, 0, min(numEntries, maxInitialEntries))
+	ifindexes := make([]uint32, 0, cap(entries))
+	var srcIP, dstIP uint32
+	for i := uint64(0); i < numEntries; i++ {
+		var entry Entry
+		var ifindex uint32
+		for _, typ := range columns {
+			value, err := readUvarint(r, errEntries)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch typ {
+			case columnSrcIP:
+				if srcIP, err = addIPDelta(srcIP, value); err != nil {
+					return nil, nil, err
+				}
+				entry.SrcIP = srcIP
+			case columnDstIP:
+				if dstIP, err = addIPDelta(dstIP, value); err != nil {
+					return nil, nil, err
+				}
+				entry.DstIP = dstIP
+			case columnSrcPort, columnDstPort:
+				if value > math.MaxUint16 {
+					return nil, nil, malformed(fmt.Errorf("port %d out of range", value))
+				}
+				if typ == columnSrcPort {
+					entry.SrcPort = uint16(value)
+				} else {
+					entry.DstPort = uint16(value)
+				}
+			case columnTraffic:
+				entry.Traffic = value
+			case columnSquaredSizes:
+				entry.SquaredSizes = value
+			case columnIfindex:
+				if value > math.MaxUint32 {
+					return nil, nil, malformed(fmt.Errorf("interface index %d out of range", value))
+				}
+				ifindex = uint32(value)
+			default:
+				// Columns added by later versions of the encoding.
+			}
+		}
+		entries = append(entries, entry)
+		ifindexes = append(ifindexes, ifindex)
+	}
+	if r.n != 0 {
+		return nil, nil, malformed(errEntries)
+	}
+	return entries, ifindexes, nil
+}
+
+// addIPDelta adds the zigzag encoded difference delta to ip.
+func addIPDelta(ip uint32, delta uint64) (uint32, error) {
+	next := int64(ip) + (int64(delta>>1) ^ -int64(delta&1))
+	if next < 0 || next > math.MaxUint32 {
+		return 0, malformed(errors.New("IP out of range"))
+	}
+	return uint32(next), nil
+}
@@ -0,0 +1,162 @@
+package payload
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/polarsignals/kubezonnet/byteorder"
+)
+
+func TestPayloadEncodeDecodeCompact(t *testing.T) {
+	keys := []IPKey{
+		{SrcIP: byteorder.Htonl(0x0a000105), DstIP: byteorder.Htonl(0x0a000203), SrcPort: 80, DstPort: 51234, Ifindex: 2},
+		{SrcIP: byteorder.Htonl(0x0a000101), DstIP: byteorder.Htonl(0x0a000209), SrcPort: 443, DstPort: 40000, Ifindex: 4},
+		{SrcIP: byteorder.Htonl(0x0a000105), DstIP: byteorder.Htonl(0x0a000201), SrcPort: 80, DstPort: 60000, Ifindex: 2},
+		{SrcIP: byteorder.Htonl(0xffffffff), DstIP: 0, SrcPort: 65535, DstPort: 0, Ifindex: 2},
+	}
+	values := []IPValue{
+		{PacketSize: 3, SquaredSizes: 9},
+		{PacketSize: 1 << 40, SquaredSizes: 1 << 63},
+		{PacketSize: 0, SquaredSizes: 0},
+		{PacketSize: 7, SquaredSizes: 49},
+	}
+	metadata := &Metadata{
+		Node:        "node-a",
+		WindowStart: time.Unix(100, 0),
+		WindowEnd:   time.Unix(110, 0),
+		InstanceID:  "instance",
+		Sequence:    3,
+	}
+
+	buf := EncodeWithOptions(keys, values, Options{
+		Version:    Version3,
+		SampleRate: 2,
+		Interfaces: map[uint32]string{2: "eth0"},
+		Metadata:   metadata,
+	})
+	require.Equal(t, []byte{0, 3}, buf[4:6])
+	p, err := DecodePayload(buf)
+	require.NoError(t, err)
+
+	// Entries are decoded sorted by their IPs.
+	require.Equal(t, Payload{
+		SampleRate: 2,
+		Interfaces: true,
+		Metadata:   *metadata,
+		Entries: []Entry{
+			{SrcIP: 0x0a000101, DstIP: 0x0a000209, SrcPort: 443, DstPort: 40000, Traffic: 1 << 40, SquaredSizes: 1 << 63, Interface: "if4"},
+			{SrcIP: 0x0a000105, DstIP: 0x0a000201, SrcPort: 80, DstPort: 60000, Traffic: 0, SquaredSizes: 0, Interface: "eth0"},
+			{SrcIP: 0x0a000105, DstIP: 0x0a000203, SrcPort: 80, DstPort: 51234, Traffic: 3, SquaredSizes: 9, Interface: "eth0"},
+			{SrcIP: 0xffffffff, DstIP: 0, SrcPort: 65535, DstPort: 0, Traffic: 7, SquaredSizes: 49, Interface: "eth0"},
+		},
+	}, p)
+
+	// Without options only the IPs, ports and traffic are encoded.
+	p, err = DecodePayload(EncodeWithOptions(keys[:1], values[:1], Options{Version: Version3}))
+	require.NoError(t, err)
+	require.Equal(t, []Entry{{SrcIP: 0x0a000105, DstIP: 0x0a000203, SrcPort: 80, DstPort: 51234, Traffic: 3}}, p.Entries)
+
+	p, err = DecodePayload(EncodeWithOptions(nil, nil, Options{Version: Version3}))
+	require.NoError(t, err)
+	require.Empty(t, p.Entries)
+
+	var malformed *MalformedError
+	_, err = DecodePayload(buf[:len(buf)-1])
+	require.ErrorAs(t, err, &malformed)
+}
+
+func TestPayloadDecodeCompactUnknownColumns(t *testing.T) {
+	// Two entries with an unknown column between the IPs and the traffic.
+	var entries []byte
+	entries = binary.AppendUvarint(entries, 4)
+	entries = append(entries, columnSrcIP, columnDstIP, 99, columnTraffic)
+	entries = binary.AppendUvarint(entries, 2)
+	entries = binary.AppendVarint(entries, 10)
+	entries = binary.AppendVarint(entries, 20)
+	entries = binary.AppendUvarint(entries, 1<<50)
+	entries = binary.AppendUvarint(entries, 5)
+	entries = binary.AppendVarint(entries, 0)
+	entries = binary.AppendVarint(entries, -2)
+	entries = binary.AppendUvarint(entries, 0)
+	entries = binary.AppendUvarint(entries, 6)
+
+	buf := appendField(append(Magic[:], 0, 3), fieldCompactEntries, entries)
+	p, err := DecodePayload(buf)
+	require.NoError(t, err)
+	require.Equal(t, []Entry{
+		{SrcIP: 10, DstIP: 20, Traffic: 5},
+		{SrcIP: 10, DstIP: 18, Traffic: 6},
+	}, p.Entries)
+
+	// IPs can't leave the range of IPv4 addresses.
+	entries = binary.AppendUvarint(nil, 1)
+	entries = append(entries, columnSrcIP)
+	entries = binary.AppendUvarint(entries, 1)
+	entries = binary.AppendVarint(entries, -1)
+	var malformed *MalformedError
+	_, err = DecodePayload(appendField(append(Magic[:], 0, 3), fieldCompactEntries, entries))
+	require.ErrorAs(t, err, &malformed)
+}
+
+// benchmarkEntries returns entries as a node typically records them: a few
+// local pods talking to many remote pods, mostly on ephemeral ports.
+func benchmarkEntries(n int) ([]IPKey, []IPValue) {
+	rng := rand.New(rand.NewSource(1))
+	keys := make([]IPKey, n)
+	values := make([]IPValue, n)
+	for i := range keys {
+		keys[i] = IPKey{
+			SrcIP:   byteorder.Htonl(0x0a000100 + uint32(rng.Intn(16))),
+			DstIP:   byteorder.Htonl(0x0a000000 + uint32(rng.Intn(1<<16))),
+			SrcPort: []uint16{80, 443, 8080}[rng.Intn(3)],
+			DstPort: uint16(32768 + rng.Intn(28232)),
+			Ifindex: 2,
+		}
+		size := uint64(rng.Intn(1500) + 64)
+		packets := uint64(rng.Intn(100) + 1)
+		values[i] = IPValue{PacketSize: size * packets, SquaredSizes: size * size * packets}
+	}
+	return keys, values
+}
+
+var benchmarkVersions = []struct {
+	name    string
+	version int
+}{
+	{"legacy", VersionLegacy},
+	{"version 2", Version2},
+	{"version 3", Version3},
+}
+
+func BenchmarkEncode(b *testing.B) {
+	keys, values := benchmarkEntries(10000)
+	for _, v := range benchmarkVersions {
+		b.Run(v.name, func(b *testing.B) {
+			opts := Options{Version: v.version, SampleRate: 2, Interfaces: map[uint32]string{2: "eth0"}}
+			var buf []byte
+			for i := 0; i < b.N; i++ {
+				buf = EncodeWithOptions(keys, values, opts)
+			}
+			b.ReportMetric(float64(len(buf))/float64(len(keys)), "bytes/entry")
+		})
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	keys, values := benchmarkEntries(10000)
+	for _, v := range benchmarkVersions {
+		b.Run(v.name, func(b *testing.B) {
+			buf := EncodeWithOptions(keys, values, Options{Version: v.version, SampleRate: 2, Interfaces: map[uint32]string{2: "eth0"}})
+			b.SetBytes(int64(len(buf)))
+			for i := 0; i < b.N; i++ {
+				if _, err := DecodePayload(buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
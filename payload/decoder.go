@@ -0,0 +1,403 @@
+package payload
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/polarsignals/kubezonnet/byteorder"
+)
+
+// Limits bound the resources used to decode a payload. Zero values don't
+// limit anything.
+type Limits struct {
+	// MaxBytes is the maximum size of an encoded payload.
+	MaxBytes int64
+	// MaxEntries is the maximum number of entries of a payload.
+	MaxEntries int
+}
+
+// TooLargeError is returned if a payload exceeds the Limits of a Decoder.
+type TooLargeError struct {
+	// Limit is the exceeded limit, "bytes" or "entries".
+	Limit string
+	Max   int64
+}
+
+func (e *TooLargeError) Error() string {
+	return fmt.Sprintf("payload exceeds the limit of %d %s", e.Max, e.Limit)
+}
+
+// MalformedError is returned if a payload isn't encoded correctly.
+type MalformedError struct {
+	Err error
+}
+
+func (e *MalformedError) Error() string {
+	return "malformed payload: " + e.Err.Error()
+}
+
+func (e *MalformedError) Unwrap() error {
+	return e.Err
+}
+
+// maxInitialEntries caps the capacity allocated for entries up front, so
+// that a payload claiming more entries than it contains doesn't allocate
+// memory for them.
+const maxInitialEntries = 4096
+
+// Decoder decodes a payload of any version from a reader, reading one entry
+// at a time rather than the whole payload into memory.
+type Decoder struct {
+	r      *bufio.Reader
+	limits Limits
+}
+
+// NewDecoder returns a decoder reading from r within limits.
+func NewDecoder(r io.Reader, limits Limits) *Decoder {
+	return &Decoder{
+		r:      bufio.NewReader(&limitReader{r: r, max: limits.MaxBytes}),
+		limits: limits,
+	}
+}
+
+// Decode decodes the payload. Errors are a TooLargeError if the payload
+// exceeds the limits, a MalformedError if it isn't encoded correctly, or the
+// error of the reader.
+func (d *Decoder) Decode() (Payload, error) {
+	magic, err := d.r.Peek(len(Magic))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return Payload{}, err
+	}
+	if isVersioned(magic) {
+		return d.decodeVersioned()
+	}
+	return d.decodeLegacy()
+}
+
+func (d *Decoder) decodeLegacy() (Payload, error) {
+	var header [4]byte
+	if err := d.readFull(header[:], errUnexpectedLength); err != nil {
+		return Payload{}, err
+	}
+	numEntries := binary.BigEndian.Uint32(header[:])
+
+	entrySize := 20 // 2 uint32s, 2 uint16s, and 1 uint64 per entry in the data.
+	if err := d.checkEntries(uint64(numEntries), uint64(entrySize)); err != nil {
+		return Payload{}, err
+	}
+
+	errEntries := errors.New("unexpected length of buffer for number of entries")
+	var p Payload
+	p.Entries = make([]Entry, 0, min(numEntries, maxInitialEntries))
+	buf := make([]byte, entrySize)
+	for i := uint32(0); i < numEntries; i++ {
+		if err := d.readFull(buf, errEntries); err != nil {
+			return Payload{}, err
+		}
+		p.Entries = append(p.Entries, Entry{
+			SrcIP:   byteorder.Ntohl(binary.BigEndian.Uint32(buf[0:4])),
+			DstIP:   byteorder.Ntohl(binary.BigEndian.Uint32(buf[4:8])),
+			SrcPort: binary.BigEndian.Uint16(buf[8:10]),
+			DstPort: binary.BigEndian.Uint16(buf[10:12]),
+			Traffic: binary.BigEndian.Uint64(buf[12:20]),
+		})
+	}
+
+	if err := d.expectEOF(errEntries); err != nil {
+		return Payload{}, err
+	}
+	return p, nil
+}
+
+// decodeVersioned decodes a payload starting with Magic.
+func (d *Decoder) decodeVersioned() (Payload, error) {
+	var header [6]byte
+	if err := d.readFull(header[:], errUnexpectedLength); err != nil {
+		return Payload{}, err
+	}
+	if version := binary.BigEndian.Uint16(header[4:6]); version != Version2 && version != Version3 {
+		return Payload{}, malformed(fmt.Errorf("unsupported payload version %d", version))
+	}
+
+	var p Payload
+	var interfaces map[uint32]string
+	var ifindexes []uint32
+	for {
+		typ, err := d.r.ReadByte()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return Payload{}, err
+		}
+		length, err := readUvarint(d.r, fmt.Errorf("unexpected length of field %d", typ))
+		if err != nil {
+			return Payload{}, err
+		}
+
+		if typ == fieldEntries || typ == fieldCompactEntries {
+			decode := d.decodeColumns
+			if typ == fieldCompactEntries {
+				decode = d.decodeCompactColumns
+			}
+			p.Entries, ifindexes, err = decode(length)
+			if err != nil {
+				return Payload{}, err
+			}
+			continue
+		}
+
+		data, err := io.ReadAll(&fieldReader{r: d.r, n: length})
+		if err != nil {
+			return Payload{}, err
+		}
+		if uint64(len(data)) != length {
+			return Payload{}, malformed(fmt.Errorf("unexpected length of field %d", typ))
+		}
+		switch typ {
+		case fieldSampleRate:
+			if len(data) != 4 {
+				return Payload{}, malformed(errors.New("unexpected length of sample rate"))
+			}
+			p.SampleRate = binary.BigEndian.Uint32(data)
+		case fieldInterfaces:
+			p.Interfaces = true
+			interfaces, err = decodeInterfaces(data)
+		case fieldMetadata:
+			p.Metadata, err = decodeMetadata(data)
+		default:
+			// Fields added by later versions of the encoding.
+		}
+		if err != nil {
+			return Payload{}, malformed(err)
+		}
+	}
+	if p.SampleRate <= 1 {
+		p.SampleRate = 0
+	}
+
+	if p.Interfaces {
+		resolveInterfaces(p.Entries, ifindexes, interfaces)
+	}
+	return p, nil
+}
+
+// decodeColumns decodes the entries field of the given length. The interface
+// indexes are returned separately, to be resolved once the interface table
+// is known.
+func (d *Decoder) decodeColumns(length uint64) ([]Entry, []uint32, error) {
+	r := &fieldReader{r: d.r, n: length}
+	errColumns := errors.New("unexpected length of buffer for number of columns")
+	numColumns, err := readUvarint(r, errColumns)
+	if err != nil {
+		return nil, nil, err
+	}
+	if numColumns > r.n/2 {
+		return nil, nil, malformed(errColumns)
+	}
+	columns := make([]column, numColumns)
+	entrySize := 0
+	for i := range columns {
+		var buf [2]byte
+		if err := d.readFullFrom(r, buf[:], errColumns); err != nil {
+			return nil, nil, err
+		}
+		columns[i] = column{typ: buf[0], size: buf[1]}
+		entrySize += int(columns[i].size)
+		if err := checkColumnSize(columns[i]); err != nil {
+			return nil, nil, malformed(err)
+		}
+	}
+
+	errEntries := errors.New("unexpected length of buffer for number of entries")
+	numEntries, err := readUvarint(r, errUnexpectedLength)
+	if err != nil {
+		return nil, nil, err
+	}
+	if entrySize == 0 && numEntries > 0 || numEntries > r.n || r.n != numEntries*uint64(entrySize) {
+		return nil, nil, malformed(errEntries)
+	}
+	if err := d.checkEntries(numEntries, uint64(entrySize)); err != nil {
+		return nil, nil, err
+	}
+
+	entries := make([]Entry, 0, min(numEntries, maxInitialEntries))
+	ifindexes := make([]uint32, 0, cap(entries))
+	buf := make([]byte, entrySize)
+	for i := uint64(0); i < numEntries; i++ {
+		if err := d.readFullFrom(r, buf, errEntries); err != nil {
+			return nil, nil, err
+		}
+		var entry Entry
+		var ifindex uint32
+		values := buf
+		for _, c := range columns {
+			value := values[:c.size]
+			values = values[c.size:]
+			switch c.typ {
+			case columnSrcIP:
+				entry.SrcIP = binary.BigEndian.Uint32(value)
+			case columnDstIP:
+				entry.DstIP = binary.BigEndian.Uint32(value)
+			case columnSrcPort:
+				entry.SrcPort = binary.BigEndian.Uint16(value)
+			case columnDstPort:
+				entry.DstPort = binary.BigEndian.Uint16(value)
+			case columnTraffic:
+				entry.Traffic = binary.BigEndian.Uint64(value)
+			case columnSquaredSizes:
+				entry.SquaredSizes = binary.BigEndian.Uint64(value)
+			case columnIfindex:
+				ifindex = binary.BigEndian.Uint32(value)
+			default:
+				// Columns added by later versions of the encoding.
+			}
+		}
+		entries = append(entries, entry)
+		ifindexes = append(ifindexes, ifindex)
+	}
+	return entries, ifindexes, nil
+}
+
+// checkEntries checks the number of entries a payload claims against the
+// limits, before they are read.
+func (d *Decoder) checkEntries(numEntries, entrySize uint64) error {
+	if d.limits.MaxEntries > 0 && numEntries > uint64(d.limits.MaxEntries) {
+		return &TooLargeError{Limit: "entries", Max: int64(d.limits.MaxEntries)}
+	}
+	if d.limits.MaxBytes > 0 && numEntries*entrySize > uint64(d.limits.MaxBytes) {
+		return &TooLargeError{Limit: "bytes", Max: d.limits.MaxBytes}
+	}
+	return nil
+}
+
+func (d *Decoder) readFull(buf []byte, errShort error) error {
+	return d.readFullFrom(d.r, buf, errShort)
+}
+
+// readFullFrom fills buf from r, failing with errShort as a MalformedError
+// if the payload ends before.
+func (d *Decoder) readFullFrom(r io.Reader, buf []byte, errShort error) error {
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return readError(err, errShort)
+	}
+	return nil
+}
+
+// readUvarint reads a uvarint like binary.ReadUvarint, failing with errShort
+// as a MalformedError if the payload ends before or it overflows.
+func readUvarint(r io.ByteReader, errShort error) (uint64, error) {
+	var x uint64
+	for shift := 0; ; shift += 7 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, readError(err, errShort)
+		}
+		if shift == 63 && b > 1 {
+			return 0, malformed(errShort)
+		}
+		if b < 0x80 {
+			return x | uint64(b)<<shift, nil
+		}
+		x |= uint64(b&0x7f) << shift
+	}
+}
+
+// readError turns the end of the payload into a MalformedError with errShort
+// and passes other errors of the reader on.
+func readError(err, errShort error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return malformed(errShort)
+	}
+	return err
+}
+
+// expectEOF checks that the payload ends, failing with errTrailing as a
+// MalformedError otherwise.
+func (d *Decoder) expectEOF(errTrailing error) error {
+	_, err := d.r.ReadByte()
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return malformed(errTrailing)
+}
+
+func malformed(err error) error {
+	return &MalformedError{Err: err}
+}
+
+// resolveInterfaces sets the interface names of entries from their interface
+// indexes. Indexes missing in interfaces are named "if<index>".
+func resolveInterfaces(entries []Entry, ifindexes []uint32, interfaces map[uint32]string) {
+	for i, ifindex := range ifindexes {
+		name, found := interfaces[ifindex]
+		if !found && ifindex != 0 {
+			name = "if" + strconv.FormatUint(uint64(ifindex), 10)
+		}
+		entries[i].Interface = name
+	}
+}
+
+// fieldReader reads the n bytes of a field.
+type fieldReader struct {
+	r *bufio.Reader
+	n uint64
+}
+
+func (f *fieldReader) Read(p []byte) (int, error) {
+	if f.n == 0 {
+		return 0, io.EOF
+	}
+	if uint64(len(p)) > f.n {
+		p = p[:f.n]
+	}
+	n, err := f.r.Read(p)
+	f.n -= uint64(n)
+	return n, err
+}
+
+func (f *fieldReader) ReadByte() (byte, error) {
+	if f.n == 0 {
+		return 0, io.EOF
+	}
+	b, err := f.r.ReadByte()
+	if err == nil {
+		f.n--
+	}
+	return b, err
+}
+
+// limitReader fails with a TooLargeError once more than max bytes were read,
+// if max is greater than 0.
+type limitReader struct {
+	r    io.Reader
+	read int64
+	max  int64
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.max <= 0 {
+		return l.r.Read(p)
+	}
+	if l.read > l.max {
+		return 0, &TooLargeError{Limit: "bytes", Max: l.max}
+	}
+	// Reading one byte more than allowed tells a payload at the limit from
+	// one exceeding it.
+	if remaining := l.max - l.read + 1; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	if l.read > l.max {
+		return n, &TooLargeError{Limit: "bytes", Max: l.max}
+	}
+	return n, err
+}
@@ -0,0 +1,88 @@
+package payload
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/polarsignals/kubezonnet/byteorder"
+)
+
+func TestDecoderLimits(t *testing.T) {
+	keys := make([]IPKey, 10)
+	values := make([]IPValue, 10)
+	for i := range keys {
+		keys[i] = IPKey{SrcIP: byteorder.Htonl(uint32(i)), DstIP: byteorder.Htonl(2), SrcPort: 80, DstPort: 443, Ifindex: 2}
+		values[i] = IPValue{PacketSize: 100}
+	}
+
+	for name, opts := range map[string]Options{
+		"legacy":    {},
+		"version 2": {Version: Version2, Interfaces: map[uint32]string{2: "eth0"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			buf := EncodeWithOptions(keys, values, opts)
+			decode := func(limits Limits) (Payload, error) {
+				return NewDecoder(bytes.NewReader(buf), limits).Decode()
+			}
+
+			// Payloads at the limits are decoded.
+			p, err := decode(Limits{MaxBytes: int64(len(buf)), MaxEntries: len(keys)})
+			require.NoError(t, err)
+			require.Len(t, p.Entries, len(keys))
+
+			var tooLarge *TooLargeError
+			_, err = decode(Limits{MaxEntries: len(keys) - 1})
+			require.ErrorAs(t, err, &tooLarge)
+			require.Equal(t, "entries", tooLarge.Limit)
+
+			_, err = decode(Limits{MaxBytes: int64(len(buf)) - 1})
+			require.ErrorAs(t, err, &tooLarge)
+			require.Equal(t, "bytes", tooLarge.Limit)
+
+			var malformed *MalformedError
+			_, err = decode(Limits{})
+			require.NoError(t, err)
+			buf = buf[:len(buf)-1]
+			_, err = decode(Limits{})
+			require.ErrorAs(t, err, &malformed)
+		})
+	}
+}
+
+func TestDecoderRejectsClaimedEntries(t *testing.T) {
+	// A legacy payload claiming a billion entries without containing them
+	// is rejected by the byte limit before any are read.
+	buf := []byte{0x3b, 0x9a, 0xca, 0x00}
+	var tooLarge *TooLargeError
+	_, err := NewDecoder(bytes.NewReader(buf), Limits{MaxBytes: 1 << 20}).Decode()
+	require.ErrorAs(t, err, &tooLarge)
+
+	// Without limits it fails as soon as the entries run out.
+	var malformed *MalformedError
+	_, err = NewDecoder(bytes.NewReader(buf), Limits{}).Decode()
+	require.ErrorAs(t, err, &malformed)
+
+	// Versioned entry fields must match the size of the entries.
+	buf = append(Magic[:], 0, 2, fieldEntries, 0xff, 0xff, 0xff, 0xff, 0x0f, 1, columnSrcIP, 4, 0xff, 0xff, 0xff, 0xff, 0x0f)
+	_, err = NewDecoder(bytes.NewReader(buf), Limits{}).Decode()
+	require.ErrorAs(t, err, &malformed)
+	buf = append(Magic[:], 0, 2, fieldEntries, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01)
+	_, err = NewDecoder(bytes.NewReader(buf), Limits{}).Decode()
+	require.ErrorAs(t, err, &malformed)
+}
+
+func TestDecoderReaderErrors(t *testing.T) {
+	errRead := errors.New("connection reset")
+	buf := Encode([]IPKey{{SrcIP: 1}}, []IPValue{{PacketSize: 1}})
+	r := io.MultiReader(bytes.NewReader(buf[:10]), iotest.ErrReader(errRead))
+
+	_, err := NewDecoder(r, Limits{}).Decode()
+	require.ErrorIs(t, err, errRead)
+	var malformed *MalformedError
+	require.False(t, errors.As(err, &malformed))
+}
@@ -1,39 +1,124 @@
 package payload
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"time"
+)
 
-	"github.com/polarsignals/kubezonnet/byteorder"
+// Aggregation modes describe how agents collapsed the ports of entries before
+// sending them. A collapsed port is sent as 0.
+const (
+	// AggregationFull keeps both ports.
+	AggregationFull = "full"
+	// AggregationServerPort keeps only the port of the serving side and
+	// collapses the ephemeral port of the client side.
+	AggregationServerPort = "server-port"
+	// AggregationIPPair collapses both ports.
+	AggregationIPPair = "ip-pair"
 )
 
+// AggregationHeader is the HTTP header agents use to tell the server which
+// aggregation mode a payload was produced with.
+const AggregationHeader = "X-Kubezonnet-Aggregation"
+
 // Key for the eBPF map representing IP pairs
 type IPKey struct {
-	SrcIP    uint32
-	DstIP    uint32
-	SrcPort  uint16
-	DstPort  uint16
+	SrcIP   uint32
+	DstIP   uint32
+	SrcPort uint16
+	DstPort uint16
+	// Ifindex is the index of the interface the traffic left the node on.
+	Ifindex uint32
 }
 
 // Value for the eBPF map representing total packet sizes
 type IPValue struct {
 	PacketSize uint64
+	// SquaredSizes is the sum of the squared sizes of the sampled packets,
+	// only recorded when sampling.
+	SquaredSizes uint64
 }
 
+// Options enable optional parts of the encoding. Except for the Version, they
+// are only encoded with Version2 and later.
+type Options struct {
+	// SampleRate is N if 1 in N packets was captured, with the packet sizes
+	// of the values already scaled up by N. 0 and 1 mean that all packets
+	// were captured.
+	SampleRate uint32
+	// Interfaces maps the interface indexes of keys to interface names. If
+	// set, the interface of every entry is encoded.
+	Interfaces map[uint32]string
+	// Version is the version of the encoding, VersionLegacy if 0. Servers
+	// that predate Version2 can only decode VersionLegacy, and servers that
+	// predate Version3 can't decode it.
+	Version int
+	// Metadata describes the agent and the window the entries were
+	// collected in. It is only encoded with Version2 and later.
+	Metadata *Metadata
+}
+
+// Metadata describes the agent that sent a payload. Fields are empty if the
+// agent didn't send them.
+type Metadata struct {
+	// Node is the name of the node the agent is running on.
+	Node string
+	// AgentVersion is the version of the agent.
+	AgentVersion string
+	// CaptureMode describes how the agent captures traffic.
+	CaptureMode string
+	// WindowStart and WindowEnd are the times between which the entries
+	// were collected.
+	WindowStart time.Time
+	WindowEnd   time.Time
+	// InstanceID identifies the agent process, it changes when the agent
+	// restarts.
+	InstanceID string
+	// Sequence numbers the payloads of an agent process starting at 1, a
+	// payload that is sent again keeps its number. 0 if not numbered.
+	Sequence uint64
+}
+
+// The legacy encoding starts with the number of entries, followed by 20 bytes
+// per entry. It has no room for optional fields, which are only encoded with
+// Version2 and later:
+//
+//	uint32 number of entries
+//	entries:
+//	  uint32 source IP
+//	  uint32 destination IP
+//	  uint16 source port
+//	  uint16 destination port
+//	  uint64 traffic
+
+// Encode encodes entries without any of the optional fields.
 func Encode(keys []IPKey, values []IPValue) []byte {
-	size := 4 + 20*len(keys) // The first 4 bytes encode the length, then 2 uint32s, 2 uint16s, and 1 uint64 per entry in the data.
-	buf := make([]byte, size)
+	return EncodeWithOptions(keys, values, Options{})
+}
 
+// EncodeWithOptions encodes entries with the version of the options. The
+// legacy encoding leaves out all other options, callers that need them must
+// use Version2 or later.
+func EncodeWithOptions(keys []IPKey, values []IPValue, opts Options) []byte {
+	if opts.Version == Version2 || opts.Version == Version3 {
+		return encodeVersioned(keys, values, opts)
+	}
+
+	headerSize := 4 // The first 4 bytes encode the length
+	entrySize := 20 // 2 uint32s, 2 uint16s, and 1 uint64 per entry in the data.
+	buf := make([]byte, headerSize+entrySize*len(keys))
 	binary.BigEndian.PutUint32(buf[:4], uint32(len(keys)))
-	offset := 4
 
+	offset := headerSize
 	for i, srcDst := range keys {
 		binary.BigEndian.PutUint32(buf[offset:offset+4], srcDst.SrcIP)
 		binary.BigEndian.PutUint32(buf[offset+4:offset+8], srcDst.DstIP)
 		binary.BigEndian.PutUint16(buf[offset+8:offset+10], srcDst.SrcPort)
 		binary.BigEndian.PutUint16(buf[offset+10:offset+12], srcDst.DstPort)
 		binary.BigEndian.PutUint64(buf[offset+12:offset+20], values[i].PacketSize)
-		offset += 20
+		offset += entrySize
 	}
 
 	return buf
@@ -45,35 +130,67 @@ type Entry struct {
 	SrcPort uint16
 	DstPort uint16
 	Traffic uint64
+	// SquaredSizes is the sum of the squared sizes of the sampled packets,
+	// only set for sampled payloads.
+	SquaredSizes uint64
+	// Interface is the name of the interface the traffic left the node on,
+	// only set if the agent recorded interfaces.
+	Interface string
+}
+
+// Payload is a decoded payload.
+type Payload struct {
+	// SampleRate is N if 1 in N packets was captured and Traffic is an
+	// estimate, 0 if all packets were captured.
+	SampleRate uint32
+	// Interfaces is true if the agent recorded the interface of entries.
+	Interfaces bool
+	// Metadata is only set by agents using Version2 and later.
+	Metadata Metadata
+	Entries  []Entry
 }
 
+// Decode decodes the entries of a payload.
 func Decode(buf []byte) ([]Entry, error) {
-	if len(buf) < 4 {
-		return nil, errors.New("unexpected length of buffer")
+	p, err := DecodePayload(buf)
+	if err != nil {
+		return nil, err
 	}
-	numEntries := binary.BigEndian.Uint32(buf[:4])
+	return p.Entries, nil
+}
 
-	size := 4 + 20*numEntries // The first 4 bytes encode the length, then 2 uint32s, 2 uint16s, and 1 uint64 per entry in the data.
-	if uint32(len(buf)) != size {
-		return nil, errors.New("unexpected length of buffer for number of entries")
+var errUnexpectedLength = errors.New("unexpected length of buffer")
+
+// DecodePayload decodes a payload of any version including its optional
+// fields.
+func DecodePayload(buf []byte) (Payload, error) {
+	return NewDecoder(bytes.NewReader(buf), Limits{}).Decode()
+}
+
+func decodeInterfaces(buf []byte) (map[uint32]string, error) {
+	if len(buf) < 4 {
+		return nil, errUnexpectedLength
 	}
+	n := binary.BigEndian.Uint32(buf[:4])
+	buf = buf[4:]
 
-	entries := make([]Entry, numEntries)
-	for i := uint32(0); i < numEntries; i++ {
-		offset := 4 + i*20
-		srcIP := binary.BigEndian.Uint32(buf[offset : offset+4])
-		dstIP := binary.BigEndian.Uint32(buf[offset+4 : offset+8])
-		srcPort := binary.BigEndian.Uint16(buf[offset+8 : offset+10])
-		dstPort := binary.BigEndian.Uint16(buf[offset+10 : offset+12])
-		traffic := binary.BigEndian.Uint64(buf[offset+12 : offset+20])
-		entries[i] = Entry{
-			SrcIP:   byteorder.Ntohl(srcIP),
-			DstIP:   byteorder.Ntohl(dstIP),
-			SrcPort: srcPort,
-			DstPort: dstPort,
-			Traffic: traffic,
+	interfaces := make(map[uint32]string, min(n, uint32(len(buf)/6)))
+	for i := uint32(0); i < n; i++ {
+		if len(buf) < 6 {
+			return nil, errors.New("unexpected length of buffer for number of interfaces")
+		}
+		ifindex := binary.BigEndian.Uint32(buf[:4])
+		nameLen := int(binary.BigEndian.Uint16(buf[4:6]))
+		buf = buf[6:]
+		if len(buf) < nameLen {
+			return nil, errors.New("unexpected length of buffer for interface name")
 		}
+		interfaces[ifindex] = string(buf[:nameLen])
+		buf = buf[nameLen:]
+	}
+	if len(buf) != 0 {
+		return nil, errors.New("unexpected trailing data after interfaces")
 	}
 
-	return entries, nil
+	return interfaces, nil
 }
@@ -1,7 +1,9 @@
 package payload
 
 import (
+	"encoding/binary"
 	"testing"
+	"time"
 
 	"github.com/polarsignals/kubezonnet/byteorder"
 	"github.com/stretchr/testify/require"
@@ -35,3 +37,115 @@ func TestPayloadEncodeDecode(t *testing.T) {
 	require.Equal(t, expectedKeys, resKeys)
 	require.Equal(t, expectedValues, resValues)
 }
+
+func TestPayloadEncodeLegacyOptions(t *testing.T) {
+	keys := []IPKey{
+		{SrcIP: byteorder.Htonl(1), DstIP: byteorder.Htonl(2), SrcPort: 80, DstPort: 443, Ifindex: 2},
+	}
+	values := []IPValue{{PacketSize: 3000, SquaredSizes: 2 * 1500 * 1500}}
+
+	// The legacy encoding has no room for optional fields, servers that
+	// predate them would misread the payload.
+	buf := EncodeWithOptions(keys, values, Options{SampleRate: 100, Interfaces: map[uint32]string{2: "eth0"}})
+	require.Equal(t, Encode(keys, values), buf)
+	p, err := DecodePayload(buf)
+	require.NoError(t, err)
+	require.Equal(t, Payload{
+		Entries: []Entry{{SrcIP: 1, DstIP: 2, SrcPort: 80, DstPort: 443, Traffic: 3000}},
+	}, p)
+
+	// A number of entries with the highest bit set isn't an extension.
+	binary.BigEndian.PutUint32(buf[:4], 1<<31|1)
+	_, err = DecodePayload(buf)
+	var malformedErr *MalformedError
+	require.ErrorAs(t, err, &malformedErr)
+}
+
+func TestPayloadEncodeDecodeVersioned(t *testing.T) {
+	keys := []IPKey{
+		{SrcIP: byteorder.Htonl(1), DstIP: byteorder.Htonl(2), SrcPort: 80, DstPort: 443, Ifindex: 2},
+		{SrcIP: byteorder.Htonl(1), DstIP: byteorder.Htonl(3), SrcPort: 80, DstPort: 443, Ifindex: 4},
+	}
+	values := []IPValue{{PacketSize: 3, SquaredSizes: 9}, {PacketSize: 1, SquaredSizes: 1}}
+
+	buf := EncodeWithOptions(keys, values, Options{Version: Version2})
+	require.Equal(t, Magic[:], buf[:4])
+	p, err := DecodePayload(buf)
+	require.NoError(t, err)
+	require.Equal(t, Payload{
+		Entries: []Entry{
+			{SrcIP: 1, DstIP: 2, SrcPort: 80, DstPort: 443, Traffic: 3},
+			{SrcIP: 1, DstIP: 3, SrcPort: 80, DstPort: 443, Traffic: 1},
+		},
+	}, p)
+
+	p, err = DecodePayload(EncodeWithOptions(keys, values, Options{
+		Version:    Version2,
+		SampleRate: 2,
+		Interfaces: map[uint32]string{2: "eth0"},
+	}))
+	require.NoError(t, err)
+	require.Equal(t, Payload{
+		SampleRate: 2,
+		Interfaces: true,
+		Entries: []Entry{
+			{SrcIP: 1, DstIP: 2, SrcPort: 80, DstPort: 443, Traffic: 3, SquaredSizes: 9, Interface: "eth0"},
+			{SrcIP: 1, DstIP: 3, SrcPort: 80, DstPort: 443, Traffic: 1, SquaredSizes: 1, Interface: "if4"},
+		},
+	}, p)
+
+	// The legacy encoding is still decoded.
+	entries, err := Decode(Encode(keys, values))
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+
+	_, err = DecodePayload([]byte{'K', 'Z', 'N', 'P', 0, 4})
+	require.ErrorContains(t, err, "unsupported payload version 4")
+	_, err = DecodePayload(buf[:len(buf)-1])
+	require.Error(t, err)
+}
+
+func TestPayloadDecodeVersionedUnknownFields(t *testing.T) {
+	// A payload of a later version of the encoding, with an unknown field
+	// and an unknown column between the known ones.
+	buf := append(Magic[:], 0, 2)
+	buf = append(buf, 99, 3, 'n', 'e', 'w')
+	buf = append(buf, fieldEntries, 1+2*3+1+2*(4+1+8))
+	buf = append(buf, 3, columnSrcIP, 4, 42, 1, columnTraffic, 8)
+	buf = append(buf, 2)
+	buf = append(buf, 0, 0, 0, 1, 0xff, 0, 0, 0, 0, 0, 0, 0, 10)
+	buf = append(buf, 0, 0, 0, 2, 0xff, 0, 0, 0, 0, 0, 0, 0, 20)
+
+	p, err := DecodePayload(buf)
+	require.NoError(t, err)
+	require.Equal(t, Payload{Entries: []Entry{{SrcIP: 1, Traffic: 10}, {SrcIP: 2, Traffic: 20}}}, p)
+
+	// Known columns must have the size of their type.
+	buf[len(buf)-2*13-2] = 4
+	_, err = DecodePayload(buf)
+	require.Error(t, err)
+}
+
+func TestPayloadEncodeDecodeMetadata(t *testing.T) {
+	keys := []IPKey{{SrcIP: byteorder.Htonl(1), DstIP: byteorder.Htonl(2), SrcPort: 80, DstPort: 443}}
+	values := []IPValue{{PacketSize: 3}}
+	metadata := Metadata{
+		Node:         "node-a",
+		AgentVersion: "0.3.0",
+		CaptureMode:  "cilium/netfilter",
+		WindowStart:  time.Unix(1700000000, 0),
+		WindowEnd:    time.Unix(1700000010, 500),
+		InstanceID:   "4e7a1c",
+		Sequence:     42,
+	}
+
+	p, err := DecodePayload(EncodeWithOptions(keys, values, Options{Version: Version2, Metadata: &metadata}))
+	require.NoError(t, err)
+	require.Equal(t, metadata, p.Metadata)
+	require.Len(t, p.Entries, 1)
+
+	// The legacy encoding doesn't carry metadata.
+	p, err = DecodePayload(EncodeWithOptions(keys, values, Options{Metadata: &metadata}))
+	require.NoError(t, err)
+	require.Equal(t, Metadata{}, p.Metadata)
+}
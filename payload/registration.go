@@ -0,0 +1,73 @@
+package payload
+
+// Versions are the versions of the encoding this package encodes and decodes,
+// oldest first.
+var Versions = []int{VersionLegacy, Version2, Version3}
+
+// CompressionGzip compresses payloads with gzip, announced with the
+// Content-Encoding header.
+const CompressionGzip = "gzip"
+
+// RegistrationPath is where agents register, relative to the URL they send
+// payloads to. Servers that predate registration respond with 404 Not Found.
+const RegistrationPath = "register"
+
+// ConfigPath is where agents fetch the AgentConfig, relative to the URL they
+// send payloads to. If the revision query parameter is the current revision,
+// the request waits for the configuration to change, and is answered with 304
+// Not Modified if it didn't.
+const ConfigPath = "agent-config"
+
+// Registration is sent by an agent to a server to announce itself and its
+// capabilities before sending payloads.
+type Registration struct {
+	// Node is the name of the node the agent is running on.
+	Node string `json:"node"`
+	// InstanceID identifies the agent process, it changes when the agent
+	// restarts.
+	InstanceID string `json:"instanceID"`
+	// AgentVersion is the version of the agent.
+	AgentVersion string `json:"agentVersion,omitempty"`
+	// KernelRelease is the release of the node's kernel, such as
+	// "6.8.0-1015-gcp".
+	KernelRelease string `json:"kernelRelease,omitempty"`
+	// CaptureMode describes how the agent captures traffic.
+	CaptureMode string `json:"captureMode,omitempty"`
+	// PayloadVersions are the versions of the encoding the agent can send.
+	PayloadVersions []int `json:"payloadVersions,omitempty"`
+	// Compressions are the compressions the agent can send payloads with.
+	Compressions []string `json:"compressions,omitempty"`
+}
+
+// RegistrationResponse holds the settings the server asks an agent to use.
+type RegistrationResponse struct {
+	// PayloadVersion is the version of the encoding to send payloads with,
+	// one of the versions the agent announced.
+	PayloadVersion int `json:"payloadVersion,omitempty"`
+	// Compression is the compression to send payloads with, one of the
+	// compressions the agent announced, uncompressed if empty.
+	Compression string `json:"compression,omitempty"`
+	// Config is the configuration the server holds for all agents, which
+	// agents keep up to date from ConfigPath.
+	Config *AgentConfig `json:"config,omitempty"`
+}
+
+// AgentConfig is the configuration a server holds centrally for all agents.
+// Its settings take precedence over the agent's own, empty ones keep them.
+type AgentConfig struct {
+	// Revision identifies the configuration, it changes whenever any of
+	// the settings do.
+	Revision string `json:"revision,omitempty"`
+	// SubnetCIDRs are the IPv4 CIDRs to monitor.
+	SubnetCIDRs []string `json:"subnetCIDRs,omitempty"`
+	// ExcludeCIDRs are IPv4 CIDRs that are never recorded.
+	ExcludeCIDRs []string `json:"excludeCIDRs,omitempty"`
+	// Aggregation is how ports are aggregated, one of the aggregation
+	// modes.
+	Aggregation string `json:"aggregation,omitempty"`
+	// SampleRate only captures 1 in SampleRate packets, if greater than 1.
+	SampleRate uint32 `json:"sampleRate,omitempty"`
+	// FlushInterval is the interval at which to send data, as a duration
+	// such as "30s".
+	FlushInterval string `json:"flushInterval,omitempty"`
+}
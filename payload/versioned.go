@@ -0,0 +1,296 @@
+package payload
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/polarsignals/kubezonnet/byteorder"
+)
+
+// Versions of the encoding.
+const (
+	// VersionLegacy is the unversioned encoding starting with the number of
+	// entries, which all servers can decode as long as no Options are used.
+	VersionLegacy = 1
+	// Version2 starts with Magic and a version, followed by typed fields
+	// that decoders skip if they don't know them. Entries are encoded as
+	// columns described by their type and size, so that columns can be
+	// added without breaking decoders either.
+	Version2 = 2
+	// Version3 is Version2 with compact entries, which are sorted, with IPs
+	// encoded as differences to the previous entry and all values as
+	// varints. It is smaller for entries sharing IPs and with small values,
+	// at the cost of sorting them.
+	Version3 = 3
+)
+
+// Magic starts every versioned payload. As the legacy encoding starts with
+// the number of entries, it would only collide with a legacy payload of more
+// than a billion entries.
+var Magic = [4]byte{'K', 'Z', 'N', 'P'}
+
+// The versioned encoding:
+//
+//	[4]byte Magic
+//	uint16  version
+//	fields:
+//	  uint8   field type
+//	  uvarint length of data
+//	  data
+//
+// Fields:
+//
+//	fieldSampleRate: uint32 sample rate
+//	fieldInterfaces: the interface table of the legacy encoding
+//	fieldMetadata: fields of the Metadata, with the same layout
+//	fieldEntries:
+//	  uvarint number of columns
+//	  columns:
+//	    uint8 column type
+//	    uint8 size of values
+//	  uvarint number of entries
+//	  entries: the values of all columns, in the order of the columns
+//	fieldCompactEntries: instead of fieldEntries with Version3
+//	  uvarint number of columns
+//	  columns:
+//	    uint8 column type
+//	  uvarint number of entries
+//	  entries: a uvarint for every column, IP columns as the zigzag
+//	           encoded difference to the IP of the previous entry
+//
+// Integers are big endian, IPs in host byte order, strings UTF-8 and times
+// int64 nanoseconds since the Unix epoch.
+const (
+	fieldSampleRate = 1
+	fieldInterfaces = 2
+	fieldEntries    = 3
+	fieldMetadata   = 4
+	// fieldCompactEntries is a separate field rather than a column layout
+	// of fieldEntries, so that servers predating it don't mistake its
+	// entries for fixed width ones.
+	fieldCompactEntries = 5
+)
+
+const (
+	metadataNode         = 1
+	metadataAgentVersion = 2
+	metadataCaptureMode  = 3
+	metadataWindowStart  = 4
+	metadataWindowEnd    = 5
+	metadataInstanceID   = 6
+	metadataSequence     = 7
+)
+
+const (
+	columnSrcIP        = 1
+	columnDstIP        = 2
+	columnSrcPort      = 3
+	columnDstPort      = 4
+	columnTraffic      = 5
+	columnSquaredSizes = 6
+	columnIfindex      = 7
+)
+
+type column struct {
+	typ  uint8
+	size uint8
+}
+
+// encodeVersioned encodes entries with Version2 or Version3.
+func encodeVersioned(keys []IPKey, values []IPValue, opts Options) []byte {
+	buf := binary.BigEndian.AppendUint16(Magic[:len(Magic):len(Magic)], uint16(opts.Version))
+
+	if opts.SampleRate > 1 {
+		buf = appendField(buf, fieldSampleRate, binary.BigEndian.AppendUint32(nil, opts.SampleRate))
+	}
+	if opts.Interfaces != nil {
+		buf = appendField(buf, fieldInterfaces, appendInterfaces(nil, opts.Interfaces))
+	}
+	if opts.Metadata != nil {
+		buf = appendField(buf, fieldMetadata, appendMetadata(nil, *opts.Metadata))
+	}
+
+	columns := entryColumns(opts)
+	if opts.Version == Version3 {
+		return appendField(buf, fieldCompactEntries, appendCompactEntries(nil, columns, keys, values))
+	}
+
+	entries := binary.AppendUvarint(nil, uint64(len(columns)))
+	entrySize := 0
+	for _, c := range columns {
+		entries = append(entries, c.typ, c.size)
+		entrySize += int(c.size)
+	}
+	entries = binary.AppendUvarint(entries, uint64(len(keys)))
+	entries = growBytes(entries, entrySize*len(keys))
+	for i, key := range keys {
+		for _, c := range columns {
+			switch c.typ {
+			case columnSrcIP:
+				entries = binary.BigEndian.AppendUint32(entries, byteorder.Ntohl(key.SrcIP))
+			case columnDstIP:
+				entries = binary.BigEndian.AppendUint32(entries, byteorder.Ntohl(key.DstIP))
+			case columnSrcPort:
+				entries = binary.BigEndian.AppendUint16(entries, key.SrcPort)
+			case columnDstPort:
+				entries = binary.BigEndian.AppendUint16(entries, key.DstPort)
+			case columnTraffic:
+				entries = binary.BigEndian.AppendUint64(entries, values[i].PacketSize)
+			case columnSquaredSizes:
+				entries = binary.BigEndian.AppendUint64(entries, values[i].SquaredSizes)
+			case columnIfindex:
+				entries = binary.BigEndian.AppendUint32(entries, key.Ifindex)
+			}
+		}
+	}
+	return appendField(buf, fieldEntries, entries)
+}
+
+// entryColumns returns the columns of entries encoded with opts.
+func entryColumns(opts Options) []column {
+	columns := []column{
+		{columnSrcIP, 4},
+		{columnDstIP, 4},
+		{columnSrcPort, 2},
+		{columnDstPort, 2},
+		{columnTraffic, 8},
+	}
+	if opts.SampleRate > 1 {
+		columns = append(columns, column{columnSquaredSizes, 8})
+	}
+	if opts.Interfaces != nil {
+		columns = append(columns, column{columnIfindex, 4})
+	}
+	return columns
+}
+
+func appendField(buf []byte, typ uint8, data []byte) []byte {
+	buf = append(buf, typ)
+	buf = binary.AppendUvarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+func appendMetadata(buf []byte, m Metadata) []byte {
+	for _, field := range []struct {
+		typ   uint8
+		value string
+	}{
+		{metadataNode, m.Node},
+		{metadataAgentVersion, m.AgentVersion},
+		{metadataCaptureMode, m.CaptureMode},
+		{metadataInstanceID, m.InstanceID},
+	} {
+		if field.value != "" {
+			buf = appendField(buf, field.typ, []byte(field.value))
+		}
+	}
+	if !m.WindowStart.IsZero() {
+		buf = appendField(buf, metadataWindowStart, binary.BigEndian.AppendUint64(nil, uint64(m.WindowStart.UnixNano())))
+	}
+	if !m.WindowEnd.IsZero() {
+		buf = appendField(buf, metadataWindowEnd, binary.BigEndian.AppendUint64(nil, uint64(m.WindowEnd.UnixNano())))
+	}
+	if m.Sequence != 0 {
+		buf = appendField(buf, metadataSequence, binary.BigEndian.AppendUint64(nil, m.Sequence))
+	}
+	return buf
+}
+
+func appendInterfaces(buf []byte, interfaces map[uint32]string) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(interfaces)))
+	for ifindex, name := range interfaces {
+		buf = binary.BigEndian.AppendUint32(buf, ifindex)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(name)))
+		buf = append(buf, name...)
+	}
+	return buf
+}
+
+// growBytes grows the capacity of buf by at least n bytes.
+func growBytes(buf []byte, n int) []byte {
+	if cap(buf)-len(buf) >= n {
+		return buf
+	}
+	grown := make([]byte, len(buf), len(buf)+n)
+	copy(grown, buf)
+	return grown
+}
+
+// isVersioned reports whether buf starts with Magic.
+func isVersioned(buf []byte) bool {
+	return len(buf) >= len(Magic) && [4]byte(buf[:4]) == Magic
+}
+
+// decodeFields calls f with the type and data of every field in buf.
+func decodeFields(buf []byte, f func(typ uint8, data []byte) error) error {
+	for len(buf) > 0 {
+		typ := buf[0]
+		length, n := binary.Uvarint(buf[1:])
+		if n <= 0 || length > uint64(len(buf)-1-n) {
+			return fmt.Errorf("unexpected length of field %d", typ)
+		}
+		data := buf[1+n : 1+n+int(length)]
+		buf = buf[1+n+int(length):]
+
+		if err := f(typ, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeMetadata(buf []byte) (Metadata, error) {
+	var m Metadata
+	err := decodeFields(buf, func(typ uint8, data []byte) error {
+		switch typ {
+		case metadataNode:
+			m.Node = string(data)
+		case metadataAgentVersion:
+			m.AgentVersion = string(data)
+		case metadataCaptureMode:
+			m.CaptureMode = string(data)
+		case metadataInstanceID:
+			m.InstanceID = string(data)
+		case metadataWindowStart, metadataWindowEnd:
+			if len(data) != 8 {
+				return errors.New("unexpected length of window time")
+			}
+			t := time.Unix(0, int64(binary.BigEndian.Uint64(data)))
+			if typ == metadataWindowStart {
+				m.WindowStart = t
+			} else {
+				m.WindowEnd = t
+			}
+		case metadataSequence:
+			if len(data) != 8 {
+				return errors.New("unexpected length of sequence number")
+			}
+			m.Sequence = binary.BigEndian.Uint64(data)
+		default:
+			// Fields added by later versions of the encoding.
+		}
+		return nil
+	})
+	return m, err
+}
+
+// checkColumnSize checks that known columns have the size of their type.
+func checkColumnSize(c column) error {
+	var size uint8
+	switch c.typ {
+	case columnSrcIP, columnDstIP, columnIfindex:
+		size = 4
+	case columnSrcPort, columnDstPort:
+		size = 2
+	case columnTraffic, columnSquaredSizes:
+		size = 8
+	default:
+		return nil
+	}
+	if c.size != size {
+		return fmt.Errorf("unexpected size %d of column %d", c.size, c.typ)
+	}
+	return nil
+}